@@ -0,0 +1,306 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"sort"
+)
+
+// An archive is a sequence of segments. Each segment holds the version 3
+// encodings of its sketches, then its index, then a footer:
+//
+//	index:  "HLLI", a uvarint entry count, and for each entry, sorted by
+//	        key, a uvarint key length, the key, and the uvarint offset and
+//	        length of the sketch's encoding in the archive.
+//	footer: "HLLA", the archive version 1, 3 zero bytes, the big endian
+//	        uint64 offsets of the index and of the segment's start, and
+//	        the big endian CRC-32C of the index and of the footer's first
+//	        24 bytes.
+//
+// A segment starts where the previous one's footer ends, so the footer at the
+// end of the archive leads to every segment.
+const (
+	archiveMagic      = "HLLA"
+	archiveIndexMagic = "HLLI"
+	archiveVersion    = 1
+	archiveFooterSize = 28
+)
+
+var errArchiveClosed = errors.New("hyperloglog: archive segment is closed")
+
+// ArchiveWriter writes a segment of keyed sketches to an archive that
+// OpenArchive reads. Use NewArchiveWriter to create one.
+type ArchiveWriter struct {
+	w io.Writer
+	// start is the offset of the segment in the archive, and off the offset
+	// of the next byte written.
+	start, off int64
+	entries    []archiveEntry
+	buf        []byte
+	err        error
+}
+
+type archiveEntry struct {
+	key         string
+	off, length int64
+}
+
+// NewArchiveWriter returns an ArchiveWriter that writes a new segment to w.
+// To start an archive, size is 0. To append to an archive, w has to write
+// after its end and size has to be its size, such as the size of a file
+// opened for appending; the segment then adds to the archive's sketches.
+func NewArchiveWriter(w io.Writer, size int64) *ArchiveWriter {
+	return &ArchiveWriter{w: w, start: size, off: size}
+}
+
+// Add writes sk under key. A key may be added more than once, in the same or
+// in different segments; reading it merges all of its sketches. A zero-value
+// Sketch returns an error wrapping ErrorInvalidPrecision and writes nothing.
+// Once w has failed, every call returns its error.
+func (a *ArchiveWriter) Add(key string, sk *Sketch) error {
+	if a.err != nil {
+		return a.err
+	}
+	data, err := sk.AppendBinaryV3(a.buf[:0])
+	if err != nil {
+		return err
+	}
+	a.buf = data
+	if err := a.write(data); err != nil {
+		return err
+	}
+	a.entries = append(a.entries, archiveEntry{key, a.off - int64(len(data)), int64(len(data))})
+	return nil
+}
+
+func (a *ArchiveWriter) write(data []byte) error {
+	if _, err := a.w.Write(data); err != nil {
+		a.err = fmt.Errorf("hyperloglog: writing archive: %w", err)
+		return a.err
+	}
+	a.off += int64(len(data))
+	return nil
+}
+
+// Close writes the segment's index and footer, which makes the sketches added
+// readable. It does not close w. Adding or closing again after Close returns
+// an error.
+func (a *ArchiveWriter) Close() error {
+	if a.err != nil {
+		return a.err
+	}
+	slices.SortStableFunc(a.entries, func(x, y archiveEntry) int { return cmp.Compare(x.key, y.key) })
+	index := append(a.buf[:0], archiveIndexMagic...)
+	index = binary.AppendUvarint(index, uint64(len(a.entries)))
+	for _, e := range a.entries {
+		index = binary.AppendUvarint(index, uint64(len(e.key)))
+		index = append(index, e.key...)
+		index = binary.AppendUvarint(index, uint64(e.off))
+		index = binary.AppendUvarint(index, uint64(e.length))
+	}
+	index = append(index, archiveMagic...)
+	index = append(index, archiveVersion, 0, 0, 0)
+	index = binary.BigEndian.AppendUint64(index, uint64(a.off))
+	index = binary.BigEndian.AppendUint64(index, uint64(a.start))
+	index = binary.BigEndian.AppendUint32(index, crc32.Checksum(index, castagnoli))
+	if err := a.write(index); err != nil {
+		return err
+	}
+	a.err = errArchiveClosed
+	return nil
+}
+
+// Archive reads the keyed sketches of an archive written by ArchiveWriter.
+// Use OpenArchive to create one. An Archive is safe for concurrent use if its
+// io.ReaderAt is.
+type Archive struct {
+	r io.ReaderAt
+	// segments hold the index of every segment, the oldest first.
+	segments [][]archiveEntry
+}
+
+// OpenArchive reads the indexes of the archive of the given size that r
+// reads. Every footer and index is validated: an archive that is truncated or
+// corrupted returns an error wrapping ErrorTooShort, ErrorInvalidData,
+// ErrorChecksum or ErrorInvalidVersion. The sketches themselves are only read
+// and validated when they are looked up.
+func OpenArchive(r io.ReaderAt, size int64) (*Archive, error) {
+	a := &Archive{r: r}
+	for end := size; end > 0; {
+		if end < archiveFooterSize {
+			return nil, fmt.Errorf("hyperloglog: archive segment ending at %d is shorter than a footer: %w", end, ErrorTooShort)
+		}
+		var footer [archiveFooterSize]byte
+		if err := readArchiveAt(r, footer[:], end-archiveFooterSize); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(footer[:4], []byte(archiveMagic)) {
+			return nil, fmt.Errorf("hyperloglog: archive footer at %d has magic %q: %w", end-archiveFooterSize, footer[:4], ErrorInvalidData)
+		}
+		if footer[4] != archiveVersion {
+			return nil, fmt.Errorf("hyperloglog: archive footer at %d has version %d: %w", end-archiveFooterSize, footer[4], ErrorInvalidVersion)
+		}
+		indexOff := int64(binary.BigEndian.Uint64(footer[8:16]))
+		start := int64(binary.BigEndian.Uint64(footer[16:24]))
+		footerOff := end - archiveFooterSize
+		if footer[5]|footer[6]|footer[7] != 0 || start < 0 || indexOff < start || indexOff > footerOff {
+			return nil, fmt.Errorf("hyperloglog: archive footer at %d has segment start %d and index offset %d: %w", footerOff, start, indexOff, ErrorInvalidData)
+		}
+
+		index := make([]byte, footerOff-indexOff)
+		if err := readArchiveAt(r, index, indexOff); err != nil {
+			return nil, err
+		}
+		sum := crc32.Update(crc32.Checksum(index, castagnoli), castagnoli, footer[:24])
+		if want := binary.BigEndian.Uint32(footer[24:]); sum != want {
+			return nil, fmt.Errorf("hyperloglog: archive segment at %d: CRC-32C %#08x, footer says %#08x: %w", start, sum, want, ErrorChecksum)
+		}
+		entries, err := parseArchiveIndex(index, indexOff, start)
+		if err != nil {
+			return nil, err
+		}
+		a.segments = append(a.segments, entries)
+		end = start
+	}
+	slices.Reverse(a.segments)
+	return a, nil
+}
+
+// parseArchiveIndex parses the index at offset off of a segment that starts
+// at start.
+func parseArchiveIndex(index []byte, off, start int64) ([]archiveEntry, error) {
+	if !bytes.HasPrefix(index, []byte(archiveIndexMagic)) {
+		return nil, fmt.Errorf("hyperloglog: archive index at %d has no magic: %w", off, ErrorInvalidData)
+	}
+	pos := len(archiveIndexMagic)
+	uvarint := func(what string) (uint64, error) {
+		x, n := binary.Uvarint(index[pos:])
+		if n <= 0 {
+			return 0, fmt.Errorf("hyperloglog: archive index at %d: %s at %d is malformed: %w", off, what, off+int64(pos), ErrorInvalidData)
+		}
+		pos += n
+		return x, nil
+	}
+	count, err := uvarint("entry count")
+	if err != nil {
+		return nil, err
+	}
+	// Every entry takes at least 3 bytes, so the count is checked against
+	// the index before anything is sized from it.
+	if count > uint64(len(index)-pos)/3 {
+		return nil, fmt.Errorf("hyperloglog: archive index at %d: %d entries in %d bytes: %w", off, count, len(index)-pos, ErrorInvalidData)
+	}
+	entries := make([]archiveEntry, count)
+	for i := range entries {
+		n, err := uvarint("key length")
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(index)-pos) {
+			return nil, fmt.Errorf("hyperloglog: archive index at %d: key of %d bytes at %d: %w", off, n, off+int64(pos), ErrorInvalidData)
+		}
+		key := string(index[pos : pos+int(n)])
+		pos += int(n)
+		at, err := uvarint("sketch offset")
+		if err != nil {
+			return nil, err
+		}
+		length, err := uvarint("sketch length")
+		if err != nil {
+			return nil, err
+		}
+		if at < uint64(start) || at > uint64(off) || length > uint64(off)-at {
+			return nil, fmt.Errorf("hyperloglog: archive index at %d: sketch %q at %d of %d bytes is outside the segment: %w", off, key, at, length, ErrorInvalidData)
+		}
+		if i > 0 && key < entries[i-1].key {
+			return nil, fmt.Errorf("hyperloglog: archive index at %d: key %q after %q: %w", off, key, entries[i-1].key, ErrorInvalidData)
+		}
+		entries[i] = archiveEntry{key, int64(at), int64(length)}
+	}
+	if pos != len(index) {
+		return nil, fmt.Errorf("hyperloglog: archive index at %d has %d trailing bytes: %w", off, len(index)-pos, ErrorInvalidData)
+	}
+	return entries, nil
+}
+
+// readArchiveAt fills buf from r at offset off. As io.ReaderAt allows, a read
+// that ends at the end of the input may return io.EOF along with all of buf.
+func readArchiveAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if err == nil || err == io.EOF && n == len(buf) {
+		return nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("hyperloglog: archive read at %d: %w", off, ErrorTooShort)
+	}
+	return fmt.Errorf("hyperloglog: archive read at %d: %w", off, err)
+}
+
+// Len returns the number of distinct keys in the archive.
+func (a *Archive) Len() int { return len(a.Keys()) }
+
+// Keys returns the distinct keys in the archive, sorted.
+func (a *Archive) Keys() []string {
+	var keys []string
+	for _, entries := range a.segments {
+		for _, e := range entries {
+			keys = append(keys, e.key)
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// Get returns the sketch stored under key, merging every sketch added under
+// it, and whether there is any. A sketch that does not decode returns an error
+// wrapping the sentinel UnmarshalBinary returned, and sketches of different
+// precisions under one key one wrapping ErrorPrecisionMismatch.
+func (a *Archive) Get(key string) (*Sketch, bool, error) {
+	var merged *Sketch
+	var buf []byte
+	for _, entries := range a.segments {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].key >= key })
+		for ; i < len(entries) && entries[i].key == key; i++ {
+			e := entries[i]
+			buf = slices.Grow(buf[:0], int(e.length))[:e.length]
+			if err := readArchiveAt(a.r, buf, e.off); err != nil {
+				return nil, false, err
+			}
+			sk := &Sketch{}
+			if err := sk.UnmarshalBinary(buf); err != nil {
+				return nil, false, fmt.Errorf("hyperloglog: archive sketch %q at %d: %w", key, e.off, err)
+			}
+			if merged == nil {
+				merged = sk
+				continue
+			}
+			if err := merged.Merge(sk); err != nil {
+				return nil, false, fmt.Errorf("hyperloglog: archive sketch %q at %d: %w", key, e.off, err)
+			}
+		}
+	}
+	return merged, merged != nil, nil
+}
+
+// Compact writes to w a new archive of a single segment that holds every key
+// once, with all of its sketches merged. Errors from Get are returned as they
+// are, and w may then hold an incomplete archive.
+func (a *Archive) Compact(w io.Writer) error {
+	aw := NewArchiveWriter(w, 0)
+	for _, key := range a.Keys() {
+		sk, _, err := a.Get(key)
+		if err != nil {
+			return err
+		}
+		if err := aw.Add(key, sk); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
@@ -0,0 +1,154 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	// want holds what each key should read back as.
+	want := make(map[string]*Sketch)
+	var buf bytes.Buffer
+	writeSegment := func(keys []string) {
+		aw := NewArchiveWriter(&buf, int64(buf.Len()))
+		for _, key := range keys {
+			sk := newSketchNoError(14, rand.Intn(2) == 0)
+			for i := 0; i < rand.Intn(5000); i++ {
+				sk.InsertHash(rand.Uint64())
+			}
+			require.NoError(t, aw.Add(key, sk))
+			if want[key] == nil {
+				want[key] = &Sketch{}
+			}
+			require.NoError(t, want[key].Merge(sk))
+		}
+		require.NoError(t, aw.Close())
+		require.ErrorIs(t, aw.Add("late", New()), errArchiveClosed)
+	}
+	writeSegment([]string{"b", "a", "c", "a", ""})
+	writeSegment(nil)
+	var many []string
+	for i := 0; i < 100; i++ {
+		many = append(many, fmt.Sprintf("key-%03d", i))
+	}
+	writeSegment(append(many, "a", "d"))
+
+	check := func(data []byte, segments int) {
+		a, err := OpenArchive(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		// io.ReaderAt allows io.EOF with a read that ends at the end.
+		_, err = OpenArchive(eofReaderAt{data}, int64(len(data)))
+		require.NoError(t, err)
+		require.Len(t, a.segments, segments)
+		require.Equal(t, len(want), a.Len())
+		require.Equal(t, append([]string{"", "a", "b", "c", "d"}, many...), a.Keys())
+		for key, sk := range want {
+			got, ok, err := a.Get(key)
+			require.NoError(t, err, key)
+			require.True(t, ok, key)
+			require.Equal(t, denseRegs(sk), denseRegs(got), key)
+		}
+		got, ok, err := a.Get("missing")
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Nil(t, got)
+	}
+	check(buf.Bytes(), 3)
+
+	var compacted bytes.Buffer
+	a, err := OpenArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.NoError(t, a.Compact(&compacted))
+	check(compacted.Bytes(), 1)
+	require.Less(t, compacted.Len(), buf.Len())
+
+	a, err = OpenArchive(bytes.NewReader(nil), 0)
+	require.NoError(t, err)
+	require.Zero(t, a.Len())
+}
+
+// eofReaderAt returns io.EOF along with every read that reaches the end of
+// data, as io.ReaderAt allows.
+type eofReaderAt struct{ data []byte }
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := bytes.NewReader(r.data).ReadAt(p, off)
+	if err == nil && off+int64(n) == int64(len(r.data)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestArchive_Corrupt(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewArchiveWriter(&buf, 0)
+	sk := New()
+	for i := 0; i < 100; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+	require.NoError(t, aw.Add("a", sk))
+	require.NoError(t, aw.Add("b", New16()))
+	require.NoError(t, aw.Close())
+	first := buf.Len()
+	aw = NewArchiveWriter(&buf, int64(first))
+	require.NoError(t, aw.Add("b", New()))
+	require.NoError(t, aw.Close())
+	data := buf.Bytes()
+
+	// Any change to an index or a footer is caught when opening.
+	for _, end := range []int{first, len(data)} {
+		index := int(binary.BigEndian.Uint64(data[end-archiveFooterSize+8:]))
+		for i := index; i < end; i++ {
+			corrupt := bytes.Clone(data)
+			corrupt[i] ^= 0x10
+			_, err := OpenArchive(bytes.NewReader(corrupt), int64(len(corrupt)))
+			require.Error(t, err, "byte %d", i)
+		}
+	}
+	for _, size := range []int{1, archiveFooterSize, first - 1, first + 1, len(data) - 1} {
+		_, err := OpenArchive(bytes.NewReader(data[:size]), int64(size))
+		require.Error(t, err, "size %d", size)
+	}
+	_, err := OpenArchive(bytes.NewReader(data[:first]), int64(len(data)))
+	require.ErrorIs(t, err, ErrorTooShort)
+
+	// The index and footers of the second segment.
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)-1] ^= 1
+	_, err = OpenArchive(bytes.NewReader(corrupt), int64(len(corrupt)))
+	require.ErrorIs(t, err, ErrorChecksum)
+	corrupt = bytes.Clone(data)
+	corrupt[len(corrupt)-archiveFooterSize] = 'X'
+	_, err = OpenArchive(bytes.NewReader(corrupt), int64(len(corrupt)))
+	require.ErrorIs(t, err, ErrorInvalidData)
+	corrupt = bytes.Clone(data)
+	corrupt[len(corrupt)-archiveFooterSize+4] = 2
+	_, err = OpenArchive(bytes.NewReader(corrupt), int64(len(corrupt)))
+	require.ErrorIs(t, err, ErrorInvalidVersion)
+
+	// A sketch is only validated when it is read.
+	corrupt = bytes.Clone(data)
+	corrupt[10] ^= 1
+	a, err := OpenArchive(bytes.NewReader(corrupt), int64(len(corrupt)))
+	require.NoError(t, err)
+	_, _, err = a.Get("a")
+	require.ErrorIs(t, err, ErrorChecksum)
+
+	// "b" has precisions 16 and 14.
+	a, err = OpenArchive(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	_, _, err = a.Get("b")
+	require.ErrorIs(t, err, ErrorPrecisionMismatch)
+	require.ErrorIs(t, a.Compact(&bytes.Buffer{}), ErrorPrecisionMismatch)
+
+	require.ErrorIs(t, NewArchiveWriter(&buf, 0).Add("z", &Sketch{}), ErrorInvalidPrecision)
+	aw = NewArchiveWriter(failingWriter{ErrorTooShort}, 0)
+	require.ErrorIs(t, aw.Add("a", sk), ErrorTooShort)
+	require.ErrorIs(t, aw.Close(), ErrorTooShort)
+}
@@ -0,0 +1,225 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"slices"
+)
+
+const versionV3 = 3
+
+// castagnoli is the CRC-32C table, the checksum of the version 3 format.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrorChecksum is returned, wrapped, when a version 3 encoding does not match
+// its checksum. It wraps ErrorInvalidData, so errors.Is matches both.
+var ErrorChecksum = fmt.Errorf("checksum mismatch: %w", ErrorInvalidData)
+
+// registerModelShift sets how fast the register model adapts: each coded bit
+// moves its probability 1/32 of the way towards the bit.
+const registerModelShift = 5
+
+// registerModel is an adaptive model of 6 bit register values, coded as a
+// binary tree: node 1 codes the top bit, and node n's children are 2n and
+// 2n+1. Each node holds the probability, in units of 1/probTotal, that its
+// bit is 0.
+type registerModel [64]uint32
+
+func newRegisterModel() *registerModel {
+	var m registerModel
+	for i := range m {
+		m[i] = probTotal / 2
+	}
+	return &m
+}
+
+// code walks the tree for one register, handing each node's probability to
+// bit, which codes or decodes the bit and returns it. It returns the value.
+func (m *registerModel) code(bit func(want bool, p0 uint32) bool, v uint8) uint8 {
+	node := 1
+	for i := 5; i >= 0; i-- {
+		b := bit(v>>i&1 == 1, clampProb(m[node]))
+		if b {
+			m[node] -= m[node] >> registerModelShift
+			node = 2*node + 1
+		} else {
+			m[node] += (probTotal - m[node]) >> registerModelShift
+			node = 2 * node
+		}
+	}
+	return uint8(node - 64)
+}
+
+// MarshalBinaryV3 returns the version 3 encoding of sk. See AppendBinaryV3.
+func (sk *Sketch) MarshalBinaryV3() ([]byte, error) {
+	return sk.AppendBinaryV3(nil)
+}
+
+// AppendBinaryV3 appends the version 3 encoding of sk to data. Version 3 is
+// smaller than version 2, which MarshalBinary and AppendBinary still write so
+// that older readers can decode them, and it ends with a checksum that
+// catches corruption. UnmarshalBinary reads both; see it for the format.
+//
+// As for AppendBinary, a zero-value Sketch returns an error wrapping
+// ErrorInvalidPrecision and one fed by another hash function than HashMetro
+// an error wrapping ErrorHashMismatch, leaving data unmodified, and the
+// encoding is not canonical.
+func (sk *Sketch) AppendBinaryV3(data []byte) ([]byte, error) {
+	if err := sk.checkBinary(); err != nil {
+		return data, err
+	}
+	start := len(data)
+	if sk.sparse() {
+		data = append(data, versionV3, sk.p, 0, 1)
+
+		keys := make([]uint32, 0, sk.tmpSet.Len())
+		sk.tmpSet.ForEach(func(k uint32) { keys = append(keys, k) })
+		slices.Sort(keys)
+		data = binary.AppendUvarint(data, uint64(len(keys)))
+		var last uint32
+		for _, k := range keys {
+			data = binary.AppendUvarint(data, uint64(k-last))
+			last = k
+		}
+
+		data = binary.AppendUvarint(data, uint64(sk.sparseList.Len()))
+		data = append(data, sk.sparseList.b...)
+	} else {
+		data = append(data, versionV3, sk.p, 0, 0)
+		enc := newRangeEncoder(data)
+		model := newRegisterModel()
+		for _, r := range sk.regs {
+			model.code(func(bit bool, p0 uint32) bool {
+				enc.encode(bit, p0)
+				return bit
+			}, r)
+		}
+		data = enc.finish()
+	}
+	return binary.BigEndian.AppendUint32(data, crc32.Checksum(data[start:], castagnoli)), nil
+}
+
+// parseBinaryV3 requires data to be at least 8 bytes long and to start with
+// version 3. The registers of a dense encoding are left to forEachRegister,
+// which validates them as it decodes them.
+func parseBinaryV3(data []byte, opts DecodeOptions) (binaryView, error) {
+	body := data[:len(data)-4]
+	if sum, want := crc32.Checksum(body, castagnoli), binary.BigEndian.Uint32(data[len(body):]); sum != want {
+		return binaryView{}, decodeError(len(body), "checksum", ErrorChecksum, "CRC-32C %#08x, encoding says %#08x", sum, want)
+	}
+	p := data[1]
+	if err := opts.checkPrecision(p); err != nil {
+		return binaryView{}, err
+	}
+	if data[2] != 0 || data[3] > 1 {
+		return binaryView{}, decodeError(2, "header", ErrorInvalidData, "v3 header bytes 2:4 = %#x %#x", data[2], data[3])
+	}
+	m := uint32(1) << p
+	off := 4
+	view := binaryView{version: versionV3, p: p, sparse: data[3] == 1}
+
+	if !view.sparse {
+		view.regs = body[off:]
+		return view, nil
+	}
+	if err := opts.checkSparse(); err != nil {
+		return binaryView{}, err
+	}
+
+	uvarint := func(field string) (uint64, error) {
+		x, n := binary.Uvarint(body[off:])
+		switch {
+		case n == 0:
+			return 0, decodeError(off, field, ErrorTooShort, "missing uvarint")
+		case n < 0:
+			return 0, decodeError(off, field, ErrorInvalidData, "uvarint overflows")
+		}
+		off += n
+		return x, nil
+	}
+
+	countOff := off
+	n, err := uvarint("tmp set count")
+	if err != nil {
+		return binaryView{}, err
+	}
+	// Every key takes at least a byte, so the count is checked against the
+	// bytes left before anything is sized from it.
+	if n > uint64(m) {
+		return binaryView{}, decodeError(countOff, "tmp set count", ErrorInvalidData, "count %d exceeds register count %d", n, m)
+	}
+	if n > uint64(len(body)-off) {
+		return binaryView{}, decodeError(countOff, "tmp set count", ErrorTooShort, "%d keys in %d bytes", n, len(body)-off)
+	}
+	if err := opts.checkSparseKeys(countOff, "tmp set count", n); err != nil {
+		return binaryView{}, err
+	}
+	keysOff := off
+	var last uint64
+	for i := range n {
+		keyOff := off
+		delta, err := uvarint("tmp set key")
+		if err != nil {
+			return binaryView{}, err
+		}
+		if i > 0 && delta == 0 || delta > 1<<32-1-last {
+			return binaryView{}, decodeError(keyOff, "tmp set key", ErrorInvalidData, "key %d does not increase the key past %d or overflows", i, last)
+		}
+		k := last + delta
+		if err := checkSparseKey(uint32(k), p, keyOff, "tmp set key"); err != nil {
+			return binaryView{}, err
+		}
+		last = k
+	}
+	view.tmpSet, view.tmpCount = body[keysOff:off], int(n)
+
+	sizeOff := off
+	sz, err := uvarint("compressed list size")
+	if err != nil {
+		return binaryView{}, err
+	}
+	if err := decodeLen(off, "compressed list stream", uint64(len(body)-off), sz); err != nil {
+		return binaryView{}, err
+	}
+	b := variableLengthList(body[off:])
+	count, last32, err := b.walk(p, off)
+	if err != nil {
+		return binaryView{}, err
+	}
+	if count >= mp {
+		return binaryView{}, decodeError(off, "compressed list stream", ErrorInvalidData, "count %d >= %d", count, mp)
+	}
+	if err := opts.checkSparseKeys(sizeOff, "compressed list size", n+uint64(count)); err != nil {
+		return binaryView{}, err
+	}
+	view.list = compressedList{count: count, last: last32, b: b}
+	return view, nil
+}
+
+// forEachRegisterV3 decodes the range coded registers of a version 3
+// encoding, found at offset 4, and calls fn with each. It requires p to have
+// passed checkPrecision.
+func forEachRegisterV3(stream []byte, p uint8, fn func(i int, r uint8)) error {
+	const off = 4
+	dec, ok := newRangeDecoder(stream)
+	if !ok {
+		return decodeError(off, "register stream", ErrorInvalidData, "malformed range coder state")
+	}
+	model := newRegisterModel()
+	maxRho := maxRho(p)
+	for i := range 1 << p {
+		r := model.code(func(_ bool, p0 uint32) bool { return dec.decode(p0) }, 0)
+		if r > maxRho {
+			return decodeError(off, "register stream", ErrorInvalidData, "register %d = %d, max %d", i, r, maxRho)
+		}
+		fn(i, r)
+	}
+	switch {
+	case dec.short:
+		return decodeError(off, "register stream", ErrorTooShort, "stream ends early")
+	case !dec.done():
+		return decodeError(off, "register stream", ErrorInvalidData, "%d trailing bytes", len(stream)-dec.pos)
+	}
+	return nil
+}
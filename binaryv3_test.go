@@ -0,0 +1,154 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withChecksum replaces the last 4 bytes of a version 3 blob with the checksum
+// of the rest, so that a test can reach the checks behind it.
+func withChecksum(blob []byte) []byte {
+	body := blob[:len(blob)-4]
+	return binary.BigEndian.AppendUint32(body, crc32.Checksum(body, castagnoli))
+}
+
+func TestHLL_BinaryV3(t *testing.T) {
+	for _, p := range []uint8{4, 10, 14, 18} {
+		for _, n := range []int{0, 10, 1000, 100000} {
+			for _, sparse := range []bool{true, false} {
+				sk := newSketchNoError(p, sparse)
+				for i := 0; i < n; i++ {
+					sk.InsertHash(rand.Uint64())
+				}
+				if n == 1000 {
+					// Leave keys in both the tmp set and the sparse list.
+					sk.Estimate()
+					for i := 0; i < 20; i++ {
+						sk.InsertHash(rand.Uint64())
+					}
+				}
+
+				data, err := sk.MarshalBinaryV3()
+				require.NoError(t, err)
+				require.Equal(t, byte(3), data[0])
+				appended, err := sk.AppendBinaryV3([]byte{0xaa})
+				require.NoError(t, err)
+				require.Equal(t, append([]byte{0xaa}, data...), appended)
+				v2, err := sk.MarshalBinary()
+				require.NoError(t, err)
+				switch {
+				case !sk.sparse() && n > 0 && p >= 10:
+					require.Less(t, len(data), len(v2)/2, "p=%d n=%d", p, n)
+				case sk.tmpSet.Len() == 0:
+					// Few tmp set keys are far apart and can take 5
+					// bytes each instead of 4, so only compacted
+					// sparse sketches are compared.
+					require.LessOrEqual(t, len(data), len(v2), "p=%d n=%d", p, n)
+				}
+
+				got := &Sketch{}
+				require.NoError(t, got.UnmarshalBinary(data), "p=%d n=%d sparse=%v", p, n, sparse)
+				require.Equal(t, sk.sparse(), got.sparse())
+				require.Equal(t, sk.tmpSet.Len(), got.tmpSet.Len())
+				require.Equal(t, denseRegs(sk), denseRegs(got))
+				require.Equal(t, sk.Estimate(), got.Estimate())
+			}
+		}
+	}
+
+	_, err := (&Sketch{}).MarshalBinaryV3()
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	data, err := NewRedis().AppendBinaryV3([]byte{1})
+	require.ErrorIs(t, err, ErrorHashMismatch)
+	require.Equal(t, []byte{1}, data)
+}
+
+func TestHLL_BinaryV3_Corrupt(t *testing.T) {
+	for _, sparse := range []bool{true, false} {
+		sk := newSketchNoError(14, sparse)
+		for i := 0; i < 3000; i++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		data, err := sk.MarshalBinaryV3()
+		require.NoError(t, err)
+
+		target := New()
+		target.InsertHash(1)
+		want := target.Clone()
+		for i := range data {
+			corrupt := append([]byte(nil), data...)
+			corrupt[i] ^= 1 << rand.Intn(8)
+			err := target.UnmarshalBinary(corrupt)
+			if i == 0 {
+				// The version no longer says 3.
+				require.Error(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrorChecksum, "byte %d", i)
+				require.ErrorIs(t, err, ErrorInvalidData)
+			}
+		}
+		for _, n := range []int{8, len(data) / 2, len(data) - 1} {
+			require.Error(t, target.UnmarshalBinary(data[:n]))
+		}
+		require.Equal(t, want.Fingerprint(), target.Fingerprint())
+	}
+}
+
+func TestHLL_BinaryV3_Malformed(t *testing.T) {
+	// denseStream range codes registers with the version 3 model.
+	denseStream := func(regs []uint8) []byte {
+		enc := newRangeEncoder(nil)
+		model := newRegisterModel()
+		for _, r := range regs {
+			model.code(func(bit bool, p0 uint32) bool {
+				enc.encode(bit, p0)
+				return bit
+			}, r)
+		}
+		return enc.finish()
+	}
+	regs := make([]uint8, 16)
+	stream := denseStream(regs)
+	tooLarge := append([]uint8(nil), regs...)
+	tooLarge[3] = 62
+
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		wantErr error
+	}{
+		{"header byte 2", append([]byte{3, 4, 1, 0}, stream...), ErrorInvalidData},
+		{"header byte 3", append([]byte{3, 4, 0, 2}, stream...), ErrorInvalidData},
+		{"precision", append([]byte{3, 19, 0, 0}, stream...), ErrorInvalidPrecision},
+		{"register too large", append([]byte{3, 4, 0, 0}, denseStream(tooLarge)...), ErrorInvalidData},
+		{"register stream short", append([]byte{3, 4, 0, 0}, stream[:len(stream)-2]...), ErrorTooShort},
+		{"register stream trailing", append(append([]byte{3, 4, 0, 0}, stream...), 0), ErrorInvalidData},
+		{"register stream malformed", []byte{3, 4, 0, 0, 1, 0, 0, 0, 0}, ErrorInvalidData},
+		{"tmp set count", []byte{3, 4, 0, 1, 17}, ErrorInvalidData},
+		{"tmp set short", []byte{3, 4, 0, 1, 3, 2, 2}, ErrorTooShort},
+		{"tmp set repeated key", []byte{3, 4, 0, 1, 2, 2, 0, 0}, ErrorInvalidData},
+		{"tmp set key overflows", []byte{3, 4, 0, 1, 2, 0xfe, 0xff, 0xff, 0xff, 0x0f, 2, 0}, ErrorInvalidData},
+		{"tmp set key varint", []byte{3, 4, 0, 1, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, ErrorInvalidData},
+		{"list size missing", []byte{3, 4, 0, 1, 0}, ErrorTooShort},
+		{"list short", []byte{3, 4, 0, 1, 0, 3, 2}, ErrorTooShort},
+		{"list trailing", []byte{3, 4, 0, 1, 0, 1, 2, 0}, ErrorInvalidData},
+		{"list repeated key", []byte{3, 4, 0, 1, 0, 2, 2, 0}, ErrorInvalidData},
+		{"list key rho", []byte{3, 4, 0, 1, 0, 1, 0x7f}, ErrorInvalidData},
+	} {
+		sk := New()
+		blob := withChecksum(append(tt.payload, 0, 0, 0, 0))
+		require.ErrorIs(t, sk.UnmarshalBinary(blob), tt.wantErr, tt.name)
+		require.Zero(t, sk.Estimate(), tt.name)
+	}
+
+	sk := &Sketch{}
+	require.NoError(t, sk.UnmarshalBinary(withChecksum(append(append([]byte{3, 4, 0, 0}, stream...), 0, 0, 0, 0))))
+	require.Equal(t, regs, sk.regs)
+	require.NoError(t, sk.UnmarshalBinary(withChecksum([]byte{3, 4, 0, 1, 2, 2, 2, 2, 2, 4, 0, 0, 0, 0})))
+	require.Equal(t, 2, sk.tmpSet.Len())
+	require.Equal(t, uint32(2), sk.sparseList.count)
+}
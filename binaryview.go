@@ -0,0 +1,140 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// binaryView is an encoding of a Sketch that parseBinary validated. Its
+// registers and keys are read from the encoding in place.
+type binaryView struct {
+	version uint8
+	p       uint8
+	sparse  bool
+	// regs holds the dense registers: two to a byte biased by bias in
+	// version 1, one to a byte in version 2, and range coded in version 3.
+	regs []byte
+	bias uint8
+	// tmpSet holds the tmpCount keys of the tmp set: big endian uint32s in
+	// version 2, and uvarint deltas in version 3.
+	tmpSet   []byte
+	tmpCount int
+	list     compressedList
+}
+
+// sketch returns a new Sketch holding the encoding.
+func (v *binaryView) sketch() (*Sketch, error) {
+	sk := newSketchNoError(v.p, v.sparse)
+	if v.sparse {
+		sk.tmpSet = makeSet(v.tmpCount)
+		v.forEachTmpKey(func(k uint32) { sk.tmpSet.add(k) })
+		sk.sparseList.count, sk.sparseList.last = v.list.count, v.list.last
+		sk.sparseList.b = append(make(variableLengthList, 0, len(v.list.b)), v.list.b...)
+		return sk, nil
+	}
+	if err := v.forEachRegister(func(i int, r uint8) { sk.regs[i] = r }); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// forEachRegister calls fn with each register of a dense encoding, in order.
+// Only the registers of version 3 are validated here, and fn may have been
+// called with some of them when an error is returned.
+func (v *binaryView) forEachRegister(fn func(i int, r uint8)) error {
+	switch v.version {
+	case 1:
+		for i, b := range v.regs {
+			fn(i*2, b>>4+v.bias)
+			fn(i*2+1, b&0x0f+v.bias)
+		}
+	case 2:
+		for i, r := range v.regs {
+			fn(i, r)
+		}
+	default:
+		return forEachRegisterV3(v.regs, v.p, fn)
+	}
+	return nil
+}
+
+// forEachTmpKey calls fn with each key of the tmp set of a sparse encoding.
+func (v *binaryView) forEachTmpKey(fn func(k uint32)) {
+	if v.version != versionV3 {
+		for i := 0; i < len(v.tmpSet); i += 4 {
+			fn(binary.BigEndian.Uint32(v.tmpSet[i:]))
+		}
+		return
+	}
+	var k uint32
+	for data := v.tmpSet; len(data) > 0; {
+		delta, n := binary.Uvarint(data)
+		k += uint32(delta)
+		fn(k)
+		data = data[n:]
+	}
+}
+
+// MergeBinary merges the sketch encoded in data into sk, with the same result
+// as UnmarshalBinary into a new Sketch followed by Merge, but reading the
+// registers or keys straight from data instead of copying them first. data is
+// validated as strictly as by UnmarshalBinary, and the same errors are
+// returned; an encoding of another precision than sk's returns an error
+// wrapping ErrorPrecisionMismatch, and a sk fed by another hash function than
+// HashMetro, which binary encodings pin, one wrapping ErrorHashMismatch. sk is
+// left unchanged on error.
+func (sk *Sketch) MergeBinary(data []byte) error {
+	view, err := parseBinary(data, DecodeOptions{})
+	if err != nil {
+		return err
+	}
+	if !view.sparse && view.version == versionV3 {
+		// Range coded registers are only validated by decoding them, so they
+		// are decoded once before sk changes.
+		if err := view.forEachRegister(func(int, uint8) {}); err != nil {
+			return err
+		}
+	}
+	if sk.p == 0 {
+		tmp, _ := view.sketch()
+		*sk = *tmp
+		return nil
+	}
+	if sk.hashFunc != HashMetro {
+		return fmt.Errorf("hyperloglog: cannot merge binary encoded %v hashes with %v hashes: %w", HashMetro, sk.hashFunc, ErrorHashMismatch)
+	}
+	if sk.p != view.p {
+		return fmt.Errorf("hyperloglog: cannot merge precision %d with precision %d: %w", sk.p, view.p, ErrorPrecisionMismatch)
+	}
+
+	switch {
+	case sk.sparse() && view.sparse:
+		view.forEachTmpKey(func(k uint32) { sk.tmpSet.add(k) })
+		for iter := view.list.Iter(); iter.HasNext(); {
+			sk.tmpSet.add(iter.Next())
+		}
+		sk.maybeToNormal()
+	case view.sparse:
+		insert := func(k uint32) {
+			i, r := decodeHash(k, sk.p, pp)
+			sk.insert(i, r)
+		}
+		view.forEachTmpKey(insert)
+		for iter := view.list.Iter(); iter.HasNext(); {
+			insert(iter.Next())
+		}
+	default:
+		if sk.sparse() {
+			sk.toNormal()
+		}
+		if view.version == 2 {
+			// The common case, without a call per register.
+			for i, r := range view.regs {
+				sk.regs[i] = max(sk.regs[i], r)
+			}
+			break
+		}
+		_ = view.forEachRegister(func(i int, r uint8) { sk.insert(uint32(i), r) })
+	}
+	return nil
+}
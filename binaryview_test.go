@@ -0,0 +1,141 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLL_MergeBinary(t *testing.T) {
+	newSketch := func(sparse bool, n int) *Sketch {
+		sk := newSketchNoError(10, sparse)
+		for i := 0; i < n; i++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		return sk
+	}
+	// A version 1 blob with a bias of 2 and registers 2 and 3 alternating.
+	v1 := append([]byte{1, 10, 2, 0, 0, 0, 0, 0}, make([]byte, 512)...)
+	for i := 8; i < len(v1); i++ {
+		v1[i] = 0x01
+	}
+
+	var blobs [][]byte
+	for _, sparse := range []bool{true, false} {
+		for _, n := range []int{0, 5, 500} {
+			sk := newSketch(sparse, n)
+			if n == 500 && sk.sparse() {
+				sk.Estimate()
+				sk.InsertHash(rand.Uint64())
+			}
+			v2, err := sk.MarshalBinary()
+			require.NoError(t, err)
+			v3, err := sk.MarshalBinaryV3()
+			require.NoError(t, err)
+			blobs = append(blobs, v2, v3)
+		}
+	}
+	blobs = append(blobs, v1)
+
+	receivers := []func() *Sketch{
+		func() *Sketch { return &Sketch{} },
+		func() *Sketch { return newSketch(true, 0) },
+		func() *Sketch { return newSketch(true, 8) },
+		func() *Sketch { return newSketch(false, 300) },
+	}
+	for _, newReceiver := range receivers {
+		for i, data := range blobs {
+			sk := newReceiver()
+			want := sk.Clone()
+			other := &Sketch{}
+			require.NoError(t, other.UnmarshalBinary(data))
+			require.NoError(t, want.Merge(other))
+
+			require.NoError(t, sk.MergeBinary(data), "blob %d", i)
+			require.Equal(t, want.sparse(), sk.sparse(), "blob %d", i)
+			require.Equal(t, denseRegs(want), denseRegs(sk), "blob %d", i)
+			require.Equal(t, want.Estimate(), sk.Estimate(), "blob %d", i)
+		}
+	}
+}
+
+func TestHLL_MergeBinary_Errors(t *testing.T) {
+	sk := New()
+	for i := 0; i < 1000; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+	want := sk.Fingerprint()
+
+	for _, tt := range unmarshalMalformedTests {
+		if tt.wantErr == nil {
+			continue
+		}
+		require.ErrorIs(t, sk.MergeBinary(tt.blob), tt.wantErr, tt.name)
+	}
+
+	// The register stream fails only after some registers have decoded.
+	regs := make([]uint8, 1<<14)
+	regs[1000] = 60
+	enc := newRangeEncoder(nil)
+	model := newRegisterModel()
+	for _, r := range regs {
+		model.code(func(bit bool, p0 uint32) bool {
+			enc.encode(bit, p0)
+			return bit
+		}, r)
+	}
+	blob := withChecksum(append(append([]byte{3, 14, 0, 0}, enc.finish()...), 0, 0, 0, 0))
+	require.ErrorIs(t, sk.MergeBinary(blob), ErrorInvalidData)
+
+	data, err := New16().MarshalBinary()
+	require.NoError(t, err)
+	require.ErrorIs(t, sk.MergeBinary(data), ErrorPrecisionMismatch)
+	require.Equal(t, want, sk.Fingerprint())
+
+	// Binary encodings are fed by HashMetro.
+	redis := NewRedis()
+	redis.Insert([]byte("a"))
+	want = redis.Fingerprint()
+	data, err = New().MarshalBinary()
+	require.NoError(t, err)
+	require.ErrorIs(t, redis.MergeBinary(data), ErrorHashMismatch)
+	require.Equal(t, want, redis.Fingerprint())
+}
+
+func TestHLL_MergeBinary_Allocs(t *testing.T) {
+	src := NewNoSparse()
+	for i := 0; i < 10000; i++ {
+		src.InsertHash(rand.Uint64())
+	}
+	data, err := src.MarshalBinary()
+	require.NoError(t, err)
+	sk := NewNoSparse()
+	require.Zero(t, testing.AllocsPerRun(10, func() { require.NoError(t, sk.MergeBinary(data)) }))
+	require.Equal(t, src.regs, sk.regs)
+}
+
+func Benchmark_MergeBinary(b *testing.B) {
+	src := NewNoSparse()
+	for i := 0; i < 10000; i++ {
+		src.InsertHash(rand.Uint64())
+	}
+	data, err := src.MarshalBinary()
+	require.NoError(b, err)
+	sk := NewNoSparse()
+
+	b.Run("MergeBinary", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = sk.MergeBinary(data)
+		}
+	})
+	b.Run("UnmarshalBinary+Merge", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			other := &Sketch{}
+			_ = other.UnmarshalBinary(data)
+			_ = sk.Merge(other)
+		}
+	})
+}
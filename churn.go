@@ -0,0 +1,223 @@
+package hyperloglog
+
+import (
+	"math"
+)
+
+// The dense joint estimate follows Ertl, "New cardinality estimation methods
+// for HyperLogLog sketches" (2017), with the cardinalities of A and B fixed
+// to their own estimates and only the intersection fitted.
+
+// Churn is the change between the elements of two periods A and B.
+type Churn struct {
+	// New is |B\A|, the elements of B not in A.
+	New Bounded
+	// Returning is |A∩B|, the elements in both.
+	Returning Bounded
+	// Lost is |A\B|, the elements of A not in B.
+	Lost Bounded
+}
+
+// EstimateChurn estimates the new, returning and lost elements from period a
+// to period b. See EstimateJoint; periods fed by different hash functions
+// return a zero Churn.
+func EstimateChurn(a, b *Sketch) Churn {
+	j := EstimateJoint(a, b)
+	return Churn{New: j.BnotA, Returning: j.Intersection, Lost: j.AnotB}
+}
+
+// EstimateJoint estimates the cardinalities of the sets two sketches have
+// seen, of their union and intersection and of their differences. Unlike
+// inclusion-exclusion over Clone, Merge and Estimate, the estimates are
+// consistent with each other and never negative.
+//
+// When both sketches are sparse, their sparse keys are compared directly and
+// the estimates are almost exact. Otherwise the intersection is the one that
+// best explains the pairs of register values, and its standard error comes
+// from the same fit. Sketches of different precisions are compared at the
+// lower one. Nil and zero-value sketches are empty; the sketches are not
+// modified. Sketches fed by different hash functions put the same element in
+// unrelated registers, so they cannot be compared and return a zero
+// JointEstimate.
+func EstimateJoint(a, b *Sketch) JointEstimate {
+	if _, ok := sharedHashFunc(a, b); !ok {
+		return JointEstimate{}
+	}
+	if a == nil || a.p == 0 {
+		if b == nil || b.p == 0 {
+			return JointEstimate{}
+		}
+		a = newSketchNoError(b.p, true)
+	}
+	if b == nil || b.p == 0 {
+		b = newSketchNoError(a.p, true)
+	}
+	p := min(a.p, b.p)
+	a, b = jointOperand(a, p), jointOperand(b, p)
+	if a.sparse() && b.sparse() {
+		return sparseJoint(a, b)
+	}
+	return denseJoint(a.denseRegisters(), b.denseRegisters(), p)
+}
+
+// jointOperand returns a copy of sk at precision p, with its sparse keys
+// compacted, and dense if its sparse list is over the dense size, as Estimate
+// would leave it.
+func jointOperand(sk *Sketch, p uint8) *Sketch {
+	sk = sk.Clone()
+	// p is valid and at most sk.p.
+	_ = sk.Fold(p)
+	if sk.sparse() {
+		sk.mergeSparse()
+		if uint32(sk.sparseList.Len()) > sk.m {
+			sk.toNormal()
+		}
+	}
+	return sk
+}
+
+// denseRegisters returns sk's registers, turning a sparse sketch dense.
+func (sk *Sketch) denseRegisters() []uint8 {
+	if sk.sparse() {
+		sk.toNormal()
+	}
+	return sk.regs
+}
+
+// sparseJoint requires both sketches to have compacted sparse lists of the
+// same precision.
+func sparseJoint(a, b *Sketch) JointEstimate {
+	// The sparse lists are sorted, so the union is a merge.
+	var union uint32
+	ia, ib := a.sparseList.Iter(), b.sparseList.Iter()
+	for ia.HasNext() || ib.HasNext() {
+		union++
+		switch {
+		case !ib.HasNext():
+			ia.Next()
+		case !ia.HasNext():
+			ib.Next()
+		default:
+			ka, na := ia.Peek()
+			kb, nb := ib.Peek()
+			if ka <= kb {
+				ia.Advance(ka, na)
+			}
+			if kb <= ka {
+				ib.Advance(kb, nb)
+			}
+		}
+	}
+
+	count := func(n uint32) float64 { return linearCount(mp, mp-min(n, mp-1)) }
+	// variance is the variance of linear counting n hashes into mp bins,
+	// which only comes from the keys that collide.
+	variance := func(n float64) float64 {
+		t := n / float64(mp)
+		return float64(mp) * (math.Expm1(t) - t)
+	}
+	na, nb, u := count(a.sparseList.count), count(b.sparseList.count), count(union)
+	x := min(max(0, na+nb-u), na, nb)
+	fitErr := math.Sqrt(variance(na) + variance(nb) + variance(u))
+	return jointFromIntersection(na, nb, x, fitErr, 0)
+}
+
+// denseJoint requires both register slices to have 2^p registers.
+func denseJoint(a, b []uint8, p uint8) JointEstimate {
+	pairs := make(map[[2]uint8]float64)
+	for i, ra := range a {
+		pairs[[2]uint8{ra, b[i]}]++
+	}
+	sa, za := sumAndZeros(a)
+	sb, zb := sumAndZeros(b)
+	na, nb := float64(estimateDense(p, sa, za)), float64(estimateDense(p, sb, zb))
+
+	m := math.Ldexp(1, int(p))
+	top := int(maxRho(p))
+	// cdf returns P(R <= k) for a register that has seen a Poisson number
+	// of hashes with mean lambda.
+	cdf := func(lambda float64, k int) float64 {
+		switch {
+		case k < 0:
+			return 0
+		case k >= top:
+			return 1
+		}
+		return math.Exp(-lambda * math.Ldexp(1, -k))
+	}
+	ll := func(x float64) float64 {
+		la, lb, lx := max(0, na-x)/m, max(0, nb-x)/m, x/m
+		joint := func(i, j int) float64 {
+			return cdf(la, i) * cdf(lb, j) * cdf(lx, min(i, j))
+		}
+		var sum float64
+		for pair, n := range pairs {
+			i, j := int(pair[0]), int(pair[1])
+			prob := joint(i, j) - joint(i-1, j) - joint(i, j-1) + joint(i-1, j-1)
+			sum += n * math.Log(max(prob, math.SmallestNonzeroFloat64))
+		}
+		return sum
+	}
+	x, fitErr := maximizeIntersection(na, nb, ll)
+	return jointFromIntersection(na, nb, x, fitErr, 1.04/math.Sqrt(m))
+}
+
+// RetentionMatrix returns the cohort retention matrix of a sequence of
+// periods. The cohort of period i holds the elements first seen in period i,
+// and row i of the matrix holds how many of them were seen k periods later,
+// for k from 0 up to the last period, so that row i has len(periods)-i
+// entries and its first entry is the size of the cohort.
+//
+// Each entry is estimated as a difference of two joint estimates, |S_i\U| -
+// |S_i\(U∪S_j)| where U is the union of the periods before i, clamped to the
+// size of the cohort and never negative. The periods may have different
+// precisions; they are compared at the lowest. Nil periods are empty. Periods
+// fed by different hash functions cannot be compared, and every entry of
+// their matrix is zero.
+func RetentionMatrix(periods []*Sketch) [][]Bounded {
+	var p uint8
+	for _, sk := range periods {
+		if sk != nil && sk.p != 0 && (p == 0 || sk.p < p) {
+			p = sk.p
+		}
+	}
+	h, ok := sharedHashFunc(periods...)
+	rows := make([][]Bounded, len(periods))
+	if p == 0 || !ok {
+		for i := range rows {
+			rows[i] = make([]Bounded, len(periods)-i)
+		}
+		return rows
+	}
+
+	// The empty sketches take the periods' hash function, so that they
+	// merge with them.
+	empty := func() *Sketch {
+		sk, _ := NewSketchWithHash(p, true, h)
+		return sk
+	}
+	folded := make([]*Sketch, len(periods))
+	for i, sk := range periods {
+		if sk == nil || sk.p == 0 {
+			folded[i] = empty()
+		} else {
+			folded[i] = jointOperand(sk, p)
+		}
+	}
+	before := empty()
+	for i, si := range folded {
+		cohort := EstimateJoint(si, before).AnotB
+		rows[i] = make([]Bounded, len(periods)-i)
+		rows[i][0] = cohort
+		for k := 1; k < len(rows[i]); k++ {
+			u := before.Clone()
+			// All sketches have precision p and hash function h.
+			_ = u.Merge(folded[i+k])
+			gone := EstimateJoint(si, u).AnotB
+			kept := min(max(0, cohort.Estimate-gone.Estimate), cohort.Estimate)
+			rows[i][k] = Bounded{kept, math.Hypot(cohort.StdErr, gone.StdErr)}
+		}
+		_ = before.Merge(si)
+	}
+	return rows
+}
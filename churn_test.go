@@ -0,0 +1,145 @@
+package hyperloglog
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireBounded(t *testing.T, want float64, got Bounded, tolerance float64, msgAndArgs ...any) {
+	t.Helper()
+	require.InDelta(t, want, got.Estimate, tolerance, msgAndArgs...)
+	// Counts are whole, while the estimates and their errors are not.
+	lo, hi := got.Bounds(4)
+	require.LessOrEqual(t, lo, want+1, msgAndArgs...)
+	require.GreaterOrEqual(t, hi, want-1, msgAndArgs...)
+}
+
+func TestEstimateChurn(t *testing.T) {
+	for _, tt := range []struct {
+		na, nb, shared int
+		pa, pb         uint8
+	}{
+		{100000, 80000, 50000, 14, 14},
+		{100000, 100000, 0, 14, 14},
+		{200000, 50000, 50000, 14, 14},
+		{100000, 80000, 80000, 16, 14},
+		{1000, 800, 500, 14, 14}, // sparse
+		{1000, 200000, 500, 14, 14},
+		{50000, 20, 10, 14, 12},
+	} {
+		a, b := newSketchNoError(tt.pa, true), newSketchNoError(tt.pb, true)
+		for i := 0; i < tt.shared; i++ {
+			x := rand.Uint64()
+			a.InsertHash(x)
+			b.InsertHash(x)
+		}
+		for i := tt.shared; i < tt.na; i++ {
+			a.InsertHash(rand.Uint64())
+		}
+		for i := tt.shared; i < tt.nb; i++ {
+			b.InsertHash(rand.Uint64())
+		}
+		aBefore, bBefore := a.Clone(), b.Clone()
+
+		c := EstimateChurn(a, b)
+		union := float64(tt.na + tt.nb - tt.shared)
+		rel := 1.04 / math.Sqrt(float64(uint(1)<<min(tt.pa, tt.pb)))
+		tolerance := 3.5*rel*union + 2
+		requireBounded(t, float64(tt.nb-tt.shared), c.New, tolerance, "new %+v", tt)
+		requireBounded(t, float64(tt.shared), c.Returning, tolerance, "returning %+v", tt)
+		requireBounded(t, float64(tt.na-tt.shared), c.Lost, tolerance, "lost %+v", tt)
+		for _, pair := range [][2]*Sketch{{aBefore, a}, {bBefore, b}} {
+			require.Equal(t, pair[0].sparse(), pair[1].sparse())
+			require.Equal(t, pair[0].tmpSet.Len(), pair[1].tmpSet.Len())
+			require.Equal(t, denseRegs(pair[0]), denseRegs(pair[1]))
+		}
+
+		j := EstimateJoint(a, b)
+		require.GreaterOrEqual(t, j.AnotB.Estimate, 0.0)
+		require.GreaterOrEqual(t, j.BnotA.Estimate, 0.0)
+		require.InDelta(t, j.A.Estimate, j.Intersection.Estimate+j.AnotB.Estimate, 1e-6)
+		require.InDelta(t, j.B.Estimate, j.Intersection.Estimate+j.BnotA.Estimate, 1e-6)
+	}
+
+	require.Equal(t, JointEstimate{}, EstimateJoint(nil, &Sketch{}))
+	sk := New()
+	for i := 0; i < 100; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+	c := EstimateChurn(nil, sk)
+	require.InDelta(t, 100, c.New.Estimate, 1)
+	require.Zero(t, c.Returning.Estimate)
+
+	redis := NewRedis()
+	redis.Insert([]byte("a"))
+	require.InDelta(t, 1, EstimateChurn(nil, redis).New.Estimate, 0.5)
+	require.Equal(t, Churn{}, EstimateChurn(sk, redis))
+	require.Equal(t, JointEstimate{}, EstimateJoint(redis, sk))
+}
+
+func TestRetentionMatrix(t *testing.T) {
+	// Each period brings a cohort of new users, half of whom come back the
+	// next period and a quarter every period after.
+	cohorts := []int{50000, 40000, 30000, 20000}
+	periods := make([]*Sketch, len(cohorts))
+	for i := range periods {
+		periods[i] = New()
+	}
+	want := make([][]float64, len(cohorts))
+	for i, n := range cohorts {
+		want[i] = make([]float64, len(cohorts)-i)
+		for u := 0; u < n; u++ {
+			x := rand.Uint64()
+			periods[i].InsertHash(x)
+			want[i][0]++
+			for k := 1; k < len(want[i]); k++ {
+				if (k == 1 && u%2 == 0) || u%4 == 0 {
+					periods[i+k].InsertHash(x)
+					want[i][k]++
+				}
+			}
+		}
+	}
+
+	// Entries are differences against the union of all earlier periods, so
+	// their error scales with the total.
+	total := 0
+	for _, n := range cohorts {
+		total += n
+	}
+	tolerance := 3.5 * 1.04 / math.Sqrt(1<<14) * float64(total)
+
+	got := RetentionMatrix(periods)
+	require.Len(t, got, len(cohorts))
+	for i := range want {
+		require.Len(t, got[i], len(want[i]))
+		for k, w := range want[i] {
+			requireBounded(t, w, got[i][k], tolerance, "cohort %d after %d", i, k)
+		}
+	}
+
+	// Periods fed by another hash function are compared alike, but not
+	// with periods fed by the first.
+	redis := make([]*Sketch, len(periods))
+	for i, sk := range periods {
+		redis[i] = sk.Clone()
+		redis[i].hashFunc = HashRedis
+	}
+	for i, row := range RetentionMatrix(redis) {
+		for k, b := range row {
+			// The fit sums over a map, in no fixed order.
+			require.InDelta(t, got[i][k].Estimate, b.Estimate, 0.01)
+			require.InDelta(t, got[i][k].StdErr, b.StdErr, 0.01)
+		}
+	}
+	redis[0] = periods[0]
+	for i, row := range RetentionMatrix(redis) {
+		require.Equal(t, make([]Bounded, len(cohorts)-i), row)
+	}
+
+	empty := RetentionMatrix([]*Sketch{nil, nil})
+	require.Equal(t, [][]Bounded{{{}, {}}, {{}}}, empty)
+}
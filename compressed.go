@@ -2,7 +2,6 @@ package hyperloglog
 
 import (
 	"encoding/binary"
-	"fmt"
 	"slices"
 )
 
@@ -77,11 +76,12 @@ func (v *compressedList) AppendBinary(data []byte) ([]byte, error) {
 	return v.b.AppendBinary(data)
 }
 
-// unmarshal requires p to have passed checkPrecision, and data to be exactly
-// the compressed list; trailing bytes are rejected.
-func (v *compressedList) unmarshal(data []byte, p uint8) error {
+// parseCompressedList requires p to have passed checkPrecision, and data to be
+// exactly the compressed list, found at offset off of the encoding; trailing
+// bytes are rejected. The list returned reads its stream from data in place.
+func parseCompressedList(data []byte, p uint8, off int) (compressedList, error) {
 	if len(data) < 12 {
-		return fmt.Errorf("hyperloglog: compressed list header needs 12 bytes, have %d: %w", len(data), ErrorTooShort)
+		return compressedList{}, decodeError(off, "compressed list header", ErrorTooShort, "need 12 bytes, have %d", len(data))
 	}
 
 	// Read the count.
@@ -92,56 +92,36 @@ func (v *compressedList) unmarshal(data []byte, p uint8) error {
 
 	// Read the size of the list.
 	sz, data := binary.BigEndian.Uint32(data[:4]), data[4:]
-	if err := exactLen("compressed list stream", uint64(len(data)), uint64(sz)); err != nil {
-		return err
+	if err := decodeLen(off+12, "compressed list stream", uint64(len(data)), uint64(sz)); err != nil {
+		return compressedList{}, err
 	}
 	if count >= mp {
-		return fmt.Errorf("hyperloglog: compressed list count %d >= %d: %w", count, mp, ErrorInvalidData)
+		return compressedList{}, decodeError(off, "compressed list count", ErrorInvalidData, "count %d >= %d", count, mp)
 	}
 	if count == 0 {
 		if sz != 0 || last != 0 {
-			return fmt.Errorf("hyperloglog: empty compressed list has size %d and last %d: %w", sz, last, ErrorInvalidData)
+			return compressedList{}, decodeError(off, "compressed list count", ErrorInvalidData, "empty list has size %d and last %d", sz, last)
 		}
 	} else if sz < count || sz > 5*count {
-		return fmt.Errorf("hyperloglog: compressed list of %d entries has impossible stream size %d: %w", count, sz, ErrorInvalidData)
+		return compressedList{}, decodeError(off+8, "compressed list size", ErrorInvalidData, "%d entries cannot take %d bytes", count, sz)
 	}
 
-	b := make(variableLengthList, sz)
-	copy(b, data[:sz])
+	b := variableLengthList(data[:sz])
 
-	// Walk the stream once, decoding each varint exactly once, so that count
-	// and last cannot describe something the payload does not contain.
-	var entries uint32
-	var running uint32
-	for i := 0; i < int(sz); {
-		off := i
-		x, end, ok := b.decode(off)
-		if !ok {
-			return fmt.Errorf("hyperloglog: compressed list varint at compressed-list offset %d is malformed: %w", off, ErrorInvalidData)
-		}
-		i = end
-		// Every delta after the first strictly increases the running key, so
-		// the decoded keys strictly increase, the sum cannot wrap, and count
-		// cannot be inflated by duplicates.
-		next := running + x
-		if entries > 0 && next <= running {
-			return fmt.Errorf("hyperloglog: compressed list delta %d at compressed-list offset %d does not increase the key past %d: %w", entries, off, running, ErrorInvalidData)
-		}
-		running = next
-		if err := checkSparseKey(running, p); err != nil {
-			return fmt.Errorf("hyperloglog: compressed-list offset %d: %w", off, err)
-		}
-		entries++
+	// Walk the stream once, so that count and last cannot describe something
+	// the payload does not contain.
+	entries, running, err := b.walk(p, off+12)
+	if err != nil {
+		return compressedList{}, err
 	}
 	if count != entries {
-		return fmt.Errorf("hyperloglog: compressed list count %d, decoded %d entries: %w", count, entries, ErrorInvalidData)
+		return compressedList{}, decodeError(off, "compressed list count", ErrorInvalidData, "count %d, decoded %d entries", count, entries)
 	}
 	if last != running {
-		return fmt.Errorf("hyperloglog: compressed list last %d, decoded %d: %w", last, running, ErrorInvalidData)
+		return compressedList{}, decodeError(off+4, "compressed list last", ErrorInvalidData, "last %d, decoded %d", last, running)
 	}
 
-	v.count, v.last, v.b = count, last, b
-	return nil
+	return compressedList{count: count, last: last, b: b}, nil
 }
 
 func newCompressedList(capacity int) *compressedList {
@@ -223,6 +203,33 @@ func (v variableLengthList) decode(i int) (x uint32, next int, ok bool) {
 	return x, j + 1, true
 }
 
+// walk decodes each varint of the delta stream v, found at offset base of the
+// encoding, exactly once and returns the number of keys and the last one. It
+// requires p to have passed checkPrecision.
+func (v variableLengthList) walk(p uint8, base int) (count, last uint32, err error) {
+	for i := 0; i < len(v); {
+		off := i
+		x, end, ok := v.decode(off)
+		if !ok {
+			return 0, 0, decodeError(base+off, "compressed list delta", ErrorInvalidData, "malformed varint")
+		}
+		i = end
+		// Every delta after the first strictly increases the running key, so
+		// the decoded keys strictly increase, the sum cannot wrap, and count
+		// cannot be inflated by duplicates.
+		next := last + x
+		if count > 0 && next <= last {
+			return 0, 0, decodeError(base+off, "compressed list delta", ErrorInvalidData, "delta %d does not increase the key past %d", count, last)
+		}
+		last = next
+		if err := checkSparseKey(last, p, base+off, "compressed list delta"); err != nil {
+			return 0, 0, err
+		}
+		count++
+	}
+	return count, last, nil
+}
+
 func (v variableLengthList) Append(x uint32) variableLengthList {
 	for x&0xffffff80 != 0 {
 		v = append(v, uint8((x&0x7f)|0x80))
@@ -0,0 +1,387 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// The CPC sketch follows Kevin Lang's "Back to the Future: an Even More
+// Nearly Optimal Cardinality Estimation Algorithm" (2017), the algorithm
+// behind the Apache DataSketches CPC sketch. Its serialized form is this
+// package's own and is not compatible with DataSketches.
+
+const cpcVersion = 1
+
+// ErrorNotSparse is returned by NewCPCFromSketch when the Sketch is dense. A
+// dense register only keeps the largest value seen, which is not enough to
+// recover the coupons a CPC sketch needs.
+var ErrorNotSparse = errors.New("sketch is not sparse")
+
+// CPCSketch is a Compressed Probabilistic Counting sketch. It uses far more
+// memory than a Sketch of the same precision while it is in use, but its
+// serialized form is several times smaller at equal accuracy, which makes it
+// the better choice for archival.
+//
+// A CPCSketch of precision p records a coupon for every (register, rho) pair
+// a Sketch of precision p would see, rather than only the largest rho per
+// register. Use NewCPC to create one; the zero value is not usable.
+type CPCSketch struct {
+	p       uint8
+	rows    []uint64
+	coupons uint32
+	// merged is set once the sketch holds coupons that were not inserted
+	// into it directly. The HIP accumulators below are only valid while it
+	// is clear.
+	merged bool
+	hip    float64
+	kxp    float64
+}
+
+// NewCPC returns an empty CPC sketch with 2^precision rows. The precision has
+// to be >= 4 and <= 18, otherwise ErrorInvalidPrecision is returned.
+func NewCPC(precision uint8) (*CPCSketch, error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	k := 1 << precision
+	return &CPCSketch{
+		p:    precision,
+		rows: make([]uint64, k),
+		kxp:  float64(k),
+	}, nil
+}
+
+// NewCPCFromSketch returns a CPC sketch holding the same coupons as sk. Only a
+// sparse Sketch keeps every coupon it has seen, so a dense one returns an error
+// wrapping ErrorNotSparse, and one fed by another hash function than
+// HashMetro one wrapping ErrorHashMismatch. The conversion is exact: the
+// result is the CPC sketch the same hashes would have built, except that it
+// has to estimate as if it had been merged.
+func NewCPCFromSketch(sk *Sketch) (*CPCSketch, error) {
+	if err := checkPrecision(sk.p); err != nil {
+		return nil, fmt.Errorf("hyperloglog: precision %d: %w", sk.p, err)
+	}
+	if !sk.sparse() {
+		return nil, fmt.Errorf("hyperloglog: cannot convert a dense sketch to CPC: %w", ErrorNotSparse)
+	}
+	// CPCSketch.Insert hashes with MetroHash64.
+	if err := sk.checkFormatHash("CPC", HashMetro); err != nil {
+		return nil, err
+	}
+	c, _ := NewCPC(sk.p)
+	add := func(k uint32) {
+		i, r := decodeHash(k, sk.p, pp)
+		c.rows[i] |= 1 << (r - 1)
+	}
+	sk.tmpSet.ForEach(add)
+	for iter := sk.sparseList.Iter(); iter.HasNext(); {
+		add(iter.Next())
+	}
+	c.countCoupons()
+	c.merged = c.coupons > 0
+	return c, nil
+}
+
+func (c *CPCSketch) k() uint32 { return uint32(len(c.rows)) }
+
+// cols returns the number of columns a row can use: rho is at most 64-p+1.
+func (c *CPCSketch) cols() uint8 { return maxRho(c.p) }
+
+// colWeight returns the probability that a hash lands in column col of its
+// row. The weights of a row sum to 1.
+func (c *CPCSketch) colWeight(col uint8) float64 {
+	if col == c.cols()-1 {
+		return math.Ldexp(1, -int(col))
+	}
+	return math.Ldexp(1, -int(col)-1)
+}
+
+func (c *CPCSketch) countCoupons() {
+	c.coupons = 0
+	for _, row := range c.rows {
+		c.coupons += uint32(bits.OnesCount64(row))
+	}
+}
+
+// Clone returns a deep copy of c.
+func (c *CPCSketch) Clone() *CPCSketch {
+	clone := *c
+	clone.rows = slices.Clone(c.rows)
+	return &clone
+}
+
+// Insert hashes e with the package's MetroHash64 seed and adds it to c.
+func (c *CPCSketch) Insert(e []byte) { c.InsertHash(hash(e)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to c. The hash is split
+// into a row and a column exactly as Sketch.InsertHash splits it into a
+// register and a rho.
+func (c *CPCSketch) InsertHash(x uint64) {
+	i, r := getPosVal(x, c.p)
+	col := r - 1
+	bit := uint64(1) << col
+	if c.rows[i]&bit != 0 {
+		return
+	}
+	c.rows[i] |= bit
+	c.coupons++
+	if !c.merged {
+		c.hip += float64(c.k()) / c.kxp
+		c.kxp -= c.colWeight(col)
+	}
+}
+
+// Merge adds other to c. Both sketches must have the same precision, otherwise
+// an error wrapping ErrorPrecisionMismatch is returned. A nil other is treated
+// as empty.
+func (c *CPCSketch) Merge(other *CPCSketch) error {
+	if other == nil {
+		return nil
+	}
+	if c.p != other.p {
+		return fmt.Errorf("hyperloglog: cannot merge precision %d with precision %d: %w", c.p, other.p, ErrorPrecisionMismatch)
+	}
+	if other.coupons == 0 {
+		return nil
+	}
+	if c.coupons == 0 {
+		*c = *other.Clone()
+		return nil
+	}
+	for i, row := range other.rows {
+		c.rows[i] |= row
+	}
+	c.countCoupons()
+	c.merged = true
+	return nil
+}
+
+// Estimate returns the cardinality estimate. A sketch that only ever saw
+// Insert and InsertHash uses the historic inverse probability (HIP)
+// estimator; once it has been merged, it inverts the expected coupon count
+// (the ICON estimator).
+func (c *CPCSketch) Estimate() uint64 {
+	if c.coupons == 0 {
+		return 0
+	}
+	if !c.merged {
+		return uint64(c.hip + 0.5)
+	}
+	return uint64(c.icon() + 0.5)
+}
+
+// icon returns the n for which the expected number of coupons equals the
+// observed one.
+func (c *CPCSketch) icon() float64 {
+	k := float64(c.k())
+	cols := c.cols()
+	want := float64(c.coupons)
+	if want >= k*float64(cols) {
+		// Every cell is set; the estimate is unbounded.
+		want = k*float64(cols) - 0.5
+	}
+	expected := func(n float64) float64 {
+		var sum float64
+		for col := range cols {
+			sum -= math.Expm1(-n * c.colWeight(col) / k)
+		}
+		return k * sum
+	}
+
+	lo, hi := 0.0, max(want, 1)
+	for expected(hi) < want {
+		lo, hi = hi, 2*hi
+	}
+	for range 100 {
+		mid := lo + (hi-lo)/2
+		if mid == lo || mid == hi {
+			break
+		}
+		if expected(mid) < want {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo + (hi-lo)/2
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (c *CPCSketch) MarshalBinary() ([]byte, error) {
+	return c.AppendBinary(nil)
+}
+
+// AppendBinary implements the encoding.BinaryAppender interface. See
+// UnmarshalBinary for the format.
+func (c *CPCSketch) AppendBinary(data []byte) ([]byte, error) {
+	if err := checkPrecision(c.p); err != nil {
+		return data, fmt.Errorf("hyperloglog: precision %d: %w", c.p, err)
+	}
+	var flags byte
+	if c.merged {
+		flags = 1
+	}
+	data = append(data, cpcVersion, c.p, flags, 0)
+	if !c.merged {
+		data = binary.BigEndian.AppendUint64(data, math.Float64bits(c.hip))
+		data = binary.BigEndian.AppendUint64(data, math.Float64bits(c.kxp))
+	}
+
+	counts := c.columnCounts()
+	coded := false
+	for _, n := range counts {
+		data = binary.AppendUvarint(data, uint64(n))
+		coded = coded || (n > 0 && n < c.k())
+	}
+	if !coded {
+		return data, nil
+	}
+
+	enc := newRangeEncoder(data)
+	for col, n := range counts {
+		c.codeColumn(n, func(row uint32, p0 uint32) bool {
+			bit := c.rows[row]&(1<<col) != 0
+			enc.encode(bit, p0)
+			return bit
+		})
+	}
+	return enc.finish(), nil
+}
+
+func (c *CPCSketch) columnCounts() []uint32 {
+	counts := make([]uint32, c.cols())
+	for _, row := range c.rows {
+		for ; row != 0; row &= row - 1 {
+			counts[bits.TrailingZeros64(row)]++
+		}
+	}
+	return counts
+}
+
+// codeColumn walks the rows of a column holding ones set cells that the count
+// does not already imply, handing each to code together with the probability
+// that it is 0. Knowing how many set cells remain in the rest of the column
+// makes that probability exact, so the column costs close to log2(k choose
+// ones) bits. It returns the first row of the run at the end of the column
+// that has to be all ones, or k if there is none.
+func (c *CPCSketch) codeColumn(ones uint32, code func(row uint32, p0 uint32) bool) uint32 {
+	k := c.k()
+	if ones == 0 || ones == k {
+		return k
+	}
+	for row := uint32(0); row < k; row++ {
+		left := k - row
+		switch ones {
+		case 0:
+			return k
+		case left:
+			return row
+		}
+		p0 := uint32(uint64(left-ones) * probTotal / uint64(left))
+		if code(row, clampProb(p0)) {
+			ones--
+		}
+	}
+	return k
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+//
+// The format starts with a 4 byte header: the version (1), the precision,
+// a flags byte whose bit 0 is set when the sketch has been merged and whose
+// other bits must be clear, and a reserved 0 byte. An unmerged sketch follows
+// it with its HIP estimate and the remaining HIP probability mass, each a big
+// endian IEEE 754 float64. Then come 64-p+1 uvarints, the number of set cells
+// in each column. The rest is a range coded stream of the cells of every
+// column that is neither empty nor full, column by column, and has to be
+// exactly as long as decoding it requires.
+//
+// Errors wrap the package's exported sentinels and leave c unchanged.
+func (c *CPCSketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("hyperloglog: cpc header needs 4 bytes, have %d: %w", len(data), ErrorTooShort)
+	}
+	if data[0] != cpcVersion {
+		return fmt.Errorf("hyperloglog: cpc version %d: %w", data[0], ErrorInvalidVersion)
+	}
+	if err := checkPrecision(data[1]); err != nil {
+		return fmt.Errorf("hyperloglog: precision %d: %w", data[1], err)
+	}
+	if data[2] > 1 || data[3] != 0 {
+		return fmt.Errorf("hyperloglog: cpc header bytes 2:4 = %#x %#x: %w", data[2], data[3], ErrorInvalidData)
+	}
+	tmp, _ := NewCPC(data[1])
+	tmp.merged = data[2] == 1
+	k := tmp.k()
+	off := 4
+
+	if !tmp.merged {
+		if len(data) < off+16 {
+			return fmt.Errorf("hyperloglog: cpc HIP state at offset %d needs 16 bytes, have %d: %w", off, len(data)-off, ErrorTooShort)
+		}
+		tmp.hip = math.Float64frombits(binary.BigEndian.Uint64(data[off:]))
+		tmp.kxp = math.Float64frombits(binary.BigEndian.Uint64(data[off+8:]))
+		if !(tmp.hip >= 0) || math.IsInf(tmp.hip, 0) || !(tmp.kxp > 0 && tmp.kxp <= float64(k)) {
+			return fmt.Errorf("hyperloglog: cpc HIP state %g, %g at offset %d: %w", tmp.hip, tmp.kxp, off, ErrorInvalidData)
+		}
+		off += 16
+	}
+
+	counts := make([]uint32, tmp.cols())
+	coded := false
+	for col := range counts {
+		n, sz := binary.Uvarint(data[off:])
+		switch {
+		case sz == 0:
+			return fmt.Errorf("hyperloglog: cpc column %d count at offset %d: %w", col, off, ErrorTooShort)
+		case sz < 0 || n > uint64(k):
+			return fmt.Errorf("hyperloglog: cpc column %d count at offset %d exceeds %d rows: %w", col, off, k, ErrorInvalidData)
+		}
+		counts[col] = uint32(n)
+		coded = coded || (n > 0 && n < uint64(k))
+		off += sz
+		if n == uint64(k) {
+			for row := range tmp.rows {
+				tmp.rows[row] |= 1 << col
+			}
+		}
+	}
+
+	stream := data[off:]
+	if !coded {
+		if len(stream) != 0 {
+			return fmt.Errorf("hyperloglog: cpc has %d bytes after its column counts: %w", len(stream), ErrorInvalidData)
+		}
+	} else {
+		dec, ok := newRangeDecoder(stream)
+		if !ok {
+			return fmt.Errorf("hyperloglog: cpc stream at offset %d is malformed: %w", off, ErrorInvalidData)
+		}
+		for col, n := range counts {
+			tail := tmp.codeColumn(n, func(row uint32, p0 uint32) bool {
+				bit := dec.decode(p0)
+				if bit {
+					tmp.rows[row] |= 1 << col
+				}
+				return bit
+			})
+			for row := tail; row < k; row++ {
+				tmp.rows[row] |= 1 << col
+			}
+		}
+		switch {
+		case dec.short:
+			return fmt.Errorf("hyperloglog: cpc stream at offset %d ends early: %w", off, ErrorTooShort)
+		case !dec.done():
+			return fmt.Errorf("hyperloglog: cpc stream at offset %d has %d trailing bytes: %w", off, len(stream)-dec.pos, ErrorInvalidData)
+		}
+	}
+
+	tmp.countCoupons()
+	*c = *tmp
+	return nil
+}
@@ -0,0 +1,148 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPC_Estimate(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 10000, 1000000} {
+		c, err := NewCPC(12)
+		require.NoError(t, err)
+		for i := 0; i < n; i++ {
+			c.InsertHash(rand.Uint64())
+		}
+		if n == 0 {
+			require.Zero(t, c.Estimate())
+			continue
+		}
+
+		ratio := 100 * estimateError(c.Estimate(), uint64(n))
+		require.LessOrEqual(t, ratio, 5.0, "HIP: exact %d, got %d", n, c.Estimate())
+
+		// Merging into an empty sketch keeps HIP; merging into a
+		// non-empty one switches to ICON.
+		merged, err := NewCPC(12)
+		require.NoError(t, err)
+		merged.InsertHash(rand.Uint64())
+		require.NoError(t, merged.Merge(c))
+		require.True(t, merged.merged)
+		ratio = 100 * estimateError(merged.Estimate(), uint64(n+1))
+		require.LessOrEqual(t, ratio, 5.0, "ICON: exact %d, got %d", n+1, merged.Estimate())
+	}
+}
+
+func TestCPC_Merge(t *testing.T) {
+	a, _ := NewCPC(10)
+	b, _ := NewCPC(10)
+	all, _ := NewCPC(10)
+	for i := 0; i < 50000; i++ {
+		x := rand.Uint64()
+		if i%2 == 0 {
+			a.InsertHash(x)
+		} else {
+			b.InsertHash(x)
+		}
+		all.InsertHash(x)
+	}
+	require.NoError(t, a.Merge(b))
+	require.Equal(t, all.rows, a.rows)
+	require.Equal(t, all.coupons, a.coupons)
+
+	other, _ := NewCPC(11)
+	require.ErrorIs(t, a.Merge(other), ErrorPrecisionMismatch)
+	other.InsertHash(1)
+	require.ErrorIs(t, a.Merge(other), ErrorPrecisionMismatch)
+	require.NoError(t, a.Merge(nil))
+}
+
+func TestCPC_FromSketch(t *testing.T) {
+	sk := NewTestSketch(14)
+	c, _ := NewCPC(14)
+	for i := 0; i < 5000; i++ {
+		x := rand.Uint64()
+		sk.InsertHash(x)
+		c.InsertHash(x)
+	}
+	require.True(t, sk.sparse())
+
+	conv, err := NewCPCFromSketch(sk)
+	require.NoError(t, err)
+	require.Equal(t, c.rows, conv.rows)
+	require.Equal(t, c.coupons, conv.coupons)
+
+	_, err = NewCPCFromSketch(NewNoSparse())
+	require.ErrorIs(t, err, ErrorNotSparse)
+	_, err = NewCPCFromSketch(&Sketch{})
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	_, err = NewCPCFromSketch(NewRedis())
+	require.ErrorIs(t, err, ErrorHashMismatch)
+}
+
+func TestCPC_Marshal_Unmarshal(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000, 1000000} {
+		c, _ := NewCPC(14)
+		// A Sketch needs about twice the registers to match the
+		// accuracy of a CPC sketch.
+		sk, _ := NewSketch(15, false)
+		for i := 0; i < n; i++ {
+			x := rand.Uint64()
+			c.InsertHash(x)
+			sk.InsertHash(x)
+		}
+		data, err := c.MarshalBinary()
+		require.NoError(t, err)
+
+		var res CPCSketch
+		require.NoError(t, res.UnmarshalBinary(data))
+		require.Equal(t, c.rows, res.rows)
+		require.Equal(t, c.Estimate(), res.Estimate())
+
+		if n >= 100000 {
+			dense, err := sk.MarshalBinary()
+			require.NoError(t, err)
+			require.Less(t, 2*len(data), len(dense), "n=%d", n)
+		}
+
+		merged := c.Clone()
+		require.NoError(t, merged.Merge(&res))
+		data, err = merged.MarshalBinary()
+		require.NoError(t, err)
+		require.NoError(t, res.UnmarshalBinary(data))
+		require.Equal(t, merged.rows, res.rows)
+		require.Equal(t, merged.merged, res.merged)
+	}
+}
+
+func TestCPC_Unmarshal_Malformed(t *testing.T) {
+	c, _ := NewCPC(8)
+	for i := 0; i < 2000; i++ {
+		c.InsertHash(rand.Uint64())
+	}
+	data, err := c.MarshalBinary()
+	require.NoError(t, err)
+
+	for i := range data {
+		res, _ := NewCPC(8)
+		err := res.UnmarshalBinary(data[:i])
+		require.Error(t, err, "truncated at %d", i)
+		require.Zero(t, res.coupons, "receiver modified")
+	}
+	require.ErrorIs(t, c.UnmarshalBinary(append(data, 0)), ErrorInvalidData)
+
+	bad := append([]byte(nil), data...)
+	bad[0] = 2
+	require.ErrorIs(t, c.UnmarshalBinary(bad), ErrorInvalidVersion)
+	bad[0], bad[1] = 1, 30
+	require.ErrorIs(t, c.UnmarshalBinary(bad), ErrorInvalidPrecision)
+	bad[1], bad[2] = 8, 2
+	require.ErrorIs(t, c.UnmarshalBinary(bad), ErrorInvalidData)
+
+	for i := 0; i < 1000; i++ {
+		bad := append([]byte(nil), data...)
+		bad[4+rand.Intn(len(bad)-4)] ^= byte(1 + rand.Intn(255))
+		require.NotPanics(t, func() { _ = c.Clone().UnmarshalBinary(bad) })
+	}
+}
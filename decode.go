@@ -0,0 +1,97 @@
+package hyperloglog
+
+import "fmt"
+
+// DecodeOptions restricts what UnmarshalBinaryWithOptions, and a Decoder given
+// them with SetDecodeOptions, accept, for sketches from an untrusted source. A sketch that breaks a restriction returns
+// an error wrapping ErrorLimitExceeded. The zero value restricts nothing beyond
+// the format itself.
+type DecodeOptions struct {
+	// MaxPrecision bounds the precision, and so the number of registers a
+	// dense sketch allocates. 0 allows every supported precision.
+	MaxPrecision uint8
+	// RejectV1 rejects the version 1 encoding.
+	RejectV1 bool
+	// RejectSparse rejects sparse sketches of any version.
+	RejectSparse bool
+	// MaxSparseKeys bounds the keys of a sparse sketch, counting both its
+	// tmp set and its compressed list. 0 leaves them bounded by the format
+	// alone.
+	MaxSparseKeys int
+}
+
+// DecodeError is the error UnmarshalBinary and UnmarshalBinaryWithOptions
+// return. It locates what failed to decode and wraps one of ErrorTooShort,
+// ErrorInvalidVersion, ErrorInvalidPrecision, ErrorInvalidData, ErrorChecksum or
+// ErrorLimitExceeded, so that errors.Is matches the sentinel and errors.As
+// retrieves the DecodeError, also through the errors of the stream Decoder and
+// the Archive, which wrap it.
+type DecodeError struct {
+	// Offset is the offset in the encoding of the field that failed.
+	Offset int
+	// Field names the field, such as "version", "tmp set key" or "register".
+	Field string
+	// Err is the sentinel describing the failure.
+	Err error
+
+	detail string
+}
+
+func (e *DecodeError) Error() string {
+	if e.detail == "" {
+		return fmt.Sprintf("hyperloglog: %s at offset %d: %v", e.Field, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("hyperloglog: %s at offset %d: %s: %v", e.Field, e.Offset, e.detail, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+func decodeError(off int, field string, err error, format string, args ...any) error {
+	return &DecodeError{Offset: off, Field: field, Err: err, detail: fmt.Sprintf(format, args...)}
+}
+
+// decodeLen is exactLen for a field of a Sketch encoding at offset off.
+func decodeLen(off int, field string, have, want uint64) error {
+	switch {
+	case have < want:
+		return decodeError(off, field, ErrorTooShort, "need %d bytes, have %d", want, have)
+	case have > want:
+		return decodeError(off, field, ErrorInvalidData, "need %d bytes, %d bytes follow them", want, have-want)
+	}
+	return nil
+}
+
+// UnmarshalBinaryWithOptions is UnmarshalBinary restricted by opts. The
+// restrictions are checked as soon as the header or the count they apply to is
+// read, before anything is sized from it.
+func (sk *Sketch) UnmarshalBinaryWithOptions(data []byte, opts DecodeOptions) error {
+	return sk.unmarshalBinary(data, opts)
+}
+
+// checkPrecision checks the precision p of an encoding at offset 1.
+func (opts DecodeOptions) checkPrecision(p uint8) error {
+	if err := checkPrecision(p); err != nil {
+		return decodeError(1, "precision", err, "precision %d", p)
+	}
+	if opts.MaxPrecision != 0 && p > opts.MaxPrecision {
+		return decodeError(1, "precision", ErrorLimitExceeded, "precision %d, limit %d", p, opts.MaxPrecision)
+	}
+	return nil
+}
+
+// checkSparse checks that an encoding may be sparse, with header byte 3 at
+// offset 3.
+func (opts DecodeOptions) checkSparse() error {
+	if opts.RejectSparse {
+		return decodeError(3, "representation", ErrorLimitExceeded, "sparse sketches are rejected")
+	}
+	return nil
+}
+
+// checkSparseKeys checks n sparse keys counted at offset off.
+func (opts DecodeOptions) checkSparseKeys(off int, field string, n uint64) error {
+	if opts.MaxSparseKeys > 0 && n > uint64(opts.MaxSparseKeys) {
+		return decodeError(off, field, ErrorLimitExceeded, "%d sparse keys, limit %d", n, opts.MaxSparseKeys)
+	}
+	return nil
+}
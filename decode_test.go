@@ -0,0 +1,110 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLL_UnmarshalBinaryWithOptions(t *testing.T) {
+	marshal := func(sk *Sketch, v3 bool) []byte {
+		var data []byte
+		var err error
+		if v3 {
+			data, err = sk.MarshalBinaryV3()
+		} else {
+			data, err = sk.MarshalBinary()
+		}
+		require.NoError(t, err)
+		return data
+	}
+	v1 := append([]byte{1, 4, 0, 0, 0, 0, 0, 0}, make([]byte, 8)...)
+
+	sparse := New()
+	for i := 0; i < 300; i++ {
+		sparse.InsertHash(rand.Uint64())
+	}
+	sparse.Estimate()
+	for i := 0; i < 20; i++ {
+		sparse.InsertHash(rand.Uint64())
+	}
+	keys := sparse.tmpSet.Len() + int(sparse.sparseList.count)
+	dense := New16NoSparse()
+	dense.InsertHash(1)
+
+	for _, v3 := range []bool{false, true} {
+		for _, tt := range []struct {
+			name  string
+			data  []byte
+			opts  DecodeOptions
+			field string
+		}{
+			{"precision", marshal(dense, v3), DecodeOptions{MaxPrecision: 14}, "precision"},
+			{"v1", v1, DecodeOptions{RejectV1: true}, "version"},
+			{"sparse", marshal(sparse, v3), DecodeOptions{RejectSparse: true}, "representation"},
+			{"tmp set keys", marshal(sparse, v3), DecodeOptions{MaxSparseKeys: sparse.tmpSet.Len() - 1}, "tmp set count"},
+			{"sparse keys", marshal(sparse, v3), DecodeOptions{MaxSparseKeys: keys - 1}, ""},
+		} {
+			target := New()
+			target.InsertHash(1)
+			want := target.Fingerprint()
+			err := target.UnmarshalBinaryWithOptions(tt.data, tt.opts)
+			require.ErrorIs(t, err, ErrorLimitExceeded, tt.name)
+			var de *DecodeError
+			require.ErrorAs(t, err, &de)
+			if tt.field != "" {
+				require.Equal(t, tt.field, de.Field, tt.name)
+			}
+			require.Equal(t, want, target.Fingerprint(), tt.name)
+		}
+
+		got := &Sketch{}
+		require.NoError(t, got.UnmarshalBinaryWithOptions(marshal(dense, v3), DecodeOptions{MaxPrecision: 16, RejectSparse: true}))
+		require.Equal(t, dense.regs, got.regs)
+		require.NoError(t, got.UnmarshalBinaryWithOptions(marshal(sparse, v3), DecodeOptions{MaxSparseKeys: keys, RejectV1: true}))
+		require.Equal(t, denseRegs(sparse), denseRegs(got))
+	}
+	require.NoError(t, (&Sketch{}).UnmarshalBinaryWithOptions(v1, DecodeOptions{}))
+}
+
+func TestHLL_DecodeError(t *testing.T) {
+	sk := NewNoSparse()
+	sk.InsertHash(1)
+	data, err := sk.MarshalBinary()
+	require.NoError(t, err)
+	data[8+100] = 60
+
+	err = (&Sketch{}).UnmarshalBinary(data)
+	var de *DecodeError
+	require.ErrorAs(t, err, &de)
+	require.Equal(t, 108, de.Offset)
+	require.Equal(t, "register", de.Field)
+	require.Same(t, ErrorInvalidData, de.Err)
+	require.Equal(t, "hyperloglog: register at offset 108: register 100 = 60, max 51: invalid binary data", err.Error())
+
+	// A bad key in the compressed list is located in the whole encoding.
+	data = []byte{2, 14, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0x7f, 0, 0, 0, 1, 0x7f}
+	err = (&Sketch{}).UnmarshalBinary(data)
+	require.ErrorAs(t, err, &de)
+	require.Equal(t, "compressed list delta", de.Field)
+	require.Equal(t, 20, de.Offset)
+
+	// Errors that wrap it keep the DecodeError.
+	sparse := New()
+	for i := 0; i < 10; i++ {
+		sparse.InsertHash(rand.Uint64())
+	}
+	var buf bytes.Buffer
+	require.NoError(t, NewEncoder(&buf).Encode(sparse))
+	stream := buf.Bytes()
+	stream[len(stream)-1] ^= 1
+	err = NewDecoder(bytes.NewReader(stream)).Decode(&Sketch{})
+	require.ErrorAs(t, err, &de)
+	require.Equal(t, "checksum", de.Field)
+	require.ErrorIs(t, err, ErrorChecksum)
+
+	err = (&Sketch{}).UnmarshalBinary(nil)
+	require.EqualError(t, err, "hyperloglog: header at offset 0: need 8 bytes, have 0: too short binary")
+}
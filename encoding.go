@@ -0,0 +1,105 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	representationSparse = "sparse"
+	representationDense  = "dense"
+)
+
+// sketchJSON is the JSON form of a Sketch. Data marshals as standard base64.
+type sketchJSON struct {
+	Precision      uint8  `json:"precision"`
+	Representation string `json:"representation"`
+	Data           []byte `json:"data"`
+}
+
+// representation names sk's representation in JSON.
+func (sk *Sketch) representation() string {
+	if sk.sparse() {
+		return representationSparse
+	}
+	return representationDense
+}
+
+// MarshalText implements the encoding.TextMarshaler interface. The text is the
+// canonical binary encoding (see AppendCanonical) in standard base64. A
+// zero-value Sketch returns an error wrapping ErrorInvalidPrecision.
+func (sk *Sketch) MarshalText() ([]byte, error) {
+	data, err := sk.MarshalCanonical()
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(text, data)
+	return text, nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface. The text has
+// to be a binary encoding in standard base64, which is decoded as by
+// UnmarshalBinary; text that is not base64 returns an error wrapping
+// ErrorInvalidData. If an error is returned sk is left unchanged.
+func (sk *Sketch) UnmarshalText(text []byte) error {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(data, text)
+	if err != nil {
+		return fmt.Errorf("hyperloglog: text is not base64: %v: %w", err, ErrorInvalidData)
+	}
+	return sk.UnmarshalBinary(data[:n])
+}
+
+// MarshalJSON implements the json.Marshaler interface. A Sketch is an object
+// holding its precision, its representation, "sparse" or "dense", and its
+// canonical binary encoding (see AppendCanonical) in standard base64:
+//
+//	{"precision":14,"representation":"sparse","data":"Ag4AAQAAAAA..."}
+//
+// A zero-value Sketch marshals to null.
+func (sk *Sketch) MarshalJSON() ([]byte, error) {
+	if sk.p == 0 {
+		return []byte("null"), nil
+	}
+	c := sk.canonical()
+	data, err := c.AppendBinary(nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sketchJSON{
+		Precision:      c.p,
+		Representation: c.representation(),
+		Data:           data,
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, reading the object
+// MarshalJSON writes. The data is decoded as by UnmarshalBinary, and the
+// precision and representation have to agree with it. Malformed JSON, data
+// that is not base64 and disagreeing fields return an error wrapping
+// ErrorInvalidData. Unknown fields are ignored, and null leaves sk unchanged,
+// as does any error.
+func (sk *Sketch) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil
+	}
+	var v sketchJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("hyperloglog: JSON sketch: %v: %w", err, ErrorInvalidData)
+	}
+	tmp := &Sketch{}
+	if err := tmp.UnmarshalBinary(v.Data); err != nil {
+		return err
+	}
+	if v.Precision != tmp.p {
+		return fmt.Errorf("hyperloglog: JSON precision %d, data has precision %d: %w", v.Precision, tmp.p, ErrorInvalidData)
+	}
+	if v.Representation != tmp.representation() {
+		return fmt.Errorf("hyperloglog: JSON representation %q, data is %s: %w", v.Representation, tmp.representation(), ErrorInvalidData)
+	}
+	*sk = *tmp
+	return nil
+}
@@ -0,0 +1,117 @@
+package hyperloglog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketch_JSON(t *testing.T) {
+	for _, tt := range []struct {
+		n              int
+		sparse         bool
+		representation string
+	}{
+		{100, true, "sparse"},
+		{50000, true, "dense"},
+		{0, false, "dense"},
+		{1000, false, "dense"},
+	} {
+		sk := newSketchNoError(14, tt.sparse)
+		for i := 0; i < tt.n; i++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		type record struct {
+			Name   string  `json:"name"`
+			Users  *Sketch `json:"users"`
+			Events Sketch  `json:"events"`
+		}
+		data, err := json.Marshal(&record{Name: "a", Users: sk, Events: *sk})
+		require.NoError(t, err)
+
+		var fields map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(data, &fields))
+		var meta sketchJSON
+		require.NoError(t, json.Unmarshal(fields["users"], &meta))
+		require.Equal(t, uint8(14), meta.Precision)
+		require.Equal(t, tt.representation, meta.Representation)
+		canonical, err := sk.MarshalCanonical()
+		require.NoError(t, err)
+		require.Equal(t, canonical, meta.Data)
+
+		var got record
+		require.NoError(t, json.Unmarshal(data, &got))
+		require.Equal(t, sk.Estimate(), got.Users.Estimate())
+		require.Equal(t, sk.Estimate(), got.Events.Estimate())
+		require.Equal(t, sk.Fingerprint(), got.Users.Fingerprint())
+	}
+
+	data, err := json.Marshal(&struct{ S Sketch }{})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"S":null}`, string(data))
+
+	sk := New()
+	sk.InsertHash(rand.Uint64())
+	want := sk.Clone()
+	require.NoError(t, json.Unmarshal([]byte("null"), sk))
+	require.Equal(t, want.Fingerprint(), sk.Fingerprint())
+
+	dense, err := New().MarshalCanonical()
+	require.NoError(t, err)
+	encoded := base64.StdEncoding.EncodeToString(dense)
+	for _, tt := range []struct {
+		json string
+		err  error
+	}{
+		{`{"precision":14,"representation":"sparse","data":"` + encoded + `","extra":1}`, nil},
+		{`{"precision":14,"representation":"sparse","data":"` + encoded + `"`, ErrorInvalidData},
+		{`[]`, ErrorInvalidData},
+		{`{"precision":14,"representation":"sparse","data":"!!"}`, ErrorInvalidData},
+		{`{"precision":12,"representation":"sparse","data":"` + encoded + `"}`, ErrorInvalidData},
+		{`{"precision":14,"representation":"dense","data":"` + encoded + `"}`, ErrorInvalidData},
+		{`{"precision":14,"representation":"sparse"}`, ErrorTooShort},
+		{`{"precision":14,"representation":"sparse","data":"AwQAAQ=="}`, ErrorTooShort},
+		{`{"precision":14,"representation":"sparse","data":"BA4AAQAAAAA="}`, ErrorInvalidVersion},
+	} {
+		err := sk.UnmarshalJSON([]byte(tt.json))
+		if tt.err == nil {
+			require.NoError(t, err, tt.json)
+			require.Zero(t, sk.Estimate(), tt.json)
+			continue
+		}
+		require.ErrorIs(t, err, tt.err, tt.json)
+	}
+}
+
+func TestSketch_Text(t *testing.T) {
+	sk := New()
+	for i := 0; i < 1000; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+	text, err := sk.MarshalText()
+	require.NoError(t, err)
+	canonical, err := sk.MarshalCanonical()
+	require.NoError(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString(canonical), string(text))
+
+	got := &Sketch{}
+	require.NoError(t, got.UnmarshalText(text))
+	require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+
+	// Sketches nested in maps and slices round-trip too.
+	data, err := json.Marshal(map[string][]*Sketch{"a": {sk}})
+	require.NoError(t, err)
+	var m map[string][]*Sketch
+	require.NoError(t, json.Unmarshal(data, &m))
+	require.Equal(t, sk.Estimate(), m["a"][0].Estimate())
+
+	_, err = (&Sketch{}).MarshalText()
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	before := got.Fingerprint()
+	require.ErrorIs(t, got.UnmarshalText([]byte("not base64!")), ErrorInvalidData)
+	require.ErrorIs(t, got.UnmarshalText([]byte("AgQAAQ==")), ErrorTooShort)
+	require.Equal(t, before, got.Fingerprint())
+}
@@ -0,0 +1,109 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Format is an encoding of a Sketch that Decode recognizes.
+type Format uint8
+
+const (
+	// FormatUnknown is no format Decode recognizes.
+	FormatUnknown Format = iota
+	// FormatBinaryV1 is version 1 of the binary encoding, only read by
+	// UnmarshalBinary.
+	FormatBinaryV1
+	// FormatBinaryV2 is version 2 of the binary encoding, written by
+	// MarshalBinary.
+	FormatBinaryV2
+	// FormatBinaryV3 is version 3 of the binary encoding, written by
+	// MarshalBinaryV3.
+	FormatBinaryV3
+	// FormatProto is the Protocol Buffers message written by MarshalProto.
+	FormatProto
+	// FormatJSON is the JSON object written by MarshalJSON.
+	FormatJSON
+	// FormatText is the base64 text written by MarshalText.
+	FormatText
+	// FormatRedis is Redis's HyperLogLog string written by MarshalRedis.
+	FormatRedis
+)
+
+var formatNames = [...]string{
+	FormatUnknown:  "unknown",
+	FormatBinaryV1: "binary v1",
+	FormatBinaryV2: "binary v2",
+	FormatBinaryV3: "binary v3",
+	FormatProto:    "protobuf",
+	FormatJSON:     "JSON",
+	FormatText:     "text",
+	FormatRedis:    "Redis",
+}
+
+func (f Format) String() string {
+	if int(f) < len(formatNames) {
+		return formatNames[f]
+	}
+	return fmt.Sprintf("Format(%d)", uint8(f))
+}
+
+// formats lists the formats Decode recognizes, in the order it tries them,
+// with how each one starts and how it decodes.
+var formats = []struct {
+	format Format
+	match  func(data []byte) bool
+	decode func(sk *Sketch, data []byte) error
+}{
+	{FormatBinaryV1, func(data []byte) bool { return data[0] == 1 }, (*Sketch).UnmarshalBinary},
+	{FormatBinaryV2, func(data []byte) bool { return data[0] == 2 }, (*Sketch).UnmarshalBinary},
+	{FormatBinaryV3, func(data []byte) bool { return data[0] == versionV3 }, (*Sketch).UnmarshalBinary},
+	// A JSON object may start with white space. A space is also the tag of
+	// the representation field, but a representation of white space or of
+	// '{' is invalid, so JSON is tried before protobuf.
+	{FormatJSON, func(data []byte) bool {
+		data = bytes.TrimLeft(data, " \t\r\n")
+		return len(data) > 0 && data[0] == '{'
+	}, (*Sketch).UnmarshalJSON},
+	// Writers put fields in field number order, so a message starts with
+	// the tag of one of the Sketch fields with its wire type. The binary
+	// versions would be tags of field 0, which does not exist.
+	{FormatProto, func(data []byte) bool {
+		switch data[0] {
+		case protoFormatVersion<<3 | protoWireVarint,
+			protoHash<<3 | protoWireVarint,
+			protoPrecision<<3 | protoWireVarint,
+			protoRepresentation<<3 | protoWireVarint,
+			protoSparseKeys<<3 | protoWireVarint,
+			protoSparseKeys<<3 | protoWireBytes,
+			protoRegisters<<3 | protoWireBytes:
+			return true
+		}
+		return false
+	}, (*Sketch).UnmarshalProto},
+	// Every binary version starts with 6 zero bits, which base64 writes as
+	// 'A'.
+	{FormatText, func(data []byte) bool { return data[0] == 'A' }, (*Sketch).UnmarshalText},
+	{FormatRedis, func(data []byte) bool { return bytes.HasPrefix(data, []byte(redisMagic)) }, (*Sketch).UnmarshalRedis},
+}
+
+// Decode recognizes the format of data from its first bytes, and decodes it
+// into a new Sketch. It returns the format it recognized, or FormatUnknown
+// with an error wrapping ErrorInvalidVersion if it recognized none. Data in
+// the recognized format is validated as its unmarshal method does, and its
+// errors are returned along with the format.
+func Decode(data []byte) (*Sketch, Format, error) {
+	if len(data) > 0 {
+		for _, f := range formats {
+			if !f.match(data) {
+				continue
+			}
+			sk := &Sketch{}
+			if err := f.decode(sk, data); err != nil {
+				return nil, f.format, err
+			}
+			return sk, f.format, nil
+		}
+	}
+	return nil, FormatUnknown, decodeError(0, "format", ErrorInvalidVersion, "no format starts with %q", data[:min(len(data), 4)])
+}
@@ -0,0 +1,98 @@
+package hyperloglog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	for _, sparse := range []bool{true, false} {
+		sk := newSketchNoError(14, sparse)
+		rs, _ := NewSketchWithHash(14, sparse, HashRedis)
+		for i := 0; i < 100; i++ {
+			x := rand.Uint64()
+			sk.InsertHash(x)
+			rs.InsertHash(x)
+		}
+		v2, err := sk.MarshalBinary()
+		require.NoError(t, err)
+		v3, err := sk.MarshalBinaryV3()
+		require.NoError(t, err)
+		proto, err := sk.MarshalProto()
+		require.NoError(t, err)
+		js, err := json.Marshal(sk)
+		require.NoError(t, err)
+		text, err := sk.MarshalText()
+		require.NoError(t, err)
+		redis, err := rs.MarshalRedis()
+		require.NoError(t, err)
+
+		for _, tt := range []struct {
+			data   []byte
+			format Format
+		}{
+			{v2, FormatBinaryV2},
+			{v3, FormatBinaryV3},
+			{proto, FormatProto},
+			{js, FormatJSON},
+			{append([]byte(" \n\t"), js...), FormatJSON},
+			{text, FormatText},
+			{[]byte(base64.StdEncoding.EncodeToString(v3)), FormatText},
+			{redis, FormatRedis},
+		} {
+			got, format, err := Decode(tt.data)
+			require.NoError(t, err, tt.format)
+			require.Equal(t, tt.format, format)
+			if format == FormatRedis {
+				// Redis only holds registers.
+				require.Equal(t, denseRegs(rs), got.regs)
+				continue
+			}
+			require.Equal(t, sk.Fingerprint(), got.Fingerprint(), tt.format)
+		}
+	}
+
+	v1 := append([]byte{1, 4, 0, 0, 0, 0, 0, 0}, make([]byte, 8)...)
+	v1[8] = 0x21
+	got, format, err := Decode(v1)
+	require.NoError(t, err)
+	require.Equal(t, FormatBinaryV1, format)
+	require.Equal(t, uint8(2), got.regs[0])
+}
+
+func TestDecode_Errors(t *testing.T) {
+	for _, data := range [][]byte{nil, {0}, []byte("HLLS\x01"), []byte("null"), {0x28 << 1}} {
+		got, format, err := Decode(data)
+		require.Nil(t, got)
+		require.Equal(t, FormatUnknown, format, "%q", data)
+		require.ErrorIs(t, err, ErrorInvalidVersion, "%q", data)
+	}
+
+	// A recognized format that does not decode reports both.
+	for _, tt := range []struct {
+		data   []byte
+		format Format
+		err    error
+	}{
+		{[]byte{2}, FormatBinaryV2, ErrorTooShort},
+		{[]byte{3, 14, 0, 0, 0, 0, 0, 0}, FormatBinaryV3, ErrorChecksum},
+		{[]byte{0x08, 3}, FormatProto, ErrorInvalidVersion},
+		// White space that leads to no JSON is a representation field.
+		{[]byte("  "), FormatProto, ErrorInvalidVersion},
+		{[]byte(`{"precision":4}`), FormatJSON, ErrorTooShort},
+		{[]byte("A!"), FormatText, ErrorInvalidData},
+		{[]byte("HYLL"), FormatRedis, ErrorTooShort},
+	} {
+		got, format, err := Decode(tt.data)
+		require.Nil(t, got)
+		require.Equal(t, tt.format, format)
+		require.ErrorIs(t, err, tt.err, tt.format)
+	}
+
+	require.Equal(t, "protobuf", FormatProto.String())
+	require.Equal(t, "Format(200)", Format(200).String())
+}
@@ -3,10 +3,12 @@
 package hyperloglog
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"math/bits"
 	"slices"
 )
 
@@ -20,14 +22,77 @@ const (
 // Clone. Its zero value is empty and initializes on insertion or merge: a zero
 // value first used with Insert or InsertHash takes New's configuration
 // (precision 14, sparse), while a zero value first used with Merge adopts the
-// other sketch's precision and representation.
+// other sketch's precision, representation and hash function.
 type Sketch struct {
 	p          uint8
 	m          uint32
-	alpha      float64
 	tmpSet     set
 	sparseList *compressedList
 	regs       []uint8
+	// hashFunc is the hash function Insert uses, and that the hashes sk
+	// has seen are assumed to come from.
+	hashFunc HashFunc
+}
+
+// HashFunc identifies the hash function that feeds a Sketch. Sketches fed by
+// different hash functions put the same element in unrelated registers, so
+// Merge refuses to combine them, and an encoding that pins a hash function
+// refuses to write a Sketch fed by another one.
+type HashFunc uint8
+
+const (
+	// HashMetro is MetroHash64 with seed 1337, which Insert uses unless the
+	// Sketch was created for another hash function. The binary, JSON and
+	// text encodings pin it.
+	HashMetro HashFunc = iota
+	// HashRedis is the hash Redis's PFADD uses, as RedisHash computes it.
+	// The Redis encoding pins it.
+	HashRedis
+)
+
+var hashFuncNames = [...]string{
+	HashMetro: "MetroHash64",
+	HashRedis: "Redis MurmurHash64A",
+}
+
+func (h HashFunc) String() string {
+	if int(h) < len(hashFuncNames) {
+		return hashFuncNames[h]
+	}
+	return fmt.Sprintf("HashFunc(%d)", uint8(h))
+}
+
+// sum hashes e with h.
+func (h HashFunc) sum(e []byte) uint64 {
+	if h == HashRedis {
+		return RedisHash(e)
+	}
+	return hash(e)
+}
+
+// checkFormatHash returns an error wrapping ErrorHashMismatch unless sk is
+// fed by h, which the named encoding pins.
+func (sk *Sketch) checkFormatHash(format string, h HashFunc) error {
+	if sk.hashFunc != h {
+		return fmt.Errorf("hyperloglog: %s encoding pins %v, sketch hashes with %v: %w", format, h, sk.hashFunc, ErrorHashMismatch)
+	}
+	return nil
+}
+
+// sharedHashFunc returns the hash function feeding the sketches that are
+// neither nil nor zero-value, and false if they are fed by different ones.
+func sharedHashFunc(sketches ...*Sketch) (HashFunc, bool) {
+	h, seen := HashMetro, false
+	for _, sk := range sketches {
+		if sk == nil || sk.p == 0 {
+			continue
+		}
+		if seen && sk.hashFunc != h {
+			return h, false
+		}
+		h, seen = sk.hashFunc, true
+	}
+	return h, true
 }
 
 // New returns a HyperLogLog Sketch with 2^14 registers (precision 14)
@@ -45,6 +110,14 @@ func NewNoSparse() *Sketch { return newSketchNoError(14, false) }
 // New16NoSparse returns a HyperLogLog Sketch with 2^16 registers (precision 16) that will not use a sparse representation
 func New16NoSparse() *Sketch { return newSketchNoError(16, false) }
 
+// NewRedis returns a HyperLogLog Sketch with 2^14 registers (precision 14)
+// whose Insert hashes with RedisHash, so that it counts elements as Redis does
+// and MarshalRedis can write it.
+func NewRedis() *Sketch {
+	sk, _ := NewSketchWithHash(14, true, HashRedis)
+	return sk
+}
+
 func newSketchNoError(precision uint8, sparse bool) *Sketch {
 	sk, _ := NewSketch(precision, sparse)
 	return sk
@@ -80,9 +153,8 @@ func NewSketch(precision uint8, sparse bool) (*Sketch, error) {
 	}
 	m := uint32(1) << precision
 	s := &Sketch{
-		m:     m,
-		p:     precision,
-		alpha: alpha(float64(m)),
+		m: m,
+		p: precision,
 	}
 	if sparse {
 		s.tmpSet = makeSet(0)
@@ -93,6 +165,25 @@ func NewSketch(precision uint8, sparse bool) (*Sketch, error) {
 	return s, nil
 }
 
+// NewSketchWithHash is NewSketch for a Sketch whose Insert hashes with h. A
+// hash function this package does not know returns an error wrapping
+// ErrorInvalidParameter.
+func NewSketchWithHash(precision uint8, sparse bool, h HashFunc) (*Sketch, error) {
+	if int(h) >= len(hashFuncNames) {
+		return nil, fmt.Errorf("hyperloglog: unknown %v: %w", h, ErrorInvalidParameter)
+	}
+	sk, err := NewSketch(precision, sparse)
+	if err != nil {
+		return nil, err
+	}
+	sk.hashFunc = h
+	return sk, nil
+}
+
+// HashFunc returns the hash function Insert uses. It is HashMetro unless sk
+// was created for another one, or decoded from an encoding of one.
+func (sk *Sketch) HashFunc() HashFunc { return sk.hashFunc }
+
 func (sk *Sketch) sparse() bool { return sk.sparseList != nil }
 
 // Clone returns a deep copy of sk.
@@ -114,6 +205,8 @@ func (sk *Sketch) maybeToNormal() {
 }
 
 // Merge adds other to sk. Nil and zero-value sketches are treated as empty.
+// Sketches fed by different hash functions return an error wrapping
+// ErrorHashMismatch.
 func (sk *Sketch) Merge(other *Sketch) error {
 	if other == nil || other.p == 0 {
 		return nil
@@ -122,6 +215,9 @@ func (sk *Sketch) Merge(other *Sketch) error {
 		*sk = *other.Clone()
 		return nil
 	}
+	if sk.hashFunc != other.hashFunc {
+		return fmt.Errorf("hyperloglog: cannot merge %v hashes with %v hashes: %w", sk.hashFunc, other.hashFunc, ErrorHashMismatch)
+	}
 	if sk.p != other.p {
 		return fmt.Errorf("hyperloglog: cannot merge precision %d with precision %d: %w", sk.p, other.p, ErrorPrecisionMismatch)
 	}
@@ -180,10 +276,88 @@ func (sk *Sketch) toNormal() {
 	sk.sparseList = nil
 }
 
+// Fold lowers sk's precision to precision, leaving sk exactly as if every hash
+// it has seen had been inserted at the lower precision. Folding trades
+// accuracy for memory: a dense Sketch shrinks by half per step. The precision
+// has to be >= 4 and at most sk's, otherwise an error wrapping
+// ErrorInvalidPrecision is returned. Folding a zero-value Sketch does
+// nothing.
+func (sk *Sketch) Fold(precision uint8) error {
+	if sk.p == 0 {
+		return nil
+	}
+	if err := checkPrecision(precision); err != nil || precision > sk.p {
+		return fmt.Errorf("hyperloglog: cannot fold precision %d to %d: %w", sk.p, precision, ErrorInvalidPrecision)
+	}
+	if precision == sk.p {
+		return nil
+	}
+	folded := newSketchNoError(precision, sk.sparse())
+	folded.hashFunc = sk.hashFunc
+	if sk.sparse() {
+		sk.mergeSparse()
+		keys := make([]uint32, 0, sk.sparseList.count)
+		for iter := sk.sparseList.Iter(); iter.HasNext(); {
+			keys = append(keys, foldKey(iter.Next(), precision))
+		}
+		slices.Sort(keys)
+		for _, k := range slices.Compact(keys) {
+			folded.sparseList.Append(k)
+		}
+		if uint32(folded.sparseList.Len()) > folded.m {
+			folded.toNormal()
+		}
+	} else {
+		d := sk.p - precision
+		for i, r := range sk.regs {
+			if r != 0 {
+				folded.insert(foldRegister(uint32(i), r, d))
+			}
+		}
+	}
+	*sk = *folded
+	return nil
+}
+
+// foldKey returns the sparse key k as it would have been encoded at precision
+// p, which may be lower than the precision k was encoded at.
+func foldKey(k uint32, p uint8) uint32 {
+	// Sparse keys hold 25 bits of index whatever the precision, but a key
+	// only carries its own rho when the index bits below the precision are
+	// zero. At a lower precision more of them have to be, and the other keys
+	// fall back to deriving rho from the index.
+	if k&1 == 1 && bextr32(k, 7, pp-p) != 0 {
+		return k >> 7 << 1
+	}
+	return k
+}
+
+// foldRegister returns the index and value that the non-zero register i
+// holding r maps to when d index bits are dropped.
+func foldRegister(i uint32, r uint8, d uint8) (uint32, uint8) {
+	// The index bits dropped lead the rest of the hash: rho is found among
+	// them, or follows them when they are all zero.
+	if low := i & (1<<d - 1); low != 0 {
+		r = uint8(bits.LeadingZeros32(low<<(32-d))) + 1
+	} else {
+		r += d
+	}
+	return i >> d, r
+}
+
+// sizeInBytes approximates the memory sk's registers or sparse keys take.
+func (sk *Sketch) sizeInBytes() int {
+	if sk.sparse() {
+		return sk.sparseList.Len() + 4*sk.tmpSet.Len()
+	}
+	return len(sk.regs)
+}
+
 func (sk *Sketch) insert(i uint32, r uint8) { sk.regs[i] = max(r, sk.regs[i]) }
 
-// Insert hashes e with the package's MetroHash64 seed and adds it to sk.
-func (sk *Sketch) Insert(e []byte) { sk.InsertHash(hash(e)) }
+// Insert hashes e with sk's hash function, by default the package's
+// MetroHash64 seed, and adds it to sk.
+func (sk *Sketch) Insert(e []byte) { sk.InsertHash(sk.hashFunc.sum(e)) }
 
 // InsertHash adds a uniformly distributed 64-bit hash to sk.
 func (sk *Sketch) InsertHash(x uint64) {
@@ -219,9 +393,14 @@ func (sk *Sketch) Estimate() uint64 {
 	}
 
 	sum, ez := sumAndZeros(sk.regs)
-	m := float64(sk.m)
+	return estimateDense(sk.p, sum, ez)
+}
 
-	est := sk.alpha * m * (m - ez) / (sum + beta(sk.p, ez))
+// estimateDense applies the LogLog-Beta estimator to 2^p registers whose
+// values sum to sum as powers of 1/2, ez of which are zero.
+func estimateDense(p uint8, sum, ez float64) uint64 {
+	m := float64(uint32(1) << p)
+	est := alpha(m) * m * (m - ez) / (sum + beta(p, ez))
 	return uint64(est + 0.5)
 }
 
@@ -283,7 +462,9 @@ func (sk *Sketch) MarshalBinary() (data []byte, err error) {
 //
 // An uninitialized (zero value) Sketch has no encoding: its precision is 0, so
 // AppendBinary returns an error wrapping ErrorInvalidPrecision and leaves the
-// caller's buffer unmodified.
+// caller's buffer unmodified. The encoding pins the hash function to
+// HashMetro, so a Sketch fed by another one returns an error wrapping
+// ErrorHashMismatch, and also leaves the buffer unmodified.
 //
 // UnmarshalBinary requires the encoding to be the entire buffer it is handed
 // and rejects trailing bytes with ErrorInvalidData. A caller appending a Sketch
@@ -294,13 +475,28 @@ func (sk *Sketch) MarshalBinary() (data []byte, err error) {
 // encode to different bytes, depending on insertion order and on whether
 // Estimate has compacted the sparse representation. An encoding must not be
 // hashed, deduplicated, or compared for equality to decide whether two
-// sketches hold the same values.
+// sketches hold the same values; use AppendCanonical or Fingerprint for that.
 func (sk *Sketch) AppendBinary(data []byte) ([]byte, error) {
+	if err := sk.checkBinary(); err != nil {
+		return data, err
+	}
+	return sk.appendBinary(data)
+}
+
+// checkBinary returns the error AppendBinary and AppendBinaryV3 return for a
+// Sketch they cannot encode.
+func (sk *Sketch) checkBinary() error {
 	// Refuse to write a header no UnmarshalBinary would accept, and leave the
 	// caller's buffer untouched when we do.
 	if err := checkPrecision(sk.p); err != nil {
-		return data, fmt.Errorf("hyperloglog: precision %d: %w", sk.p, err)
+		return fmt.Errorf("hyperloglog: precision %d: %w", sk.p, err)
 	}
+	return sk.checkFormatHash("binary", HashMetro)
+}
+
+// appendBinary is AppendBinary for a Sketch of a valid precision, whatever its
+// hash function.
+func (sk *Sketch) appendBinary(data []byte) ([]byte, error) {
 	data = slices.Grow(data, 8+len(sk.regs))
 	// Marshal a version marker.
 	data = append(data, version)
@@ -341,13 +537,70 @@ func (sk *Sketch) AppendBinary(data []byte) ([]byte, error) {
 	return data, nil
 }
 
+// MarshalCanonical returns the canonical encoding of sk. See AppendCanonical.
+func (sk *Sketch) MarshalCanonical() ([]byte, error) {
+	return sk.AppendCanonical(nil)
+}
+
+// AppendCanonical appends the canonical encoding of sk to data. Sketches
+// holding the same values have the same canonical encoding, whatever order the
+// values were inserted in and whether Estimate has run, so it can be hashed,
+// deduplicated and compared for equality.
+//
+// The canonical encoding is a version 2 encoding that UnmarshalBinary reads
+// back: the sparse representation is compacted, with an empty tmp set and the
+// keys sorted into the compressed list, or dense if Estimate would have turned
+// it dense. A sparse Sketch and a dense one have different encodings even when
+// their registers agree, since the sparse keys hold more than the registers.
+// sk is not modified.
+//
+// As for AppendBinary, a zero-value Sketch returns an error wrapping
+// ErrorInvalidPrecision, and one fed by another hash function than HashMetro
+// an error wrapping ErrorHashMismatch, and data is left unmodified.
+func (sk *Sketch) AppendCanonical(data []byte) ([]byte, error) {
+	return sk.canonical().AppendBinary(data)
+}
+
+// Fingerprint returns the SHA-256 digest of the canonical encoding of sk, so
+// that sketches holding the same values have the same fingerprint. See
+// AppendCanonical. The fingerprint of a zero-value Sketch is the digest of no
+// bytes. A Sketch fed by another hash function than HashMetro, which has no
+// canonical encoding, is fingerprinted as if it had one, followed by its
+// HashFunc byte.
+func (sk *Sketch) Fingerprint() [sha256.Size]byte {
+	if sk.p == 0 {
+		return sha256.Sum256(nil)
+	}
+	// A valid precision always encodes.
+	data, _ := sk.canonical().appendBinary(nil)
+	if sk.hashFunc != HashMetro {
+		data = append(data, byte(sk.hashFunc))
+	}
+	return sha256.Sum256(data)
+}
+
+// canonical returns sk in the state Estimate would leave it: its sparse keys
+// merged into the compressed list, or dense when they outgrow the registers.
+// It returns sk itself when it already is, and a compacted copy otherwise.
+func (sk *Sketch) canonical() *Sketch {
+	if !sk.sparse() || sk.tmpSet.Len() == 0 && uint32(sk.sparseList.Len()) <= sk.m {
+		return sk
+	}
+	c := sk.Clone()
+	c.mergeSparse()
+	if uint32(c.sparseList.Len()) > c.m {
+		c.toNormal()
+	}
+	return c
+}
+
 // ErrorTooShort is returned, wrapped, when a buffer ends before the format
 // requires. UnmarshalBinary used to return it unwrapped, so err ==
 // ErrorTooShort is now always false and callers have to use errors.Is.
 var ErrorTooShort = errors.New("too short binary")
 
 // ErrorInvalidVersion is returned by UnmarshalBinary when the version byte is
-// neither 1 nor 2.
+// not 1, 2 or 3.
 var ErrorInvalidVersion = errors.New("unknown serialization version")
 
 // ErrorInvalidPrecision is returned unwrapped by NewSketch, and wrapped by
@@ -363,12 +616,21 @@ var ErrorInvalidData = errors.New("invalid binary data")
 // precisions.
 var ErrorPrecisionMismatch = errors.New("precisions must be equal")
 
+// ErrorHashMismatch is wrapped when sketches fed by different hash functions
+// are combined, and by encoders when the encoding pins another hash function
+// than the Sketch's.
+var ErrorHashMismatch = errors.New("hash functions must be equal")
+
+// ErrorInvalidParameter is wrapped by constructors when a size or tuning
+// parameter other than the precision is out of range.
+var ErrorInvalidParameter = errors.New("invalid sketch parameter")
+
 // UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
 //
 // The binary format starts with a 4 byte header:
 //
-//	byte 0: version. 2 is written; 1 and 2 are accepted, anything else
-//	        returns ErrorInvalidVersion.
+//	byte 0: version. 2 is written; 1, 2 and 3 are accepted, anything
+//	        else returns ErrorInvalidVersion.
 //	byte 1: precision p, which must be in [4, 18], otherwise
 //	        ErrorInvalidPrecision is returned.
 //	byte 2: b, the register bias of the version 1 dense payload. It is
@@ -392,10 +654,21 @@ var ErrorPrecisionMismatch = errors.New("precisions must be equal")
 // payload bytes 4:8 are ignored and bytes 8: hold m/2 bytes of two 4 bit
 // registers each, both biased by b.
 //
-// Byte 2 must be 0 when the version is 2, and byte 3 must be 0 or 1; any other
-// value returns ErrorInvalidData. The compressed list's count must equal the
-// number of varints in its stream and must be less than 2^25, and its last
-// value must equal the sum of the deltas, otherwise ErrorInvalidData is
+// Version 3, written by AppendBinaryV3, has the same header with byte 2 0, and
+// ends with the big endian CRC-32C (Castagnoli) of every byte before it; a
+// mismatch returns ErrorChecksum, which wraps ErrorInvalidData. Its sparse
+// payload is a uvarint count N of tmp set keys, at most m, then N uvarints
+// holding the keys in increasing order as deltas from the previous key, the
+// first from 0, then a uvarint size sz and sz bytes of the compressed list's
+// delta varint stream. Its dense payload is a range coded stream of the m
+// registers, each coded as 6 bits through a binary tree of adaptive
+// probabilities that start at 1/2 and move 1/32 of the way towards each bit
+// coded; the stream has to be exactly as long as decoding it requires.
+//
+// Byte 2 must be 0 when the version is 2 or 3, and byte 3 must be 0 or 1; any
+// other value returns ErrorInvalidData. The compressed list's count must equal
+// the number of varints in its stream and must be less than 2^25, and its
+// last value must equal the sum of the deltas, otherwise ErrorInvalidData is
 // returned. Each delta varint must be at most 5 bytes long, minimally encoded,
 // and must fit in 32 bits. The running sum of the deltas must strictly
 // increase after the first delta and must not wrap; a first delta of 0 is
@@ -410,19 +683,47 @@ var ErrorPrecisionMismatch = errors.New("precisions must be equal")
 // Version, precision and every length prefix are validated before the receiver
 // is mutated, so the receiver is never left with registers or a sparse list
 // shorter than the layout implies. If an error is returned sk is left
-// unchanged. Every error returned by UnmarshalBinary wraps one of the
-// exported sentinels above and has to be matched with errors.Is rather than
-// with ==.
+// unchanged. Every error returned by UnmarshalBinary is a *DecodeError that
+// wraps one of the exported sentinels above and has to be matched with
+// errors.Is rather than with ==. UnmarshalBinaryWithOptions restricts what is
+// accepted further.
 func (sk *Sketch) UnmarshalBinary(data []byte) error {
+	return sk.unmarshalBinary(data, DecodeOptions{})
+}
+
+func (sk *Sketch) unmarshalBinary(data []byte, opts DecodeOptions) error {
+	view, err := parseBinary(data, opts)
+	if err != nil {
+		return err
+	}
+	// The parsed sketch is only committed to the receiver once the whole
+	// payload has been validated.
+	tmp, err := view.sketch()
+	if err != nil {
+		return err
+	}
+	*sk = *tmp
+	return nil
+}
+
+// parseBinary validates the encoding data as UnmarshalBinary documents, except
+// for the registers of version 3, which are validated as they are decoded.
+func parseBinary(data []byte, opts DecodeOptions) (binaryView, error) {
 	if len(data) < 8 {
-		return fmt.Errorf("hyperloglog: header needs 8 bytes, have %d: %w", len(data), ErrorTooShort)
+		return binaryView{}, decodeError(0, "header", ErrorTooShort, "need 8 bytes, have %d", len(data))
 	}
 
 	// Unmarshal version. We may need this in the future if we make
 	// non-compatible changes.
 	v := data[0]
+	if v == versionV3 {
+		return parseBinaryV3(data, opts)
+	}
 	if v != 1 && v != 2 {
-		return fmt.Errorf("hyperloglog: version %d: %w", v, ErrorInvalidVersion)
+		return binaryView{}, decodeError(0, "version", ErrorInvalidVersion, "version %d", v)
+	}
+	if v == 1 && opts.RejectV1 {
+		return binaryView{}, decodeError(0, "version", ErrorLimitExceeded, "version 1 is rejected")
 	}
 
 	// Unmarshal p.
@@ -430,33 +731,31 @@ func (sk *Sketch) UnmarshalBinary(data []byte) error {
 
 	// Determine if we need a sparse Sketch
 	if data[3] > 1 {
-		return fmt.Errorf("hyperloglog: header byte 3 = %d: %w", data[3], ErrorInvalidData)
+		return binaryView{}, decodeError(3, "representation", ErrorInvalidData, "header byte 3 = %d", data[3])
 	}
 	sparse := data[3] == 1
 
 	// Unmarshal b. Only the version 1 dense encoding has a register bias.
 	b := data[2]
 	if v == 2 && b != 0 {
-		return fmt.Errorf("hyperloglog: header byte 2 = %d for version 2: %w", b, ErrorInvalidData)
+		return binaryView{}, decodeError(2, "register bias", ErrorInvalidData, "header byte 2 = %d for version 2", b)
 	}
 
 	// Validate the precision before anything is sized from it, so that a
 	// header declaring a large p cannot allocate registers the payload does
-	// not have. The scratch Sketch below is only built once the declared
-	// lengths check out, and the receiver is only replaced once the whole
-	// payload has parsed.
-	if err := checkPrecision(p); err != nil {
-		return fmt.Errorf("hyperloglog: precision %d: %w", p, err)
+	// not have.
+	if err := opts.checkPrecision(p); err != nil {
+		return binaryView{}, err
 	}
 	m := uint32(1) << p
-
-	// The parsed sketch is only committed to the receiver at the single exit
-	// below, after the whole payload has been validated.
-	var tmp *Sketch
+	view := binaryView{version: v, p: p, sparse: sparse}
 
 	switch {
 	case sparse:
 		// Using the sparse Sketch.
+		if err := opts.checkSparse(); err != nil {
+			return binaryView{}, err
+		}
 
 		// Unmarshal the tmp_set.
 		tssz := binary.BigEndian.Uint32(data[4:8])
@@ -465,59 +764,75 @@ func (sk *Sketch) UnmarshalBinary(data []byte) error {
 		// to read 4 bytes.
 		need := 8 + 4*uint64(tssz)
 		if need > uint64(len(data)) {
-			return fmt.Errorf("hyperloglog: tmp set of %d keys needs %d bytes, have %d: %w", tssz, need, len(data), ErrorTooShort)
+			return binaryView{}, decodeError(4, "tmp set count", ErrorTooShort, "%d keys need %d bytes, have %d", tssz, need, len(data))
 		}
 		if tssz > m {
-			return fmt.Errorf("hyperloglog: tmp set count %d exceeds register count %d: %w", tssz, m, ErrorInvalidData)
+			return binaryView{}, decodeError(4, "tmp set count", ErrorInvalidData, "count %d exceeds register count %d", tssz, m)
+		}
+		if err := opts.checkSparseKeys(4, "tmp set count", uint64(tssz)); err != nil {
+			return binaryView{}, err
 		}
-		tmp = newSketchNoError(p, true)
-		tmp.tmpSet = makeSet(int(tssz))
 
 		tsLastByte := int(need)
 		for i := 8; i < tsLastByte; i += 4 {
 			k := binary.BigEndian.Uint32(data[i : i+4])
-			if err := checkSparseKey(k, p); err != nil {
-				return fmt.Errorf("hyperloglog: tmp set key at offset %d: %w", i, err)
+			if err := checkSparseKey(k, p, i, "tmp set key"); err != nil {
+				return binaryView{}, err
 			}
-			tmp.tmpSet.add(k)
 		}
+		view.tmpSet, view.tmpCount = data[8:tsLastByte], int(tssz)
 
 		// Unmarshal the sparse Sketch.
-		if err := tmp.sparseList.unmarshal(data[tsLastByte:], p); err != nil {
-			return fmt.Errorf("hyperloglog: compressed list at offset %d: %w", tsLastByte, err)
+		list, err := parseCompressedList(data[tsLastByte:], p, tsLastByte)
+		if err != nil {
+			return binaryView{}, err
+		}
+		if err := opts.checkSparseKeys(tsLastByte, "compressed list count", uint64(tssz)+uint64(list.count)); err != nil {
+			return binaryView{}, err
 		}
+		view.list = list
 
 	case v == 1:
 		// Using the version 1 dense Sketch, where two 4 bit registers are
 		// packed into each byte.
 		payload := data[8:]
 		nb := int(m) / 2
-		if err := exactLen("v1 dense registers at offset 8", uint64(len(payload)), uint64(nb)); err != nil {
-			return err
+		if err := decodeLen(8, "v1 dense registers", uint64(len(payload)), uint64(nb)); err != nil {
+			return binaryView{}, err
 		}
-		tmp = newSketchNoError(p, false)
-		if err := tmp.unmarshalBinaryV1(payload, b); err != nil {
-			return err
+		maxRho := maxRho(p)
+		for i, v := range payload {
+			// Widen before adding the bias so that it cannot wrap.
+			hi := uint16(v>>4) + uint16(b)
+			lo := uint16(v&0x0f) + uint16(b)
+			if hi > uint16(maxRho) {
+				return binaryView{}, decodeError(8+i, "v1 register", ErrorInvalidData, "register %d = %d, max %d", i*2, hi, maxRho)
+			}
+			if lo > uint16(maxRho) {
+				return binaryView{}, decodeError(8+i, "v1 register", ErrorInvalidData, "register %d = %d, max %d", i*2+1, lo, maxRho)
+			}
 		}
+		view.regs, view.bias = payload, b
 
 	default:
 		// Using the version 2 dense Sketch.
 		payload := data[8:]
 		sz := binary.BigEndian.Uint32(data[4:8])
 		if uint64(sz) != uint64(m) {
-			return fmt.Errorf("hyperloglog: dense register count %d, want m = %d: %w", sz, m, ErrorInvalidData)
+			return binaryView{}, decodeError(4, "dense register count", ErrorInvalidData, "count %d, want m = %d", sz, m)
 		}
-		if err := exactLen("dense registers at offset 8", uint64(len(payload)), uint64(sz)); err != nil {
-			return err
+		if err := decodeLen(8, "dense registers", uint64(len(payload)), uint64(sz)); err != nil {
+			return binaryView{}, err
 		}
-		tmp = newSketchNoError(p, false)
-		if err := tmp.unmarshalBinaryV2(payload); err != nil {
-			return err
+		maxRho := maxRho(p)
+		for i, r := range payload {
+			if r > maxRho {
+				return binaryView{}, decodeError(8+i, "register", ErrorInvalidData, "register %d = %d, max %d", i, r, maxRho)
+			}
 		}
+		view.regs = payload
 	}
-
-	*sk = *tmp
-	return nil
+	return view, nil
 }
 
 func sumAndZeros(regs []uint8) (res, ez float64) {
@@ -530,39 +845,6 @@ func sumAndZeros(regs []uint8) (res, ez float64) {
 	return res, ez
 }
 
-// unmarshalBinaryV1 requires len(sk.regs) == int(sk.m) and
-// len(data) == int(sk.m)/2.
-func (sk *Sketch) unmarshalBinaryV1(data []byte, b uint8) error {
-	maxRho := maxRho(sk.p)
-	for i, v := range data {
-		// Widen before adding the bias so that it cannot wrap.
-		hi := uint16(v>>4) + uint16(b)
-		lo := uint16(v&0x0f) + uint16(b)
-		if hi > uint16(maxRho) {
-			return fmt.Errorf("hyperloglog: v1 register %d = %d at offset %d, max %d: %w", i*2, hi, 8+i, maxRho, ErrorInvalidData)
-		}
-		if lo > uint16(maxRho) {
-			return fmt.Errorf("hyperloglog: v1 register %d = %d at offset %d, max %d: %w", i*2+1, lo, 8+i, maxRho, ErrorInvalidData)
-		}
-		sk.regs[i*2] = uint8(hi)
-		sk.regs[i*2+1] = uint8(lo)
-	}
-	return nil
-}
-
-// unmarshalBinaryV2 requires len(sk.regs) == int(sk.m) and
-// len(data) == int(sk.m).
-func (sk *Sketch) unmarshalBinaryV2(data []byte) error {
-	maxRho := maxRho(sk.p)
-	copy(sk.regs, data)
-	for i, r := range sk.regs {
-		if r > maxRho {
-			return fmt.Errorf("hyperloglog: register %d = %d, max %d: %w", i, r, maxRho, ErrorInvalidData)
-		}
-	}
-	return nil
-}
-
 // Reset clears the sketch while preserving its current representation and
 // allocated backing storage.
 func (sk *Sketch) Reset() {
@@ -2,6 +2,7 @@ package hyperloglog
 
 import (
 	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -778,6 +779,9 @@ func TestHLL_Unmarshal_Malformed(t *testing.T) {
 				return
 			}
 			require.ErrorIs(t, err, tt.wantErr)
+			var de *DecodeError
+			require.ErrorAs(t, err, &de)
+			require.Same(t, tt.wantErr, de.Err)
 		})
 	}
 }
@@ -793,6 +797,9 @@ func FuzzUnmarshalBinary(f *testing.F) {
 			data, err := sk.MarshalBinary()
 			require.NoError(f, err)
 			f.Add(data)
+			data, err = sk.MarshalBinaryV3()
+			require.NoError(f, err)
+			f.Add(data)
 		}
 	}
 	for _, tt := range unmarshalMalformedTests {
@@ -810,11 +817,15 @@ func FuzzUnmarshalBinary(f *testing.F) {
 					errors.Is(err, ErrorInvalidVersion) ||
 					errors.Is(err, ErrorInvalidPrecision),
 				"unexpected error: %v", err)
+			require.Error(t, (&Sketch{}).MergeBinary(data))
 			// A rejected blob leaves the receiver as it was, and usable.
 			sk.InsertHash(rand.Uint64())
 			sk.Estimate()
 			return
 		}
+		merged := &Sketch{}
+		require.NoError(t, merged.MergeBinary(data))
+		require.Equal(t, denseRegs(sk), denseRegs(merged))
 
 		sk.Estimate()
 		require.NoError(t, sk.Merge(sk.Clone()))
@@ -938,6 +949,72 @@ func Benchmark_UnmarshalBinary(b *testing.B) {
 	})
 }
 
+func TestHLL_Canonical(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		n      int
+		sparse bool
+	}{
+		{"sparse", 500, true},
+		{"sparse list only", 5000, true},
+		{"promoted", 30000, true},
+		{"dense", 30000, false},
+	} {
+		hashes := make([]uint64, tt.n)
+		for i := range hashes {
+			hashes[i] = rand.Uint64()
+		}
+		a := newSketchNoError(14, tt.sparse)
+		b := newSketchNoError(14, tt.sparse)
+		for i, x := range hashes {
+			a.InsertHash(x)
+			b.InsertHash(hashes[len(hashes)-1-i])
+			if i%97 == 0 {
+				b.Estimate()
+			}
+		}
+		before := a.Clone()
+
+		ca, err := a.MarshalCanonical()
+		require.NoError(t, err, tt.name)
+		cb, err := b.MarshalCanonical()
+		require.NoError(t, err, tt.name)
+		require.Equal(t, ca, cb, tt.name)
+		require.Equal(t, a.Fingerprint(), b.Fingerprint(), tt.name)
+		require.Equal(t, before.sparse(), a.sparse(), tt.name)
+		require.Equal(t, before.tmpSet.Len(), a.tmpSet.Len(), tt.name)
+
+		decoded := &Sketch{}
+		require.NoError(t, decoded.UnmarshalBinary(ca), tt.name)
+		require.Equal(t, a.Estimate(), decoded.Estimate(), tt.name)
+		again, err := decoded.MarshalCanonical()
+		require.NoError(t, err, tt.name)
+		require.Equal(t, ca, again, tt.name)
+
+		prefix := []byte("prefix")
+		appended, err := a.AppendCanonical(prefix)
+		require.NoError(t, err, tt.name)
+		require.Equal(t, append([]byte("prefix"), ca...), appended, tt.name)
+
+		// Register 0 takes the largest rho there is.
+		b.InsertHash(1)
+		require.NotEqual(t, a.Fingerprint(), b.Fingerprint(), tt.name)
+	}
+
+	// A sparse sketch and a dense one with the same registers differ.
+	sparse, dense := New(), NewNoSparse()
+	for i := 0; i < 100; i++ {
+		x := rand.Uint64()
+		sparse.InsertHash(x)
+		dense.InsertHash(x)
+	}
+	require.NotEqual(t, sparse.Fingerprint(), dense.Fingerprint())
+
+	_, err := (&Sketch{}).MarshalCanonical()
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	require.Equal(t, sha256.Sum256(nil), (&Sketch{}).Fingerprint())
+}
+
 // The compressed list decoder rejects a zero delta after the first entry, so
 // mergeSparse has to emit every key at most once even when the tmp set and the
 // sparse list overlap.
@@ -982,6 +1059,42 @@ func TestHLL_MergeSparse_NoZeroDeltas(t *testing.T) {
 	require.Equal(t, sk.Estimate(), res.Estimate())
 }
 
+func TestHLL_Fold(t *testing.T) {
+	for _, n := range []int{0, 10, 500, 5000, 1000000} {
+		for _, sparse := range []bool{true, false} {
+			sk := newSketchNoError(16, sparse)
+			want := newSketchNoError(11, sparse)
+			for i := 0; i < n; i++ {
+				x := rand.Uint64()
+				sk.InsertHash(x)
+				want.InsertHash(x)
+			}
+			require.NoError(t, sk.Fold(16))
+			require.EqualValues(t, 16, sk.p)
+			require.NoError(t, sk.Fold(11))
+			require.EqualValues(t, 11, sk.p)
+
+			// A sparse Sketch may stay sparse longer than one inserted
+			// into directly, so compare the dense registers.
+			require.Equal(t, denseRegs(want), denseRegs(sk), "n=%d sparse=%v", n, sparse)
+		}
+	}
+
+	sk := New()
+	require.ErrorIs(t, sk.Fold(15), ErrorInvalidPrecision)
+	require.ErrorIs(t, sk.Fold(3), ErrorInvalidPrecision)
+	var zero Sketch
+	require.NoError(t, zero.Fold(10))
+}
+
+func denseRegs(sk *Sketch) []uint8 {
+	sk = sk.Clone()
+	if sk.sparse() {
+		sk.toNormal()
+	}
+	return sk.regs
+}
+
 func TestHLL_Clone(t *testing.T) {
 	sk1 := NewTestSketch(16)
 
@@ -1043,9 +1156,6 @@ func TestHLL_Add_Hash(t *testing.T) {
 
 func isSketchEqual(sk1, sk2 *Sketch) bool {
 	switch {
-	case sk1.alpha != sk2.alpha:
-		fmt.Printf("alpha mismatch: %f != %f", sk1.alpha, sk2.alpha)
-		return false
 	case sk1.p != sk2.p:
 		fmt.Printf("p mismatch: %d != %d", sk1.p, sk2.p)
 		return false
@@ -0,0 +1,282 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// HyperMinHash follows Yu and Weber, "HyperMinHash: MinHash in LogLog space"
+// (2017).
+
+const (
+	hyperMinHashVersion = 1
+	maxMantissaBits     = 10
+)
+
+// HyperMinHash is a HyperLogLog sketch whose registers also keep r mantissa
+// bits of the smallest hash they have seen. The extra bits turn every register
+// into a MinHash sample, so two sketches estimate their Jaccard index and
+// intersection while staying mergeable by union. Each register takes 2 bytes.
+//
+// The mantissa is taken from the low r bits of the hash, which InsertHash
+// does not otherwise use unless rho exceeds 64-p-r.
+//
+// Its zero value is empty and initializes on insertion or merge, like a
+// Sketch's: first used with Insert or InsertHash it takes precision 14 with 10
+// mantissa bits, first used with Merge it adopts the other sketch's
+// configuration.
+type HyperMinHash struct {
+	p uint8
+	r uint8
+	// Register i holds rho<<r | ^mantissa, so that the register of the
+	// smallest hash is the largest value and merging is a maximum. 0 is
+	// an empty register.
+	regs []uint16
+}
+
+// NewHyperMinHash returns a HyperMinHash sketch with 2^precision registers of
+// r mantissa bits each. The precision has to be >= 4 and <= 18, otherwise
+// ErrorInvalidPrecision is returned; r has to be >= 1 and <= 10, otherwise an
+// error wrapping ErrorInvalidParameter is returned.
+func NewHyperMinHash(precision, r uint8) (*HyperMinHash, error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	if err := checkMantissaBits(r); err != nil {
+		return nil, err
+	}
+	return &HyperMinHash{
+		p:    precision,
+		r:    r,
+		regs: make([]uint16, 1<<precision),
+	}, nil
+}
+
+func checkMantissaBits(r uint8) error {
+	if r < 1 || r > maxMantissaBits {
+		return fmt.Errorf("hyperloglog: %d mantissa bits outside [1, %d]: %w", r, maxMantissaBits, ErrorInvalidParameter)
+	}
+	return nil
+}
+
+// Clone returns a deep copy of h.
+func (h *HyperMinHash) Clone() *HyperMinHash {
+	clone := *h
+	clone.regs = slices.Clone(h.regs)
+	return &clone
+}
+
+// Insert hashes e with the package's MetroHash64 seed and adds it to h.
+func (h *HyperMinHash) Insert(e []byte) { h.InsertHash(hash(e)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to h.
+func (h *HyperMinHash) InsertHash(x uint64) {
+	if h.p == 0 {
+		*h = HyperMinHash{p: 14, r: maxMantissaBits, regs: make([]uint16, 1<<14)}
+	}
+	i, rho := getPosVal(x, h.p)
+	mask := uint16(1)<<h.r - 1
+	v := uint16(rho)<<h.r | ^uint16(x)&mask
+	h.regs[i] = max(h.regs[i], v)
+}
+
+func (h *HyperMinHash) rho(v uint16) uint8 { return uint8(v >> h.r) }
+
+// Merge adds other to h. Nil and zero-value sketches are treated as empty.
+// Both sketches must have the same precision and the same number of
+// mantissa bits, otherwise an error wrapping ErrorPrecisionMismatch is
+// returned.
+func (h *HyperMinHash) Merge(other *HyperMinHash) error {
+	if other == nil || other.p == 0 {
+		return nil
+	}
+	if h.p == 0 {
+		*h = *other.Clone()
+		return nil
+	}
+	if err := h.compatible(other); err != nil {
+		return err
+	}
+	for i, v := range other.regs {
+		h.regs[i] = max(h.regs[i], v)
+	}
+	return nil
+}
+
+func (h *HyperMinHash) compatible(other *HyperMinHash) error {
+	if h.p != other.p || h.r != other.r {
+		return fmt.Errorf("hyperloglog: cannot combine precision %d with %d mantissa bits and precision %d with %d mantissa bits: %w", h.p, h.r, other.p, other.r, ErrorPrecisionMismatch)
+	}
+	return nil
+}
+
+// Estimate returns the cardinality estimate.
+func (h *HyperMinHash) Estimate() uint64 {
+	if h.p == 0 {
+		return 0
+	}
+	var sum, ez float64
+	for _, v := range h.regs {
+		rho := h.rho(v)
+		if rho == 0 {
+			ez++
+		}
+		sum += 1.0 / math.Pow(2.0, float64(rho))
+	}
+	return estimateDense(h.p, sum, ez)
+}
+
+// Jaccard returns the estimated Jaccard index |A∩B| / |A∪B| of the elements
+// h and other have seen. Registers that agree exactly sample an element of
+// the intersection, except for the collisions two unrelated sets of the same
+// cardinalities would produce, which are subtracted. The estimate of two
+// empty sketches is 0.
+func (h *HyperMinHash) Jaccard(other *HyperMinHash) (float64, error) {
+	if h.p == 0 || other == nil || other.p == 0 {
+		return 0, nil
+	}
+	if err := h.compatible(other); err != nil {
+		return 0, err
+	}
+	var matches, nonEmpty float64
+	for i, v := range h.regs {
+		w := other.regs[i]
+		if v != 0 || w != 0 {
+			nonEmpty++
+			if v == w {
+				matches++
+			}
+		}
+	}
+	if nonEmpty == 0 {
+		return 0, nil
+	}
+	ec := h.expectedCollisions(float64(h.Estimate()), float64(other.Estimate()))
+	return max(0, (matches-ec)/nonEmpty), nil
+}
+
+// Intersection returns the estimated number of elements both h and other have
+// seen: the Jaccard index times the cardinality of the union.
+func (h *HyperMinHash) Intersection(other *HyperMinHash) (uint64, error) {
+	j, err := h.Jaccard(other)
+	if err != nil || j == 0 {
+		return 0, err
+	}
+	union := h.Clone()
+	if err := union.Merge(other); err != nil {
+		return 0, err
+	}
+	return uint64(j*float64(union.Estimate()) + 0.5), nil
+}
+
+// expectedCollisions returns the expected number of registers in which two
+// independent sets of cardinalities n and m hold the same non-empty value.
+//
+// Within a register, a hash is better than the cell (rho, j) with probability
+// P(rho' > rho) + P(rho' = rho)*j/2^r, and a register holds that cell when
+// none of its hashes is better but one lands in it.
+func (h *HyperMinHash) expectedCollisions(n, m float64) float64 {
+	if n == 0 || m == 0 {
+		return 0
+	}
+	regs := math.Ldexp(1, int(h.p))
+	cells := math.Ldexp(1, int(h.r))
+	// none returns the probability that none of k hashes falls below the
+	// fraction f of a register's probability mass.
+	none := func(f, k float64) float64 { return math.Exp(k * math.Log1p(-f/regs)) }
+
+	top := maxRho(h.p)
+	var sum float64
+	for rho := uint8(1); rho <= top; rho++ {
+		above := math.Ldexp(1, -int(rho))
+		here := above
+		if rho == top {
+			above, here = 0, 2*here
+		}
+		// Skip rows neither set is likely to reach.
+		rowN := none(above, n) - none(above+here, n)
+		rowM := none(above, m) - none(above+here, m)
+		if rowN*rowM < 1e-30 {
+			continue
+		}
+		step := here / cells
+		for j := range int(cells) {
+			lo := above + float64(j)*step
+			sum += (none(lo, n) - none(lo+step, n)) * (none(lo, m) - none(lo+step, m))
+		}
+	}
+	return sum * regs
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+//
+// An uninitialized (zero value) HyperMinHash has no encoding and returns an
+// error wrapping ErrorInvalidPrecision.
+func (h *HyperMinHash) MarshalBinary() ([]byte, error) {
+	return h.AppendBinary(nil)
+}
+
+// AppendBinary implements the encoding.BinaryAppender interface. See
+// UnmarshalBinary for the format.
+func (h *HyperMinHash) AppendBinary(data []byte) ([]byte, error) {
+	if err := checkPrecision(h.p); err != nil {
+		return data, fmt.Errorf("hyperloglog: precision %d: %w", h.p, err)
+	}
+	data = slices.Grow(data, 8+2*len(h.regs))
+	data = append(data, hyperMinHashVersion, h.p, h.r, 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(h.regs)))
+	for _, v := range h.regs {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+//
+// The format is a 4 byte header holding the version (1), the precision p, the
+// number of mantissa bits r and a reserved 0 byte, followed by the register
+// count, which must equal 2^p, as a big endian uint32 and that many big
+// endian uint16 registers. A register's rho, its bits above the low r, must
+// be at most 64-p+1, and a register whose rho is 0 must be 0. The buffer must
+// end after the last register.
+//
+// Errors wrap the package's exported sentinels and leave h unchanged.
+func (h *HyperMinHash) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("hyperloglog: hyperminhash header needs 8 bytes, have %d: %w", len(data), ErrorTooShort)
+	}
+	if data[0] != hyperMinHashVersion {
+		return fmt.Errorf("hyperloglog: hyperminhash version %d: %w", data[0], ErrorInvalidVersion)
+	}
+	p, r := data[1], data[2]
+	if err := checkPrecision(p); err != nil {
+		return fmt.Errorf("hyperloglog: precision %d: %w", p, err)
+	}
+	if err := checkMantissaBits(r); err != nil {
+		return err
+	}
+	if data[3] != 0 {
+		return fmt.Errorf("hyperloglog: hyperminhash header byte 3 = %d: %w", data[3], ErrorInvalidData)
+	}
+	m := uint32(1) << p
+	if sz := binary.BigEndian.Uint32(data[4:8]); sz != m {
+		return fmt.Errorf("hyperloglog: hyperminhash register count %d, want m = %d: %w", sz, m, ErrorInvalidData)
+	}
+	if err := exactLen("hyperminhash registers at offset 8", uint64(len(data)-8), 2*uint64(m)); err != nil {
+		return err
+	}
+
+	tmp, _ := NewHyperMinHash(p, r)
+	top := maxRho(p)
+	for i := range tmp.regs {
+		v := binary.BigEndian.Uint16(data[8+2*i:])
+		if rho := tmp.rho(v); rho > top || (rho == 0 && v != 0) {
+			return fmt.Errorf("hyperloglog: hyperminhash register %d = %#04x at offset %d: %w", i, v, 8+2*i, ErrorInvalidData)
+		}
+		tmp.regs[i] = v
+	}
+	*h = *tmp
+	return nil
+}
@@ -0,0 +1,144 @@
+package hyperloglog
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperMinHash_Error(t *testing.T) {
+	_, err := NewHyperMinHash(3, 10)
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	_, err = NewHyperMinHash(14, 11)
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+
+	a, _ := NewHyperMinHash(14, 10)
+	b, _ := NewHyperMinHash(14, 8)
+	b.InsertHash(1)
+	require.ErrorIs(t, a.Merge(b), ErrorPrecisionMismatch)
+	_, err = a.Jaccard(b)
+	require.ErrorIs(t, err, ErrorPrecisionMismatch)
+}
+
+func TestHyperMinHash_ZeroValue(t *testing.T) {
+	var h HyperMinHash
+	require.Zero(t, h.Estimate())
+	require.NoError(t, h.Merge(nil))
+	_, err := h.MarshalBinary()
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+
+	h.InsertHash(1)
+	require.EqualValues(t, 1, h.Estimate())
+	require.EqualValues(t, 14, h.p)
+
+	var dst HyperMinHash
+	src, _ := NewHyperMinHash(10, 4)
+	require.NoError(t, dst.Merge(src))
+	require.EqualValues(t, 10, dst.p)
+	require.EqualValues(t, 4, dst.r)
+}
+
+func TestHyperMinHash_Estimate(t *testing.T) {
+	h, _ := NewHyperMinHash(14, 10)
+	sk := NewNoSparse()
+	for i := 0; i < 1000000; i++ {
+		x := rand.Uint64()
+		h.InsertHash(x)
+		sk.InsertHash(x)
+	}
+	// The registers' rho agree with a Sketch's registers.
+	for i, v := range h.regs {
+		require.Equal(t, sk.regs[i], h.rho(v))
+	}
+	require.Equal(t, sk.Estimate(), h.Estimate())
+}
+
+func TestHyperMinHash_Jaccard(t *testing.T) {
+	for _, tt := range []struct {
+		na, nb, shared int
+	}{
+		{100000, 100000, 50000},
+		{100000, 100000, 0},
+		{1000000, 100000, 100000},
+		{1000, 1000, 500},
+	} {
+		a, _ := NewHyperMinHash(14, 10)
+		b, _ := NewHyperMinHash(14, 10)
+		for i := 0; i < tt.shared; i++ {
+			x := rand.Uint64()
+			a.InsertHash(x)
+			b.InsertHash(x)
+		}
+		for i := tt.shared; i < tt.na; i++ {
+			a.InsertHash(rand.Uint64())
+		}
+		for i := tt.shared; i < tt.nb; i++ {
+			b.InsertHash(rand.Uint64())
+		}
+
+		union := float64(tt.na + tt.nb - tt.shared)
+		want := float64(tt.shared) / union
+		j, err := a.Jaccard(b)
+		require.NoError(t, err)
+		require.InDelta(t, want, j, 0.02, "%+v", tt)
+
+		inter, err := a.Intersection(b)
+		require.NoError(t, err)
+		require.InDelta(t, float64(tt.shared), float64(inter), 0.02*union, "%+v", tt)
+
+		self, err := a.Jaccard(a)
+		require.NoError(t, err)
+		require.InDelta(t, 1, self, 0.01)
+	}
+}
+
+func TestHyperMinHash_ExpectedCollisions(t *testing.T) {
+	h, _ := NewHyperMinHash(8, 4)
+	// Two disjoint sets collide by chance only; the expectation has to
+	// match what is observed on average.
+	var observed float64
+	const runs = 200
+	for range runs {
+		a, _ := NewHyperMinHash(8, 4)
+		b, _ := NewHyperMinHash(8, 4)
+		for i := 0; i < 2000; i++ {
+			a.InsertHash(rand.Uint64())
+			b.InsertHash(rand.Uint64())
+		}
+		for i, v := range a.regs {
+			if v != 0 && v == b.regs[i] {
+				observed++
+			}
+		}
+	}
+	want := h.expectedCollisions(2000, 2000)
+	require.InDelta(t, want, observed/runs, math.Max(1, 0.1*want))
+}
+
+func TestHyperMinHash_Marshal_Unmarshal(t *testing.T) {
+	h, _ := NewHyperMinHash(10, 6)
+	for i := 0; i < 10000; i++ {
+		h.InsertHash(rand.Uint64())
+	}
+	data, err := h.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, data, 8+2*1024)
+
+	var res HyperMinHash
+	require.NoError(t, res.UnmarshalBinary(data))
+	require.Equal(t, h.regs, res.regs)
+	require.Equal(t, h.Estimate(), res.Estimate())
+
+	require.ErrorIs(t, res.UnmarshalBinary(data[:len(data)-1]), ErrorTooShort)
+	require.ErrorIs(t, res.UnmarshalBinary(append(data, 0)), ErrorInvalidData)
+	bad := append([]byte(nil), data...)
+	bad[8], bad[9] = 0x00, 0x01 // rho 0 with a mantissa.
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidData)
+	bad[8], bad[9] = 0xff, 0xff // rho beyond 64-p+1.
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidData)
+	bad[2] = 0
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidParameter)
+	require.Equal(t, h.regs, res.regs)
+}
@@ -0,0 +1,106 @@
+package hyperloglog
+
+import "math"
+
+// Bounded is an estimate together with its standard error.
+type Bounded struct {
+	Estimate float64
+	StdErr   float64
+}
+
+// Bounds returns the interval of numStdDev standard errors around the
+// estimate. Cardinalities are never negative, so the lower bound is clamped
+// at 0.
+func (b Bounded) Bounds(numStdDev float64) (lower, upper float64) {
+	return max(0, b.Estimate-numStdDev*b.StdErr), b.Estimate + numStdDev*b.StdErr
+}
+
+// JointEstimate holds the estimated cardinalities of two sets A and B, and of
+// the regions of their Venn diagram. The regions are estimated together, so
+// they are consistent with each other: Intersection+AnotB equals A,
+// Intersection+BnotA equals B, and none of them is negative.
+type JointEstimate struct {
+	A, B         Bounded
+	Union        Bounded
+	Intersection Bounded
+	AnotB, BnotA Bounded
+}
+
+// Jaccard returns the estimated Jaccard index |A∩B| / |A∪B|, or 0 when both
+// sets are empty.
+func (j JointEstimate) Jaccard() float64 {
+	if j.Union.Estimate == 0 {
+		return 0
+	}
+	return j.Intersection.Estimate / j.Union.Estimate
+}
+
+// jointFromIntersection completes a joint estimate from the cardinalities of A
+// and B, the fitted intersection x and its standard error, and the relative
+// standard error of a cardinality estimate.
+func jointFromIntersection(na, nb, x, fitErr, rel float64) JointEstimate {
+	u := na + nb - x
+	regionErr := math.Hypot(fitErr, rel*x)
+	return JointEstimate{
+		A:            Bounded{na, rel * na},
+		B:            Bounded{nb, rel * nb},
+		Union:        Bounded{u, math.Hypot(fitErr, rel*u)},
+		Intersection: Bounded{x, regionErr},
+		AnotB:        Bounded{na - x, math.Hypot(fitErr, rel*(na-x))},
+		BnotA:        Bounded{nb - x, math.Hypot(fitErr, rel*(nb-x))},
+	}
+}
+
+// maximizeIntersection returns the intersection size in [0, min(na, nb)] that
+// maximizes the log-likelihood ll, found by golden-section search, together
+// with its standard error from the curvature of ll at the maximum.
+func maximizeIntersection(na, nb float64, ll func(x float64) float64) (x, stdErr float64) {
+	hi := min(na, nb)
+	if hi <= 0 {
+		return 0, 0
+	}
+	const invPhi = 0.6180339887498949
+	a, b := 0.0, hi
+	c, d := b-invPhi*(b-a), a+invPhi*(b-a)
+	fc, fd := ll(c), ll(d)
+	for range 200 {
+		if b-a <= 1e-9*hi {
+			break
+		}
+		if fc >= fd {
+			b, d, fd = d, c, fc
+			c = b - invPhi*(b-a)
+			fc = ll(c)
+		} else {
+			a, c, fc = c, d, fd
+			d = a + invPhi*(b-a)
+			fd = ll(d)
+		}
+	}
+	x = (a + b) / 2
+	for _, end := range []float64{0, hi} {
+		if ll(end) > ll(x) {
+			x = end
+		}
+	}
+
+	// The observed Fisher information is the negated second derivative.
+	h := 1e-3 * max(hi, 1)
+	lo, up := max(0, x-h), min(hi, x+h)
+	mid := (lo + up) / 2
+	d2 := (ll(up) - 2*ll(mid) + ll(lo)) / ((up - mid) * (mid - lo))
+	if d2 < 0 && !math.IsInf(d2, 0) {
+		stdErr = math.Sqrt(-1 / d2)
+	} else {
+		stdErr = hi
+	}
+	return x, stdErr
+}
+
+// xlogy returns x*log(y), taking 0*log(0) to be 0.
+func xlogy(x, y float64) float64 {
+	if x == 0 {
+		return 0
+	}
+	return x * math.Log(y)
+}
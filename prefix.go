@@ -0,0 +1,377 @@
+package hyperloglog
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var (
+	defaultIPv4Levels = []int{8, 16, 24}
+	defaultIPv6Levels = []int{16, 32, 48, 64}
+	// ipv4Mapped is the first IPv4-mapped IPv6 address, ::ffff:0.0.0.0.
+	ipv4Mapped = netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff})
+)
+
+// prefixNode is a node of a prefix tree: a Sketch of everything inserted
+// under the node's prefix, and the nodes of the next level.
+type prefixNode[K comparable] struct {
+	sk       *Sketch
+	children map[K]*prefixNode[K]
+}
+
+func newPrefixNode[K comparable](p uint8) *prefixNode[K] {
+	return &prefixNode[K]{sk: newSketchNoError(p, true)}
+}
+
+// child returns the child of n under key, creating it if needed.
+func (n *prefixNode[K]) child(key K, p uint8) *prefixNode[K] {
+	c, ok := n.children[key]
+	if !ok {
+		if n.children == nil {
+			n.children = make(map[K]*prefixNode[K])
+		}
+		c = newPrefixNode[K](p)
+		n.children[key] = c
+	}
+	return c
+}
+
+// merge adds other's tree to n's. Both trees have the same precision.
+func (n *prefixNode[K]) merge(other *prefixNode[K], p uint8) {
+	_ = n.sk.Merge(other.sk)
+	for key, oc := range other.children {
+		n.child(key, p).merge(oc, p)
+	}
+}
+
+// expand calls fn, in key order, for every child of n whose estimate exceeds
+// threshold, with the keys from the root down to the child, and expands
+// those children in turn.
+func (n *prefixNode[K]) expand(threshold uint64, compare func(a, b K) int, path []K, fn func(path []K, est uint64)) {
+	keys := make([]K, 0, len(n.children))
+	for key := range n.children {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, compare)
+	for _, key := range keys {
+		c := n.children[key]
+		if est := c.sk.Estimate(); est > threshold {
+			fn(append(path, key), est)
+			c.expand(threshold, compare, append(path, key), fn)
+		}
+	}
+}
+
+// IPPrefixSketch counts distinct values under IP prefixes, such as the
+// distinct clients of every /8, /16 and /24. It keeps a prefix tree with a
+// sparse Sketch at each configured prefix length, so the count of a prefix
+// at a configured length is a single estimate, and the count of a prefix
+// between two lengths is the union of the sketches of the longer length it
+// contains. IPv4-mapped IPv6 addresses count as IPv4 addresses, so an IPv6
+// prefix that contains all of them, such as ::/0, also counts every IPv4
+// address.
+//
+// Use NewIPPrefixSketch to create one; the zero value is not usable.
+type IPPrefixSketch struct {
+	p            uint8
+	levels4      []int
+	levels6      []int
+	root4, root6 *prefixNode[netip.Prefix]
+}
+
+// PrefixEstimate is a prefix with its cardinality estimate.
+type PrefixEstimate struct {
+	Prefix   netip.Prefix
+	Estimate uint64
+}
+
+// NewIPPrefixSketch returns an empty IPPrefixSketch whose sketches have
+// 2^precision registers, and that keeps them at the prefix lengths in
+// v4Levels and v6Levels. Nil levels take the defaults of /8, /16 and /24 for
+// IPv4 and /16, /32, /48 and /64 for IPv6.
+//
+// The precision has to be >= 4 and <= 18, otherwise ErrorInvalidPrecision is
+// returned. Levels that do not strictly increase within (0, 32] for IPv4 or
+// (0, 128] for IPv6 return an error wrapping ErrorInvalidParameter.
+func NewIPPrefixSketch(precision uint8, v4Levels, v6Levels []int) (*IPPrefixSketch, error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	if v4Levels == nil {
+		v4Levels = defaultIPv4Levels
+	}
+	if v6Levels == nil {
+		v6Levels = defaultIPv6Levels
+	}
+	if err := checkPrefixLevels(v4Levels, 32); err != nil {
+		return nil, err
+	}
+	if err := checkPrefixLevels(v6Levels, 128); err != nil {
+		return nil, err
+	}
+	return &IPPrefixSketch{
+		p:       precision,
+		levels4: slices.Clone(v4Levels),
+		levels6: slices.Clone(v6Levels),
+		root4:   newPrefixNode[netip.Prefix](precision),
+		root6:   newPrefixNode[netip.Prefix](precision),
+	}, nil
+}
+
+func checkPrefixLevels(levels []int, bits int) error {
+	for i, l := range levels {
+		if l <= 0 || l > bits || (i > 0 && l <= levels[i-1]) {
+			return fmt.Errorf("hyperloglog: prefix levels %v do not increase within (0, %d]: %w", levels, bits, ErrorInvalidParameter)
+		}
+	}
+	return nil
+}
+
+// family returns the levels and the root of addr's family.
+func (s *IPPrefixSketch) family(addr netip.Addr) ([]int, *prefixNode[netip.Prefix]) {
+	if addr.Is4() {
+		return s.levels4, s.root4
+	}
+	return s.levels6, s.root6
+}
+
+// InsertAddr adds the address itself, hashed with the package's MetroHash64
+// seed, to the counts of its prefixes. Invalid addresses are ignored.
+func (s *IPPrefixSketch) InsertAddr(addr netip.Addr) {
+	addr = addr.Unmap()
+	b, _ := addr.MarshalBinary()
+	s.InsertHash(addr, hash(b))
+}
+
+// Insert hashes value with the package's MetroHash64 seed and adds it to the
+// counts of addr's prefixes. Invalid addresses are ignored.
+func (s *IPPrefixSketch) Insert(addr netip.Addr, value []byte) { s.InsertHash(addr, hash(value)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to the counts of addr's
+// prefixes. Invalid addresses are ignored.
+func (s *IPPrefixSketch) InsertHash(addr netip.Addr, x uint64) {
+	if !addr.IsValid() {
+		return
+	}
+	addr = addr.Unmap()
+	levels, n := s.family(addr)
+	n.sk.InsertHash(x)
+	for _, l := range levels {
+		pfx, _ := addr.Prefix(l)
+		n = n.child(pfx, s.p)
+		n.sk.InsertHash(x)
+	}
+}
+
+// SketchPrefix returns a Sketch of the values inserted under pfx, independent
+// of s. A prefix longer than the longest level of its family returns an error
+// wrapping ErrorInvalidParameter; an invalid prefix returns an empty Sketch.
+func (s *IPPrefixSketch) SketchPrefix(pfx netip.Prefix) (*Sketch, error) {
+	res := newSketchNoError(s.p, true)
+	if !pfx.IsValid() {
+		return res, nil
+	}
+	if pfx.Addr().Is4In6() && pfx.Bits() >= 96 {
+		pfx = netip.PrefixFrom(pfx.Addr().Unmap(), pfx.Bits()-96)
+	}
+	pfx = pfx.Masked()
+	levels, n := s.family(pfx.Addr())
+	if deepest := levels[len(levels)-1]; pfx.Bits() > deepest {
+		return nil, fmt.Errorf("hyperloglog: prefix %v is longer than the deepest level /%d: %w", pfx, deepest, ErrorInvalidParameter)
+	}
+	if pfx.Addr().Is6() && pfx.Contains(ipv4Mapped) {
+		// A shorter prefix than /96 holds every IPv4-mapped address, and
+		// those are stored unmapped.
+		_ = res.Merge(s.root4.sk)
+	}
+	for _, l := range levels {
+		if pfx.Bits() == 0 {
+			break
+		}
+		if pfx.Bits() >= l {
+			key, _ := pfx.Addr().Prefix(l)
+			if n = n.children[key]; n == nil {
+				return res, nil
+			}
+			if pfx.Bits() == l {
+				break
+			}
+			continue
+		}
+		// pfx lies between two levels: union the nodes it contains.
+		for key, c := range n.children {
+			if pfx.Contains(key.Addr()) {
+				_ = res.Merge(c.sk)
+			}
+		}
+		return res, nil
+	}
+	_ = res.Merge(n.sk)
+	return res, nil
+}
+
+// EstimatePrefix returns the cardinality estimate of the values inserted
+// under pfx. See SketchPrefix for the prefixes it accepts.
+func (s *IPPrefixSketch) EstimatePrefix(pfx netip.Prefix) (uint64, error) {
+	sk, err := s.SketchPrefix(pfx)
+	if err != nil {
+		return 0, err
+	}
+	return sk.Estimate(), nil
+}
+
+// Expand returns the prefixes at the configured levels whose estimate exceeds
+// threshold, expanding only those: a prefix is listed when it and all its
+// ancestors exceed threshold. IPv4 prefixes come first, each followed by its
+// expanded descendants, in address order.
+func (s *IPPrefixSketch) Expand(threshold uint64) []PrefixEstimate {
+	var res []PrefixEstimate
+	add := func(path []netip.Prefix, est uint64) {
+		res = append(res, PrefixEstimate{Prefix: path[len(path)-1], Estimate: est})
+	}
+	compare := func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+	}
+	s.root4.expand(threshold, compare, nil, add)
+	s.root6.expand(threshold, compare, nil, add)
+	return res
+}
+
+// Merge adds other to s. Both must have the same precision, otherwise an
+// error wrapping ErrorPrecisionMismatch is returned, and the same levels,
+// otherwise an error wrapping ErrorInvalidParameter is returned.
+func (s *IPPrefixSketch) Merge(other *IPPrefixSketch) error {
+	if other == nil {
+		return nil
+	}
+	if s.p != other.p {
+		return fmt.Errorf("hyperloglog: cannot merge prefix sketches of precision %d and %d: %w", s.p, other.p, ErrorPrecisionMismatch)
+	}
+	if !slices.Equal(s.levels4, other.levels4) || !slices.Equal(s.levels6, other.levels6) {
+		return fmt.Errorf("hyperloglog: cannot merge prefix levels %v/%v with %v/%v: %w", s.levels4, s.levels6, other.levels4, other.levels6, ErrorInvalidParameter)
+	}
+	s.root4.merge(other.root4, s.p)
+	s.root6.merge(other.root6, s.p)
+	return nil
+}
+
+// PathPrefixSketch counts distinct values under URL path prefixes, such as
+// the distinct clients of /api, /api/v1 and /api/v1/users. It keeps a prefix
+// tree with a sparse Sketch for every path prefix, one level per path
+// segment, down to a maximum depth.
+//
+// Use NewPathPrefixSketch to create one; the zero value is not usable.
+type PathPrefixSketch struct {
+	p        uint8
+	maxDepth int
+	root     *prefixNode[string]
+}
+
+// PathEstimate is a path prefix with its cardinality estimate.
+type PathEstimate struct {
+	Path     string
+	Estimate uint64
+}
+
+// NewPathPrefixSketch returns an empty PathPrefixSketch whose sketches have
+// 2^precision registers, and that keeps them for path prefixes of up to
+// maxDepth segments. The precision has to be >= 4 and <= 18, otherwise
+// ErrorInvalidPrecision is returned; a maxDepth that is not positive returns
+// an error wrapping ErrorInvalidParameter.
+func NewPathPrefixSketch(precision uint8, maxDepth int) (*PathPrefixSketch, error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	if maxDepth <= 0 {
+		return nil, fmt.Errorf("hyperloglog: path depth %d is not positive: %w", maxDepth, ErrorInvalidParameter)
+	}
+	return &PathPrefixSketch{
+		p:        precision,
+		maxDepth: maxDepth,
+		root:     newPrefixNode[string](precision),
+	}, nil
+}
+
+// pathSegments splits path on "/", dropping empty segments, so that "/a//b/"
+// and "a/b" are the same path.
+func pathSegments(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// Insert hashes value with the package's MetroHash64 seed and adds it to the
+// counts of path and its prefixes, up to the maximum depth.
+func (s *PathPrefixSketch) Insert(path string, value []byte) { s.InsertHash(path, hash(value)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to the counts of path
+// and its prefixes, up to the maximum depth.
+func (s *PathPrefixSketch) InsertHash(path string, x uint64) {
+	n := s.root
+	n.sk.InsertHash(x)
+	segs := pathSegments(path)
+	for _, seg := range segs[:min(len(segs), s.maxDepth)] {
+		n = n.child(seg, s.p)
+		n.sk.InsertHash(x)
+	}
+}
+
+// SketchPrefix returns a Sketch of the values inserted under the path prefix,
+// independent of s. "/" is the prefix of every path. A prefix with more
+// segments than the maximum depth returns an error wrapping
+// ErrorInvalidParameter.
+func (s *PathPrefixSketch) SketchPrefix(prefix string) (*Sketch, error) {
+	segs := pathSegments(prefix)
+	if len(segs) > s.maxDepth {
+		return nil, fmt.Errorf("hyperloglog: path %q is deeper than %d segments: %w", prefix, s.maxDepth, ErrorInvalidParameter)
+	}
+	res := newSketchNoError(s.p, true)
+	n := s.root
+	for _, seg := range segs {
+		if n = n.children[seg]; n == nil {
+			return res, nil
+		}
+	}
+	_ = res.Merge(n.sk)
+	return res, nil
+}
+
+// EstimatePrefix returns the cardinality estimate of the values inserted
+// under the path prefix. See SketchPrefix for the prefixes it accepts.
+func (s *PathPrefixSketch) EstimatePrefix(prefix string) (uint64, error) {
+	sk, err := s.SketchPrefix(prefix)
+	if err != nil {
+		return 0, err
+	}
+	return sk.Estimate(), nil
+}
+
+// Expand returns the path prefixes whose estimate exceeds threshold,
+// expanding only those: a prefix is listed when it and all its ancestors
+// exceed threshold. Each prefix is followed by its expanded descendants, in
+// lexical order of their segments. Paths are returned with a leading "/".
+func (s *PathPrefixSketch) Expand(threshold uint64) []PathEstimate {
+	var res []PathEstimate
+	s.root.expand(threshold, strings.Compare, nil, func(segs []string, est uint64) {
+		res = append(res, PathEstimate{Path: "/" + strings.Join(segs, "/"), Estimate: est})
+	})
+	return res
+}
+
+// Merge adds other to s. Both must have the same precision, otherwise an
+// error wrapping ErrorPrecisionMismatch is returned, and the same maximum
+// depth, otherwise an error wrapping ErrorInvalidParameter is returned.
+func (s *PathPrefixSketch) Merge(other *PathPrefixSketch) error {
+	if other == nil {
+		return nil
+	}
+	if s.p != other.p {
+		return fmt.Errorf("hyperloglog: cannot merge prefix sketches of precision %d and %d: %w", s.p, other.p, ErrorPrecisionMismatch)
+	}
+	if s.maxDepth != other.maxDepth {
+		return fmt.Errorf("hyperloglog: cannot merge path depth %d with %d: %w", s.maxDepth, other.maxDepth, ErrorInvalidParameter)
+	}
+	s.root.merge(other.root, s.p)
+	return nil
+}
@@ -0,0 +1,207 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPPrefixSketch_Error(t *testing.T) {
+	_, err := NewIPPrefixSketch(3, nil, nil)
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	for _, levels := range [][2][]int{
+		{{8, 8}, nil},
+		{{0, 8}, nil},
+		{{33}, nil},
+		{nil, {129}},
+		{nil, {64, 32}},
+	} {
+		_, err := NewIPPrefixSketch(12, levels[0], levels[1])
+		require.ErrorIs(t, err, ErrorInvalidParameter, "%v", levels)
+	}
+
+	s, _ := NewIPPrefixSketch(12, nil, nil)
+	_, err = s.EstimatePrefix(netip.MustParsePrefix("10.1.2.0/25"))
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+	_, err = s.EstimatePrefix(netip.MustParsePrefix("2001:db8::/65"))
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+
+	other, _ := NewIPPrefixSketch(13, nil, nil)
+	require.ErrorIs(t, s.Merge(other), ErrorPrecisionMismatch)
+	other, _ = NewIPPrefixSketch(12, []int{8}, nil)
+	require.ErrorIs(t, s.Merge(other), ErrorInvalidParameter)
+}
+
+func randAddr4(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().As4()
+	x := rand.Uint32()
+	for i := prefix.Bits(); i < 32; i++ {
+		if x&(1<<i) != 0 {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return netip.AddrFrom4(b)
+}
+
+func TestIPPrefixSketch_EstimatePrefix(t *testing.T) {
+	s, err := NewIPPrefixSketch(14, nil, nil)
+	require.NoError(t, err)
+
+	counts := map[string]int{
+		"10.1.0.0/16":    20000,
+		"10.2.3.0/24":    200,
+		"192.168.0.0/16": 5000,
+	}
+	for pfx, n := range counts {
+		p := netip.MustParsePrefix(pfx)
+		seen := make(map[netip.Addr]bool)
+		for len(seen) < n {
+			// Each client appears twice, once IPv4-mapped.
+			addr := randAddr4(p)
+			seen[addr] = true
+			s.InsertAddr(addr)
+			s.InsertAddr(netip.AddrFrom16(addr.As16()))
+		}
+	}
+	v6 := netip.MustParseAddr("2001:db8::1")
+	for i := 0; i < 1000; i++ {
+		s.InsertHash(v6, rand.Uint64())
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		want   int
+	}{
+		{"0.0.0.0/0", 25200},
+		{"10.0.0.0/8", 20200},
+		{"10.0.0.0/14", 20200}, // between levels
+		{"10.1.0.0/16", 20000},
+		{"10.1.0.0/17", 10000},
+		{"10.2.3.0/24", 200},
+		{"10.3.0.0/16", 0},
+		{"192.160.0.0/12", 5000}, // between levels
+		{"::ffff:10.0.0.0/104", 20200},
+		{"2001:db8::/32", 1000},
+		{"2001:db8::/64", 1000},
+		{"::/0", 26200}, // holds the IPv4-mapped addresses
+		{"::/16", 25200},
+	} {
+		got, err := s.EstimatePrefix(netip.MustParsePrefix(tt.prefix))
+		require.NoError(t, err, tt.prefix)
+		require.InDelta(t, tt.want, got, 0.03*float64(tt.want)+3, tt.prefix)
+	}
+
+	// A prefix at a level is the sketch of its node, not the union of its
+	// children.
+	n := s.root4.children[netip.MustParsePrefix("10.0.0.0/8")].children[netip.MustParsePrefix("10.1.0.0/16")]
+	n.children = nil
+	got, err := s.EstimatePrefix(netip.MustParsePrefix("10.1.0.0/16"))
+	require.NoError(t, err)
+	require.Equal(t, n.sk.Estimate(), got)
+
+	s, err = NewIPPrefixSketch(14, nil, []int{32, 96})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		s.InsertHash(netip.AddrFrom16(randAddr4(netip.MustParsePrefix("10.0.0.0/8")).As16()), rand.Uint64())
+	}
+	got, err = s.EstimatePrefix(netip.MustParsePrefix("::ffff:0:0/95"))
+	require.NoError(t, err)
+	require.InDelta(t, 1000, got, 30)
+}
+
+func TestIPPrefixSketch_Expand(t *testing.T) {
+	s, _ := NewIPPrefixSketch(12, nil, nil)
+	for i := 0; i < 3000; i++ {
+		s.InsertHash(randAddr4(netip.MustParsePrefix("10.1.2.0/24")), rand.Uint64())
+		s.InsertHash(randAddr4(netip.MustParsePrefix("10.1.0.0/16")), rand.Uint64())
+		s.InsertHash(randAddr4(netip.MustParsePrefix("172.16.0.0/12")), rand.Uint64())
+	}
+	for i := 0; i < 50; i++ {
+		s.InsertHash(randAddr4(netip.MustParsePrefix("8.8.8.0/24")), rand.Uint64())
+	}
+
+	var got []string
+	for _, e := range s.Expand(1000) {
+		got = append(got, e.Prefix.String())
+	}
+	// 172.16.0.0/12 spreads over 16 /16s, none of which exceeds 1000.
+	require.Equal(t, []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "172.0.0.0/8"}, got)
+	require.Empty(t, s.Expand(1e9))
+}
+
+func TestIPPrefixSketch_Merge(t *testing.T) {
+	a, _ := NewIPPrefixSketch(12, nil, nil)
+	b, _ := NewIPPrefixSketch(12, nil, nil)
+	all, _ := NewIPPrefixSketch(12, nil, nil)
+	for i := 0; i < 10000; i++ {
+		addr := randAddr4(netip.MustParsePrefix("10.0.0.0/12"))
+		if i%2 == 0 {
+			a.InsertAddr(addr)
+		} else {
+			b.InsertAddr(addr)
+		}
+		all.InsertAddr(addr)
+	}
+	require.NoError(t, a.Merge(b))
+	for _, pfx := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.3.0.0/16", "10.3.7.0/24"} {
+		want, _ := all.EstimatePrefix(netip.MustParsePrefix(pfx))
+		got, _ := a.EstimatePrefix(netip.MustParsePrefix(pfx))
+		require.Equal(t, want, got, pfx)
+	}
+	require.Equal(t, all.Expand(100), a.Expand(100))
+}
+
+func TestPathPrefixSketch(t *testing.T) {
+	_, err := NewPathPrefixSketch(3, 4)
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	_, err = NewPathPrefixSketch(12, 0)
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+
+	s, err := NewPathPrefixSketch(12, 3)
+	require.NoError(t, err)
+	for i := 0; i < 2000; i++ {
+		s.InsertHash("/api/v1/users/"+string(rune('a'+i%26)), rand.Uint64())
+		if i%4 == 0 {
+			s.InsertHash("/api/v2//orders/", rand.Uint64())
+		}
+		if i%10 == 0 {
+			s.InsertHash("static/app.js", rand.Uint64())
+		}
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		want   int
+	}{
+		{"/", 2700},
+		{"", 2700},
+		{"/api", 2500},
+		{"/api/v1", 2000},
+		{"api/v1/users/", 2000},
+		{"/api/v2/orders", 500},
+		{"/static", 200},
+		{"/nothing/here", 0},
+	} {
+		got, err := s.EstimatePrefix(tt.prefix)
+		require.NoError(t, err, tt.prefix)
+		require.InDelta(t, tt.want, got, 0.03*float64(tt.want), tt.prefix)
+	}
+	_, err = s.EstimatePrefix("/api/v1/users/a")
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+
+	var got []string
+	for _, e := range s.Expand(300) {
+		got = append(got, e.Path)
+	}
+	require.Equal(t, []string{"/api", "/api/v1", "/api/v1/users", "/api/v2", "/api/v2/orders"}, got)
+
+	other, _ := NewPathPrefixSketch(12, 3)
+	other.InsertHash("/static/app.css", rand.Uint64())
+	require.NoError(t, s.Merge(other))
+	got2, _ := s.EstimatePrefix("/static")
+	require.InDelta(t, 201, got2, 6)
+	deeper, _ := NewPathPrefixSketch(12, 4)
+	require.ErrorIs(t, s.Merge(deeper), ErrorInvalidParameter)
+}
@@ -0,0 +1,302 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// Field numbers and enum values of the Sketch message in hyperloglog.proto.
+const (
+	protoFormatVersion  = 1
+	protoHash           = 2
+	protoPrecision      = 3
+	protoRepresentation = 4
+	protoSparseKeys     = 5
+	protoRegisters      = 6
+
+	protoHashMetroHash64Seed1337 = 1
+	protoHashRedisMurmurHash64A  = 2
+	protoRepresentationSparse    = 1
+	protoRepresentationDense     = 2
+)
+
+// protoHashes maps each HashFunc to its Hash enum value in hyperloglog.proto.
+var protoHashes = [...]uint64{
+	HashMetro: protoHashMetroHash64Seed1337,
+	HashRedis: protoHashRedisMurmurHash64A,
+}
+
+// Protocol Buffers wire types.
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+// MarshalProto returns sk as a Sketch message of hyperloglog.proto in the
+// Protocol Buffers wire format. See AppendProto.
+func (sk *Sketch) MarshalProto() ([]byte, error) {
+	return sk.AppendProto(nil)
+}
+
+// AppendProto appends sk as a Sketch message of hyperloglog.proto, in the
+// Protocol Buffers wire format, to data. The message holds the same values as
+// the canonical encoding (see AppendCanonical): sparse keys are sorted and
+// deduplicated, and the message is the same for sketches holding the same
+// values. Fields are written in field number order, with sparse_keys packed.
+//
+// The hash field holds sk's hash function. A zero-value Sketch returns an
+// error wrapping ErrorInvalidPrecision and leaves data unmodified.
+func (sk *Sketch) AppendProto(data []byte) ([]byte, error) {
+	if err := checkPrecision(sk.p); err != nil {
+		return data, fmt.Errorf("hyperloglog: precision %d: %w", sk.p, err)
+	}
+	c := sk.canonical()
+	data = appendProtoVarint(data, protoFormatVersion, version)
+	data = appendProtoVarint(data, protoHash, protoHashes[c.hashFunc])
+	data = appendProtoVarint(data, protoPrecision, uint64(c.p))
+	if !c.sparse() {
+		data = appendProtoVarint(data, protoRepresentation, protoRepresentationDense)
+		data = appendProtoBytes(data, protoRegisters, c.regs)
+		return data, nil
+	}
+
+	data = appendProtoVarint(data, protoRepresentation, protoRepresentationSparse)
+	if c.sparseList.count == 0 {
+		return data, nil
+	}
+	// The keys are sized in a first pass, so that they are appended in place
+	// after their length.
+	var size uint64
+	for iter := c.sparseList.Iter(); iter.HasNext(); {
+		size += uvarintLen(uint64(iter.Next()))
+	}
+	data = binary.AppendUvarint(data, protoSparseKeys<<3|protoWireBytes)
+	data = binary.AppendUvarint(data, size)
+	for iter := c.sparseList.Iter(); iter.HasNext(); {
+		data = binary.AppendUvarint(data, uint64(iter.Next()))
+	}
+	return data, nil
+}
+
+func appendProtoVarint(data []byte, field, x uint64) []byte {
+	data = binary.AppendUvarint(data, field<<3|protoWireVarint)
+	return binary.AppendUvarint(data, x)
+}
+
+func appendProtoBytes(data []byte, field uint64, b []byte) []byte {
+	data = binary.AppendUvarint(data, field<<3|protoWireBytes)
+	data = binary.AppendUvarint(data, uint64(len(b)))
+	return append(data, b...)
+}
+
+func uvarintLen(x uint64) uint64 { return uint64(bits.Len64(x|1)+6) / 7 }
+
+// protoKeys is a sparse_keys field at offset off: packed uvarints, or a single
+// unpacked key.
+type protoKeys struct {
+	off      int
+	packed   []byte
+	key      uint64
+	unpacked bool
+}
+
+// UnmarshalProto reads a Sketch message of hyperloglog.proto in the Protocol
+// Buffers wire format into sk, with the same guarantees as UnmarshalBinary:
+// every rule stated in hyperloglog.proto is checked, errors are a *DecodeError
+// wrapping the same sentinels, and sk is left unchanged on error.
+//
+// As the wire format requires, fields may come in any order, a non-repeated
+// scalar field that appears more than once keeps its last value, and fields of
+// unknown numbers are skipped. A
+// message that ends inside a field returns ErrorTooShort. A format_version
+// other than 2 returns ErrorInvalidVersion, a precision out of range
+// ErrorInvalidPrecision, and anything else that breaks the schema, such as a
+// hash this package does not know, sparse keys that do not strictly increase
+// or registers of a sparse sketch, ErrorInvalidData. sk takes the message's
+// hash function.
+func (sk *Sketch) UnmarshalProto(data []byte) error {
+	var (
+		formatVersion, hash, precision, representation uint64
+		keys                                           []protoKeys
+		registers                                      []byte
+		registersOff                                   int
+		// offs holds the offset of the last field of each number, or -1.
+		offs = [protoRegisters + 1]int{-1, -1, -1, -1, -1, -1, -1}
+	)
+	for off := 0; off < len(data); {
+		tag, n := binary.Uvarint(data[off:])
+		if err := protoUvarintError(off, "field tag", n); err != nil {
+			return err
+		}
+		fieldOff := off
+		off += n
+		field, wire := tag>>3, tag&7
+		if field == 0 || field > 1<<29-1 {
+			return decodeError(fieldOff, "field tag", ErrorInvalidData, "field number %d", field)
+		}
+
+		var x uint64
+		var b []byte
+		switch wire {
+		case protoWireVarint:
+			x, n = binary.Uvarint(data[off:])
+			if err := protoUvarintError(off, "varint", n); err != nil {
+				return err
+			}
+			off += n
+		case protoWireFixed64, protoWireFixed32:
+			size := 8
+			if wire == protoWireFixed32 {
+				size = 4
+			}
+			if len(data)-off < size {
+				return decodeError(off, "fixed field", ErrorTooShort, "need %d bytes, have %d", size, len(data)-off)
+			}
+			off += size
+		case protoWireBytes:
+			size, n := binary.Uvarint(data[off:])
+			if err := protoUvarintError(off, "length", n); err != nil {
+				return err
+			}
+			off += n
+			if size > uint64(len(data)-off) {
+				return decodeError(off, "length delimited field", ErrorTooShort, "need %d bytes, have %d", size, len(data)-off)
+			}
+			b = data[off : off+int(size)]
+			off += int(size)
+		default:
+			return decodeError(fieldOff, "field tag", ErrorInvalidData, "wire type %d of field %d", wire, field)
+		}
+
+		want := uint64(protoWireVarint)
+		switch field {
+		case protoFormatVersion:
+			formatVersion = x
+		case protoHash:
+			hash = x
+		case protoPrecision:
+			precision = x
+		case protoRepresentation:
+			representation = x
+		case protoSparseKeys:
+			if wire == protoWireBytes {
+				want = protoWireBytes
+				keys = append(keys, protoKeys{off: off - len(b), packed: b})
+			} else {
+				keys = append(keys, protoKeys{off: fieldOff, key: x, unpacked: true})
+			}
+		case protoRegisters:
+			want = protoWireBytes
+			registers, registersOff = b, off-len(b)
+		default:
+			continue
+		}
+		if wire != want {
+			return decodeError(fieldOff, "field tag", ErrorInvalidData, "wire type %d of field %d", wire, field)
+		}
+		offs[field] = fieldOff
+	}
+	// at returns the offset of the field of number field, or 0 if the message
+	// has none.
+	at := func(field int) int { return max(offs[field], 0) }
+
+	if formatVersion != version {
+		return decodeError(at(protoFormatVersion), "format_version", ErrorInvalidVersion, "format version %d", formatVersion)
+	}
+	i := slices.Index(protoHashes[:], hash)
+	if i < 0 {
+		return decodeError(at(protoHash), "hash", ErrorInvalidData, "hash %d", hash)
+	}
+	h := HashFunc(i)
+	if precision > 255 {
+		return decodeError(at(protoPrecision), "precision", ErrorInvalidPrecision, "precision %d", precision)
+	}
+	p := uint8(precision)
+	if err := checkPrecision(p); err != nil {
+		return decodeError(at(protoPrecision), "precision", err, "precision %d", p)
+	}
+
+	switch representation {
+	case protoRepresentationDense:
+		for _, f := range keys {
+			if f.unpacked || len(f.packed) > 0 {
+				return decodeError(f.off, "sparse_keys", ErrorInvalidData, "dense sketch has sparse keys")
+			}
+		}
+		m := 1 << p
+		if len(registers) != m {
+			return decodeError(at(protoRegisters), "registers", ErrorInvalidData, "%d registers, want m = %d", len(registers), m)
+		}
+		maxRho := maxRho(p)
+		for i, r := range registers {
+			if r > maxRho {
+				return decodeError(registersOff+i, "registers", ErrorInvalidData, "register %d = %d, max %d", i, r, maxRho)
+			}
+		}
+		tmp, _ := NewSketchWithHash(p, false, h)
+		copy(tmp.regs, registers)
+		*sk = *tmp
+		return nil
+
+	case protoRepresentationSparse:
+		if len(registers) > 0 {
+			return decodeError(at(protoRegisters), "registers", ErrorInvalidData, "sparse sketch has registers")
+		}
+		tmp, _ := NewSketchWithHash(p, true, h)
+		list := tmp.sparseList
+		add := func(off int, k uint64) error {
+			switch {
+			case k > 1<<32-1:
+				return decodeError(off, "sparse_keys", ErrorInvalidData, "key %#x overflows 32 bits", k)
+			case list.count > 0 && uint32(k) <= list.last:
+				return decodeError(off, "sparse_keys", ErrorInvalidData, "key %#08x does not increase past %#08x", k, list.last)
+			case list.count == mp-1:
+				return decodeError(off, "sparse_keys", ErrorInvalidData, "more than %d keys", mp-1)
+			}
+			if err := checkSparseKey(uint32(k), p, off, "sparse_keys"); err != nil {
+				return err
+			}
+			list.Append(uint32(k))
+			return nil
+		}
+		for _, f := range keys {
+			if f.unpacked {
+				if err := add(f.off, f.key); err != nil {
+					return err
+				}
+				continue
+			}
+			for i := 0; i < len(f.packed); {
+				k, n := binary.Uvarint(f.packed[i:])
+				if n <= 0 {
+					// The field's length bounds it, so a uvarint that does
+					// not end within it is malformed rather than short.
+					return decodeError(f.off+i, "sparse_keys", ErrorInvalidData, "malformed packed varint")
+				}
+				if err := add(f.off+i, k); err != nil {
+					return err
+				}
+				i += n
+			}
+		}
+		*sk = *tmp
+		return nil
+	}
+	return decodeError(at(protoRepresentation), "representation", ErrorInvalidData, "representation %d", representation)
+}
+
+// protoUvarintError returns the error of binary.Uvarint returning n for the
+// field at offset off, if any.
+func protoUvarintError(off int, field string, n int) error {
+	switch {
+	case n == 0:
+		return decodeError(off, field, ErrorTooShort, "message ends inside a varint")
+	case n < 0:
+		return decodeError(off, field, ErrorInvalidData, "varint overflows 64 bits")
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLL_Proto(t *testing.T) {
+	for _, p := range []uint8{4, 14, 18} {
+		for _, n := range []int{0, 10, 1000, 100000} {
+			for _, sparse := range []bool{true, false} {
+				sk := newSketchNoError(p, sparse)
+				for i := 0; i < n; i++ {
+					sk.InsertHash(rand.Uint64())
+				}
+				data, err := sk.MarshalProto()
+				require.NoError(t, err)
+				appended, err := sk.AppendProto([]byte{0xaa})
+				require.NoError(t, err)
+				require.Equal(t, append([]byte{0xaa}, data...), appended)
+
+				got := &Sketch{}
+				require.NoError(t, got.UnmarshalProto(data), "p=%d n=%d sparse=%v", p, n, sparse)
+				require.Equal(t, sk.canonical().sparse(), got.sparse())
+				require.Equal(t, denseRegs(sk), denseRegs(got))
+				require.Equal(t, sk.Estimate(), got.Estimate())
+				require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+			}
+		}
+	}
+
+	// The message for a hash of 1, which has the sparse key 39<<1 | 1, as a
+	// generated encoder writes it.
+	sk := New()
+	sk.InsertHash(1)
+	data, err := sk.MarshalProto()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x08, 2, 0x10, 1, 0x18, 14, 0x20, 1, 0x2a, 1, 79}, data)
+
+	// The hash field holds the hash function.
+	sk = NewRedis()
+	sk.InsertHash(1)
+	data, err = sk.MarshalProto()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x08, 2, 0x10, 2, 0x18, 14, 0x20, 1, 0x2a, 1, 79}, data)
+	got := &Sketch{}
+	require.NoError(t, got.UnmarshalProto(data))
+	require.Equal(t, HashRedis, got.HashFunc())
+	require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+	for _, dense := range []bool{false, true} {
+		sk := newRedisSketch(12, !dense)
+		for i := 0; i < 10000; i++ {
+			sk.Insert([]byte(fmt.Sprint(i)))
+		}
+		data, err := sk.MarshalProto()
+		require.NoError(t, err)
+		got := &Sketch{}
+		require.NoError(t, got.UnmarshalProto(data))
+		require.Equal(t, HashRedis, got.HashFunc())
+		require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+	}
+
+	_, err = (&Sketch{}).MarshalProto()
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+}
+
+func TestHLL_Proto_Wire(t *testing.T) {
+	header := func(data []byte, p, representation uint64) []byte {
+		data = appendProtoVarint(data, protoFormatVersion, 2)
+		data = appendProtoVarint(data, protoHash, protoHashMetroHash64Seed1337)
+		data = appendProtoVarint(data, protoPrecision, p)
+		return appendProtoVarint(data, protoRepresentation, representation)
+	}
+	packed := func(keys ...uint64) []byte {
+		var b []byte
+		for _, k := range keys {
+			b = binary.AppendUvarint(b, k)
+		}
+		return appendProtoBytes(nil, protoSparseKeys, b)
+	}
+	regs := make([]byte, 16)
+	regs[3] = 7
+
+	// Unknown fields of every wire type are skipped, fields may come in any
+	// order, and the last of a repeated scalar wins.
+	var data []byte
+	data = appendProtoBytes(data, protoRegisters, []byte{1})
+	data = appendProtoVarint(data, 100, 1)
+	data = binary.AppendUvarint(data, 101<<3|protoWireFixed64)
+	data = binary.LittleEndian.AppendUint64(data, 1)
+	data = binary.AppendUvarint(data, 102<<3|protoWireFixed32)
+	data = binary.LittleEndian.AppendUint32(data, 1)
+	data = appendProtoBytes(data, 103, []byte("ignored"))
+	data = appendProtoVarint(data, protoPrecision, 10)
+	data = header(data, 4, protoRepresentationDense)
+	data = appendProtoBytes(data, protoRegisters, regs)
+	sk := &Sketch{}
+	require.NoError(t, sk.UnmarshalProto(data))
+	require.Equal(t, regs, sk.regs)
+
+	// Keys may be unpacked, and split over several fields.
+	data = header(nil, 4, protoRepresentationSparse)
+	data = append(data, packed(2, 4)...)
+	data = appendProtoVarint(data, protoSparseKeys, 6)
+	data = append(data, packed()...)
+	data = append(data, packed(8)...)
+	require.NoError(t, sk.UnmarshalProto(data))
+	require.True(t, sk.sparse())
+	var keys []uint32
+	for iter := sk.sparseList.Iter(); iter.HasNext(); {
+		keys = append(keys, iter.Next())
+	}
+	require.Equal(t, []uint32{2, 4, 6, 8}, keys)
+
+	// An empty sparse sketch has no keys at all.
+	require.NoError(t, sk.UnmarshalProto(header(nil, 4, protoRepresentationSparse)))
+	require.Zero(t, sk.Estimate())
+}
+
+func TestHLL_Proto_Malformed(t *testing.T) {
+	message := func(version, hash, p, representation uint64, rest ...[]byte) []byte {
+		data := appendProtoVarint(nil, protoFormatVersion, version)
+		data = appendProtoVarint(data, protoHash, hash)
+		data = appendProtoVarint(data, protoPrecision, p)
+		data = appendProtoVarint(data, protoRepresentation, representation)
+		for _, b := range rest {
+			data = append(data, b...)
+		}
+		return data
+	}
+	keys := func(keys ...uint64) []byte {
+		var b []byte
+		for _, k := range keys {
+			b = binary.AppendUvarint(b, k)
+		}
+		return appendProtoBytes(nil, protoSparseKeys, b)
+	}
+	regs := func(regs []byte) []byte { return appendProtoBytes(nil, protoRegisters, regs) }
+	tooLarge := make([]byte, 16)
+	tooLarge[5] = 62
+	valid := message(2, 1, 4, protoRepresentationDense, regs(make([]byte, 16)))
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrorInvalidVersion},
+		{"truncated", valid[:len(valid)-1], ErrorTooShort},
+		{"truncated tag", append(message(2, 1, 4, 1), 0x80), ErrorTooShort},
+		{"truncated varint", append(message(2, 1, 4, 1), 0x08, 0x80), ErrorTooShort},
+		{"truncated fixed64", append(message(2, 1, 4, 1), 0x09, 1, 2), ErrorTooShort},
+		{"field 0", append(message(2, 1, 4, 1), 0x00, 0), ErrorInvalidData},
+		{"group", append(message(2, 1, 4, 1), 0x0b), ErrorInvalidData},
+		{"wire type", append(message(2, 1, 4, 1), 0x1a, 0), ErrorInvalidData},
+		{"varint overflow", append(message(2, 1, 4, 1), 0x18, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01), ErrorInvalidData},
+		{"version", message(3, 1, 4, protoRepresentationDense, regs(make([]byte, 16))), ErrorInvalidVersion},
+		{"hash", message(2, 3, 4, protoRepresentationDense, regs(make([]byte, 16))), ErrorInvalidData},
+		{"no hash", message(2, 0, 4, protoRepresentationDense, regs(make([]byte, 16))), ErrorInvalidData},
+		{"precision", message(2, 1, 19, protoRepresentationDense, regs(make([]byte, 16))), ErrorInvalidPrecision},
+		{"precision 260", message(2, 1, 260, protoRepresentationDense), ErrorInvalidPrecision},
+		{"representation", message(2, 1, 4, 0), ErrorInvalidData},
+		{"dense registers short", message(2, 1, 4, protoRepresentationDense, regs(make([]byte, 15))), ErrorInvalidData},
+		{"dense register too large", message(2, 1, 4, protoRepresentationDense, regs(tooLarge)), ErrorInvalidData},
+		{"dense keys", message(2, 1, 4, protoRepresentationDense, regs(make([]byte, 16)), keys(2)), ErrorInvalidData},
+		{"sparse registers", message(2, 1, 4, protoRepresentationSparse, regs(make([]byte, 16))), ErrorInvalidData},
+		{"sparse keys repeated", message(2, 1, 4, protoRepresentationSparse, keys(2, 2)), ErrorInvalidData},
+		{"sparse keys decreasing", message(2, 1, 4, protoRepresentationSparse, keys(4), keys(2)), ErrorInvalidData},
+		{"sparse key overflow", message(2, 1, 4, protoRepresentationSparse, keys(1<<32)), ErrorInvalidData},
+		{"sparse key rho", message(2, 1, 4, protoRepresentationSparse, keys(0x7f)), ErrorInvalidData},
+		{"sparse keys malformed", message(2, 1, 4, protoRepresentationSparse, appendProtoBytes(nil, protoSparseKeys, []byte{0x80})), ErrorInvalidData},
+		{"sparse keys wire type", message(2, 1, 4, protoRepresentationSparse, binary.AppendUvarint(nil, protoSparseKeys<<3|protoWireFixed32), []byte{1, 2, 3, 4}), ErrorInvalidData},
+	} {
+		sk := New()
+		sk.InsertHash(1)
+		want := sk.Fingerprint()
+		err := sk.UnmarshalProto(tt.data)
+		require.ErrorIs(t, err, tt.err, tt.name)
+		var de *DecodeError
+		require.ErrorAs(t, err, &de, tt.name)
+		require.Equal(t, want, sk.Fingerprint(), tt.name)
+	}
+	require.NoError(t, (&Sketch{}).UnmarshalProto(valid))
+}
+
+func FuzzUnmarshalProto(f *testing.F) {
+	for _, sparse := range []bool{true, false} {
+		sk := newSketchNoError(4, sparse)
+		for i := 0; i < 3; i++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		data, err := sk.MarshalProto()
+		require.NoError(f, err)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sk := &Sketch{}
+		if err := sk.UnmarshalProto(data); err != nil {
+			var de *DecodeError
+			require.ErrorAs(t, err, &de)
+			require.Zero(t, sk.p)
+			return
+		}
+		out, err := sk.MarshalProto()
+		require.NoError(t, err)
+		got := &Sketch{}
+		require.NoError(t, got.UnmarshalProto(out))
+		require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+	})
+}
@@ -0,0 +1,121 @@
+package hyperloglog
+
+// A binary range coder in the style of LZMA's. Every bit is coded against
+// the probability, in units of 1/probTotal, that it is 0. The encoder's output
+// is exactly as long as the number of bytes the decoder consumes, so a decoder
+// that finishes with bytes left over, or that runs past the end of its input,
+// was handed something no encoder wrote.
+
+const (
+	probBits  = 12
+	probTotal = 1 << probBits
+	rangeTop  = 1 << 24
+)
+
+// clampProb keeps p0 inside (0, probTotal) so that neither bit becomes
+// impossible to code.
+func clampProb(p0 uint32) uint32 { return min(max(p0, 1), probTotal-1) }
+
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+	out       []byte
+}
+
+func newRangeEncoder(out []byte) rangeEncoder {
+	return rangeEncoder{rng: 0xffffffff, cacheSize: 1, out: out}
+}
+
+// encode codes bit, which is 0 with probability p0/probTotal. p0 must be in
+// (0, probTotal).
+func (e *rangeEncoder) encode(bit bool, p0 uint32) {
+	bound := (e.rng >> probBits) * p0
+	if !bit {
+		e.rng = bound
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+	}
+	for e.rng < rangeTop {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xff000000 || e.low >= 1<<32 {
+		carry := byte(e.low >> 32)
+		b := e.cache
+		for ; e.cacheSize > 0; e.cacheSize-- {
+			e.out = append(e.out, b+carry)
+			b = 0xff
+		}
+		e.cache = byte(e.low >> 24)
+	}
+	e.cacheSize++
+	e.low = (e.low & 0x00ffffff) << 8
+}
+
+// finish flushes the encoder and returns its output appended to the buffer
+// it was created with.
+func (e *rangeEncoder) finish() []byte {
+	for range 5 {
+		e.shiftLow()
+	}
+	return e.out
+}
+
+type rangeDecoder struct {
+	code uint32
+	rng  uint32
+	in   []byte
+	pos  int
+	// short is set once the decoder has asked for a byte past the end of in.
+	short bool
+}
+
+// newRangeDecoder returns false when in does not start like an encoder's
+// output: shorter than 5 bytes, or with a non-zero first byte.
+func newRangeDecoder(in []byte) (rangeDecoder, bool) {
+	d := rangeDecoder{rng: 0xffffffff, in: in}
+	if len(in) < 5 || in[0] != 0 {
+		return d, false
+	}
+	d.code = uint32(in[1])<<24 | uint32(in[2])<<16 | uint32(in[3])<<8 | uint32(in[4])
+	d.pos = 5
+	return d, true
+}
+
+func (d *rangeDecoder) next() byte {
+	if d.pos >= len(d.in) {
+		d.short = true
+		return 0
+	}
+	b := d.in[d.pos]
+	d.pos++
+	return b
+}
+
+// decode returns the next bit, which was coded with probability p0/probTotal
+// of being 0.
+func (d *rangeDecoder) decode(p0 uint32) bool {
+	bound := (d.rng >> probBits) * p0
+	var bit bool
+	if d.code < bound {
+		d.rng = bound
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		bit = true
+	}
+	for d.rng < rangeTop {
+		d.rng <<= 8
+		d.code = d.code<<8 | uint32(d.next())
+	}
+	return bit
+}
+
+// done reports whether the decoder consumed its input exactly.
+func (d *rangeDecoder) done() bool { return !d.short && d.pos == len(d.in) }
@@ -0,0 +1,246 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Redis stores a HyperLogLog as a string: a 16 byte header of the magic
+// "HYLL", the encoding, 3 zero bytes and the cached cardinality as 8 bytes
+// little endian, whose most significant bit marks it stale, followed by the
+// registers. It always uses precision 14.
+//
+// The dense encoding packs the 16384 registers in 6 bits each, least
+// significant bit first. The sparse encoding runs through the registers with
+// three opcodes:
+//
+//	00xxxxxx          ZERO: xxxxxx+1 registers of zero
+//	01xxxxxx yyyyyyyy XZERO: xxxxxxyyyyyyyy+1 registers of zero
+//	1vvvvvxx          VAL: xx+1 registers of vvvvv+1
+const (
+	redisMagic      = "HYLL"
+	redisHeaderSize = 16
+	redisP          = 14
+	redisM          = 1 << redisP
+	redisDenseSize  = redisM * 6 / 8
+	redisDense      = 0
+	redisSparse     = 1
+
+	redisStaleCard  = 1 << 7
+	redisMaxZero    = 64
+	redisMaxXZero   = redisM
+	redisMaxVal     = 32
+	redisMaxValRun  = 4
+	redisSparseMax  = 3000
+	redisMurmurSeed = 0xadc83b19
+)
+
+// RedisHash returns the hash Redis's PFADD computes for e, MurmurHash64A with
+// seed 0xadc83b19, with its bits rearranged for InsertHash. Redis takes the
+// register from the 14 low bits of the hash and the value from the trailing
+// zeros of the others, where InsertHash takes the high and leading ones, so
+// the returned hash lands in the register Redis would update, with the same
+// value.
+//
+// A Sketch created by NewRedis or NewSketchWithHash with HashRedis hashes
+// with RedisHash on Insert, counts the same elements as Redis does, and can be
+// exchanged with it through MarshalRedis and UnmarshalRedis. Pass RedisHash's
+// hashes to InsertHash only on such a Sketch.
+func RedisHash(e []byte) uint64 {
+	h := murmurHash64A(e, redisMurmurSeed)
+	return (h&(redisM-1))<<(64-redisP) | bits.Reverse64(h>>redisP)>>redisP
+}
+
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+	h := seed ^ uint64(len(data))*m
+	for ; len(data) >= 8; data = data[8:] {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// MarshalRedis returns sk in Redis's HyperLogLog string format. See
+// AppendRedis.
+func (sk *Sketch) MarshalRedis() ([]byte, error) {
+	return sk.AppendRedis(nil)
+}
+
+// AppendRedis appends sk in Redis's HyperLogLog string format to data, so that
+// Redis can PFCOUNT and PFMERGE it once SET. Redis only holds precision 14, so
+// a Sketch of a higher precision is folded to it first, and one of a lower
+// precision returns an error wrapping ErrorInvalidPrecision, as does a
+// zero-value Sketch. The encoding pins the hash function to HashRedis, so a
+// Sketch fed by another one returns an error wrapping ErrorHashMismatch. data
+// is left unmodified on error, and sk is not modified.
+//
+// The registers are written in the sparse encoding when it fits in the 3000
+// bytes Redis allows it by default and every register fits its 5 bit values,
+// and in the dense encoding otherwise. The cached cardinality is marked stale,
+// so that Redis computes it.
+func (sk *Sketch) AppendRedis(data []byte) ([]byte, error) {
+	if err := checkPrecision(sk.p); err != nil || sk.p < redisP {
+		return data, fmt.Errorf("hyperloglog: precision %d, Redis needs at least %d: %w", sk.p, redisP, ErrorInvalidPrecision)
+	}
+	if err := sk.checkFormatHash("Redis", HashRedis); err != nil {
+		return data, err
+	}
+	c := sk.canonical()
+	if c.p != redisP || c.sparse() {
+		if c == sk {
+			c = sk.Clone()
+		}
+		if c.sparse() {
+			c.toNormal()
+		}
+		// The precision was checked above.
+		_ = c.Fold(redisP)
+	}
+
+	start := len(data)
+	data = append(data, redisMagic...)
+	data = append(data, redisSparse, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, redisStaleCard)
+	if data, ok := appendRedisSparse(data, c.regs); ok {
+		return data, nil
+	}
+	data = data[:start+redisHeaderSize]
+	data[start+len(redisMagic)] = redisDense
+	data = append(data, make([]byte, redisDenseSize)...)
+	regs := data[start+redisHeaderSize:]
+	for i, r := range c.regs {
+		pos := i * 6
+		regs[pos/8] |= r << (pos % 8)
+		if pos%8 > 2 {
+			regs[pos/8+1] |= r >> (8 - pos%8)
+		}
+	}
+	return data, nil
+}
+
+// appendRedisSparse appends regs in the sparse encoding to data. It returns
+// false if a register does not fit a VAL opcode or the encoding outgrows
+// redisSparseMax.
+func appendRedisSparse(data []byte, regs []uint8) ([]byte, bool) {
+	start := len(data)
+	for i := 0; i < len(regs); {
+		r := regs[i]
+		if r > redisMaxVal {
+			return data, false
+		}
+		n := 1
+		for i+n < len(regs) && regs[i+n] == r {
+			n++
+		}
+		i += n
+		for ; n > 0 && r == 0; n -= min(n, redisMaxXZero) {
+			if run := min(n, redisMaxXZero); run > redisMaxZero {
+				data = append(data, 0x40|byte((run-1)>>8), byte(run-1))
+			} else {
+				data = append(data, byte(run-1))
+			}
+		}
+		for ; n > 0; n -= min(n, redisMaxValRun) {
+			data = append(data, 0x80|(r-1)<<2|byte(min(n, redisMaxValRun)-1))
+		}
+		if len(data)-start > redisSparseMax {
+			return data, false
+		}
+	}
+	return data, true
+}
+
+// UnmarshalRedis reads a HyperLogLog string of Redis, as GET returns it, into
+// sk, which becomes a dense Sketch of precision 14 fed by HashRedis. Both the
+// sparse and the dense encoding are read, and the cached cardinality is
+// ignored.
+//
+// As for UnmarshalBinary, errors are a *DecodeError and sk is left unchanged on
+// error. Data that is not a HyperLogLog string or is cut short returns an
+// error wrapping ErrorInvalidData or ErrorTooShort, an encoding other than
+// sparse or dense ErrorInvalidVersion, and registers that are not exactly 16384
+// or hold values PFADD cannot set ErrorInvalidData.
+func (sk *Sketch) UnmarshalRedis(data []byte) error {
+	if len(data) < redisHeaderSize {
+		return decodeError(0, "Redis header", ErrorTooShort, "need %d bytes, have %d", redisHeaderSize, len(data))
+	}
+	if string(data[:len(redisMagic)]) != redisMagic {
+		return decodeError(0, "Redis magic", ErrorInvalidData, "magic %q", data[:len(redisMagic)])
+	}
+	if data[5]|data[6]|data[7] != 0 {
+		return decodeError(5, "Redis header", ErrorInvalidData, "reserved bytes %x", data[5:8])
+	}
+
+	res, _ := NewSketchWithHash(redisP, false, HashRedis)
+	body := data[redisHeaderSize:]
+	switch enc := data[len(redisMagic)]; enc {
+	case redisDense:
+		if err := decodeLen(redisHeaderSize, "Redis registers", uint64(len(body)), redisDenseSize); err != nil {
+			return err
+		}
+		for i := range res.regs {
+			pos := i * 6
+			v := uint16(body[pos/8])
+			if pos/8+1 < len(body) {
+				v |= uint16(body[pos/8+1]) << 8
+			}
+			res.regs[i] = uint8(v>>(pos%8)) & 0x3f
+		}
+	case redisSparse:
+		i := 0
+		for off := 0; off < len(body); off++ {
+			var n int
+			var r uint8
+			switch op := body[off]; {
+			case op&0x80 != 0:
+				n, r = int(op&0x3)+1, (op>>2)&0x1f+1
+			case op&0x40 != 0:
+				if off+1 == len(body) {
+					return decodeError(redisHeaderSize+off, "Redis XZERO", ErrorTooShort, "need 2 bytes, have 1")
+				}
+				off++
+				n = int(op&0x3f)<<8 | int(body[off]) + 1
+			default:
+				n = int(op) + 1
+			}
+			if i+n > redisM {
+				return decodeError(redisHeaderSize+off, "Redis registers", ErrorInvalidData, "runs past register %d", redisM)
+			}
+			for ; n > 0 && r != 0; n-- {
+				res.regs[i] = r
+				i++
+			}
+			i += n
+		}
+		if i != redisM {
+			return decodeError(redisHeaderSize, "Redis registers", ErrorTooShort, "runs cover %d of %d registers", i, redisM)
+		}
+	default:
+		return decodeError(len(redisMagic), "Redis encoding", ErrorInvalidVersion, "encoding %d", enc)
+	}
+
+	for i, r := range res.regs {
+		if r > maxRho(redisP) {
+			return decodeError(redisHeaderSize, "Redis registers", ErrorInvalidData, "register %d holds %d, max %d", i, r, maxRho(redisP))
+		}
+	}
+	*sk = *res
+	return nil
+}
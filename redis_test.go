@@ -0,0 +1,224 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisHash(t *testing.T) {
+	for _, tt := range []struct {
+		e     string
+		hash  uint64
+		index uint64
+		count uint8
+	}{
+		{"", 0xd8dfea6585bc9732, 5938, 2},
+		{"a", 0x53d2470a9b43b1a7, 12711, 2},
+		{"hello", 0x0f656f01eecfe400, 9216, 1},
+		{"0123456789abcdef!", 0xb917c99b031f7674, 13940, 1},
+	} {
+		require.Equal(t, tt.hash, murmurHash64A([]byte(tt.e), redisMurmurSeed), tt.e)
+		i, r := getPosVal(RedisHash([]byte(tt.e)), redisP)
+		require.Equal(t, tt.index, i, tt.e)
+		require.Equal(t, tt.count, r, tt.e)
+	}
+
+	// The register and value Redis's hllPatLen derives.
+	for n := 0; n < 1000; n++ {
+		e := []byte(fmt.Sprint(n))
+		h := murmurHash64A(e, redisMurmurSeed)
+		count := uint8(bits.TrailingZeros64(h>>redisP|1<<(64-redisP))) + 1
+		i, r := getPosVal(RedisHash(e), redisP)
+		require.Equal(t, h&(redisM-1), i)
+		require.Equal(t, count, r)
+	}
+}
+
+func TestRedis_Golden(t *testing.T) {
+	header := func(enc byte) []byte {
+		return []byte{'H', 'Y', 'L', 'L', enc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, redisStaleCard}
+	}
+
+	sk := NewRedis()
+	data, err := sk.MarshalRedis()
+	require.NoError(t, err)
+	require.Equal(t, append(header(redisSparse), 0x7f, 0xff), data)
+
+	sk.Insert([]byte("a"))
+	data, err = sk.MarshalRedis()
+	require.NoError(t, err)
+	require.Equal(t, append(header(redisSparse), 0x71, 0xa6, 0x84, 0x4e, 0x57), data)
+
+	sk = newRedisSketch(redisP, false)
+	sk.regs[0], sk.regs[1], sk.regs[redisM-1] = 1, 2, maxRho(redisP)
+	data, err = sk.MarshalRedis()
+	require.NoError(t, err)
+	want := append(header(redisDense), make([]byte, redisDenseSize)...)
+	want[redisHeaderSize] = 0x81
+	want[len(want)-1] = maxRho(redisP) << 2
+	require.Equal(t, want, data)
+
+	got := &Sketch{}
+	require.NoError(t, got.UnmarshalRedis(data))
+	require.Equal(t, sk.regs, got.regs)
+	require.Equal(t, HashRedis, got.HashFunc())
+	require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+}
+
+func newRedisSketch(p uint8, sparse bool) *Sketch {
+	sk, _ := NewSketchWithHash(p, sparse, HashRedis)
+	return sk
+}
+
+func TestRedis_RoundTrip(t *testing.T) {
+	for _, p := range []uint8{14, 16} {
+		for _, sparse := range []bool{true, false} {
+			for _, n := range []int{0, 10, 1000, 100000} {
+				sk := newRedisSketch(p, sparse)
+				for i := 0; i < n; i++ {
+					sk.Insert([]byte(fmt.Sprint(i)))
+				}
+				want := sk.Clone()
+				require.NoError(t, want.Fold(redisP))
+
+				data, err := sk.AppendRedis([]byte{0xaa})
+				require.NoError(t, err)
+				require.Equal(t, byte(0xaa), data[0])
+				data = data[1:]
+				if n <= 10 {
+					require.Equal(t, byte(redisSparse), data[4])
+				}
+				if n == 100000 {
+					require.Equal(t, byte(redisDense), data[4])
+				}
+
+				got := &Sketch{}
+				require.NoError(t, got.UnmarshalRedis(data))
+				require.Equal(t, denseRegs(want), got.regs, "p=%d sparse=%v n=%d", p, sparse, n)
+				require.Equal(t, p, sk.p)
+
+				// The same elements counted by Redis's own derivation.
+				redis := NewNoSparse()
+				for i := 0; i < n; i++ {
+					h := murmurHash64A([]byte(fmt.Sprint(i)), redisMurmurSeed)
+					redis.insert(uint32(h&(redisM-1)), uint8(bits.TrailingZeros64(h>>redisP|1<<(64-redisP)))+1)
+				}
+				require.Equal(t, redis.regs, got.regs)
+			}
+		}
+	}
+
+	sk := newRedisSketch(redisP, false)
+	for i := 0; i < 1000; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+	// A register above 32 does not fit the sparse encoding.
+	sk.regs[7] = 33
+	data, err := sk.MarshalRedis()
+	require.NoError(t, err)
+	require.Equal(t, byte(redisDense), data[4])
+
+	_, err = newRedisSketch(12, false).MarshalRedis()
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	data, err = (&Sketch{}).AppendRedis([]byte{1})
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	require.Equal(t, []byte{1}, data)
+}
+
+func TestRedis_Malformed(t *testing.T) {
+	header := []byte{'H', 'Y', 'L', 'L', redisSparse, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	sparse := func(ops ...byte) []byte { return append(bytes.Clone(header), ops...) }
+	dense := func(size int) []byte {
+		data := append(bytes.Clone(header), make([]byte, size)...)
+		data[4] = redisDense
+		return data
+	}
+	highReg := dense(redisDenseSize)
+	highReg[redisHeaderSize] = 52
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrorTooShort},
+		{"short header", header[:15], ErrorTooShort},
+		{"magic", append([]byte("HYLX"), header[4:]...), ErrorInvalidData},
+		{"reserved", append(sparse(0x7f, 0xff)[:6:6], append([]byte{1}, header[7:]...)...), ErrorInvalidData},
+		{"encoding", append([]byte("HYLL\xff"), header[5:]...), ErrorInvalidVersion},
+		{"dense short", dense(redisDenseSize - 1), ErrorTooShort},
+		{"dense long", dense(redisDenseSize + 1), ErrorInvalidData},
+		{"dense register", highReg, ErrorInvalidData},
+		{"no runs", sparse(), ErrorTooShort},
+		{"short runs", sparse(0x7f, 0xfe), ErrorTooShort},
+		{"long runs", sparse(0x7f, 0xff, 0x80), ErrorInvalidData},
+		{"XZERO cut", sparse(0x7f), ErrorTooShort},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sk := NewRedis()
+			sk.Insert([]byte("a"))
+			want := sk.Fingerprint()
+			err := sk.UnmarshalRedis(tt.data)
+			require.ErrorIs(t, err, tt.err)
+			var de *DecodeError
+			require.ErrorAs(t, err, &de)
+			require.Equal(t, want, sk.Fingerprint())
+		})
+	}
+}
+
+func TestRedis_Estimate(t *testing.T) {
+	sk := NewRedis()
+	const n = 100000
+	for i := 0; i < n; i++ {
+		sk.Insert([]byte(fmt.Sprint("element:", i)))
+	}
+	require.Less(t, estimateError(sk.Estimate(), n), 2.0)
+}
+
+func TestRedis_HashFunc(t *testing.T) {
+	redis := NewRedis()
+	redis.Insert([]byte("a"))
+	want := NewRedis()
+	want.InsertHash(RedisHash([]byte("a")))
+	require.Equal(t, want.Fingerprint(), redis.Fingerprint())
+	metro := New()
+	metro.Insert([]byte("a"))
+	require.Equal(t, HashMetro, metro.HashFunc())
+	require.NotEqual(t, metro.Fingerprint(), redis.Fingerprint())
+
+	// Neither merges into the other, and each encoding only takes its own.
+	require.ErrorIs(t, metro.Merge(redis), ErrorHashMismatch)
+	require.ErrorIs(t, redis.Merge(metro), ErrorHashMismatch)
+	require.Equal(t, want.Fingerprint(), redis.Fingerprint())
+	for name, encode := range map[string]func() ([]byte, error){
+		"binary":    redis.MarshalBinary,
+		"canonical": redis.MarshalCanonical,
+		"text":      redis.MarshalText,
+		"JSON":      redis.MarshalJSON,
+	} {
+		_, err := encode()
+		require.ErrorIs(t, err, ErrorHashMismatch, name)
+	}
+	_, err := metro.MarshalRedis()
+	require.ErrorIs(t, err, ErrorHashMismatch)
+
+	// A zero value adopts the hash function of what it merges or decodes,
+	// and a fold keeps it.
+	var zero Sketch
+	require.NoError(t, zero.Merge(redis))
+	require.Equal(t, HashRedis, zero.HashFunc())
+	big := newRedisSketch(16, true)
+	require.NoError(t, big.Fold(14))
+	require.Equal(t, HashRedis, big.HashFunc())
+	require.NoError(t, big.Merge(redis))
+
+	_, err = NewSketchWithHash(14, true, HashFunc(9))
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+	require.Equal(t, "HashFunc(9)", HashFunc(9).String())
+}
@@ -0,0 +1,504 @@
+package hyperloglog
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrorInvalidExpression is returned, wrapped, when a set expression does not
+// parse or cannot be evaluated over the sketches it is given.
+var ErrorInvalidExpression = errors.New("invalid set expression")
+
+// maxSetExprAtoms bounds the number of distinct operands of intersections and
+// differences, since evaluating them takes up to atoms*2^(atoms-1) joint
+// estimates.
+const maxSetExprAtoms = 8
+
+// maxSetExprDepth bounds how deeply parentheses nest, since the parser
+// recurses into each pair.
+const maxSetExprDepth = 100
+
+type setOp byte
+
+const (
+	opName setOp = iota
+	opUnion
+	opIntersect
+	opDiff
+)
+
+var setOpSymbols = [...]string{opUnion: "∪", opIntersect: "∩", opDiff: "\\"}
+
+// SetExpr is a parsed set expression over named sketches, such as
+// "(A ∪ B) ∩ C \ D". Use ParseSetExpr to create one.
+type SetExpr struct {
+	root *setExprNode
+}
+
+type setExprNode struct {
+	op          setOp
+	name        string
+	left, right *setExprNode
+}
+
+// ParseSetExpr parses a set expression. Operands are names made of letters,
+// digits, '_' and '.'. The operators are union, written ∪ or |, intersection,
+// written ∩ or &, and difference, written \ or -. Intersection binds tighter
+// than union and difference, which bind equally; operators of the same
+// precedence associate to the left, and parentheses group, nested at most 100
+// deep. Errors wrap ErrorInvalidExpression.
+func ParseSetExpr(s string) (*SetExpr, error) {
+	p := setExprParser{src: s}
+	p.next()
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != tokEOF {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	return &SetExpr{root: root}, nil
+}
+
+// String returns the expression with every operation parenthesized and the
+// operators written ∪, ∩ and \.
+func (e *SetExpr) String() string {
+	var b strings.Builder
+	e.root.format(&b, true)
+	return b.String()
+}
+
+func (n *setExprNode) format(b *strings.Builder, top bool) {
+	if n.op == opName {
+		b.WriteString(n.name)
+		return
+	}
+	if !top {
+		b.WriteByte('(')
+	}
+	n.left.format(b, false)
+	b.WriteString(" " + setOpSymbols[n.op] + " ")
+	n.right.format(b, false)
+	if !top {
+		b.WriteByte(')')
+	}
+}
+
+// Names returns the distinct names the expression refers to, sorted.
+func (e *SetExpr) Names() []string {
+	var names []string
+	var walk func(n *setExprNode)
+	walk = func(n *setExprNode) {
+		if n.op == opName {
+			names = append(names, n.name)
+			return
+		}
+		walk(n.left)
+		walk(n.right)
+	}
+	walk(e.root)
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// EstimateSetExpr parses expr and estimates its cardinality over sketches. See
+// ParseSetExpr and SetExpr.Estimate.
+func EstimateSetExpr(expr string, sketches map[string]*Sketch) (Bounded, error) {
+	e, err := ParseSetExpr(expr)
+	if err != nil {
+		return Bounded{}, err
+	}
+	return e.Estimate(sketches)
+}
+
+// Estimate returns the cardinality estimate of the expression over the
+// sketches named in it, with its standard error.
+//
+// Unions are exact: every maximal part of the expression made only of unions
+// is merged into a single Sketch. The rest is split into disjoint regions of
+// the Venn diagram of those unions, and each region is estimated from joint
+// estimates of a union against the union of the others (see EstimateJoint).
+// The standard errors of the joint estimates add up in quadrature, and the
+// estimate is never negative. At most 8 distinct unions may be intersected or
+// subtracted.
+//
+// A name missing from sketches returns an error wrapping
+// ErrorInvalidExpression; nil and zero-value sketches are empty. The sketches
+// may have different precisions and are compared at the lowest, but sketches
+// fed by different hash functions return an error wrapping ErrorHashMismatch.
+// They are not modified.
+func (e *SetExpr) Estimate(sketches map[string]*Sketch) (Bounded, error) {
+	var p uint8
+	var h *Sketch
+	for _, name := range e.Names() {
+		sk, ok := sketches[name]
+		if !ok {
+			return Bounded{}, fmt.Errorf("hyperloglog: set expression names unknown sketch %q: %w", name, ErrorInvalidExpression)
+		}
+		if sk == nil || sk.p == 0 {
+			continue
+		}
+		if h != nil && sk.hashFunc != h.hashFunc {
+			return Bounded{}, fmt.Errorf("hyperloglog: set expression sketch %q hashes with %v, others with %v: %w", name, sk.hashFunc, h.hashFunc, ErrorHashMismatch)
+		}
+		h = sk
+		if p == 0 || sk.p < p {
+			p = sk.p
+		}
+	}
+	if p == 0 {
+		return Bounded{}, nil
+	}
+
+	ev := setExprEval{
+		p:      p,
+		hash:   h.hashFunc,
+		leaves: make(map[[2]uint32]Bounded),
+		unions: make(map[uint32]*Sketch),
+		cubes:  make(map[[2]uint32]Bounded),
+	}
+	root := ev.atomize(e.root, sketches)
+	if len(ev.atoms) > maxSetExprAtoms {
+		return Bounded{}, fmt.Errorf("hyperloglog: set expression intersects or subtracts %d unions, max %d: %w", len(ev.atoms), maxSetExprAtoms, ErrorInvalidExpression)
+	}
+
+	var est, variance float64
+	root.expand(0, 0, func(in, out uint32) {
+		c := ev.cube(in, out)
+		est += max(0, c.Estimate)
+		variance += c.StdErr * c.StdErr
+	})
+	return Bounded{est, math.Sqrt(variance)}, nil
+}
+
+// boolExpr is a set expression over the atoms of an evaluation, as a boolean
+// function of which atoms an element belongs to.
+type boolExpr struct {
+	op          setOp // opName for an atom.
+	atom        int
+	left, right *boolExpr
+}
+
+var (
+	boolTrue  = &boolExpr{}
+	boolFalse = &boolExpr{}
+)
+
+// assign returns b with atom set to v, simplified.
+func (b *boolExpr) assign(atom int, v bool) *boolExpr {
+	switch {
+	case b == boolTrue || b == boolFalse:
+		return b
+	case b.op == opName:
+		if b.atom != atom {
+			return b
+		}
+		if v {
+			return boolTrue
+		}
+		return boolFalse
+	}
+	l, r := b.left.assign(atom, v), b.right.assign(atom, v)
+	switch b.op {
+	case opUnion:
+		switch {
+		case l == boolTrue || r == boolTrue:
+			return boolTrue
+		case l == boolFalse:
+			return r
+		case r == boolFalse:
+			return l
+		}
+	case opIntersect:
+		switch {
+		case l == boolFalse || r == boolFalse:
+			return boolFalse
+		case l == boolTrue:
+			return r
+		case r == boolTrue:
+			return l
+		}
+	case opDiff:
+		switch {
+		case l == boolFalse || r == boolTrue:
+			return boolFalse
+		case r == boolFalse:
+			return l
+		}
+	}
+	return &boolExpr{op: b.op, left: l, right: r}
+}
+
+// firstAtom returns an atom b depends on, or -1 if b has no atoms. A
+// difference from a true left operand keeps the constant, so the first atom
+// may be on the right.
+func (b *boolExpr) firstAtom() int {
+	switch {
+	case b == boolTrue || b == boolFalse:
+		return -1
+	case b.op == opName:
+		return b.atom
+	}
+	if a := b.left.firstAtom(); a >= 0 {
+		return a
+	}
+	return b.right.firstAtom()
+}
+
+// expand calls fn for disjoint cubes covering the elements b holds: the
+// elements in all atoms of in and in none of out. Set expressions hold no
+// element outside all atoms, so in is never empty.
+func (b *boolExpr) expand(in, out uint32, fn func(in, out uint32)) {
+	switch b {
+	case boolTrue:
+		fn(in, out)
+		return
+	case boolFalse:
+		return
+	}
+	a := b.firstAtom()
+	b.assign(a, true).expand(in|1<<a, out, fn)
+	b.assign(a, false).expand(in, out|1<<a, fn)
+}
+
+type setExprEval struct {
+	p uint8
+	// hash feeds every sketch, and so the unions.
+	hash  HashFunc
+	atoms []*Sketch
+	// names identifies each atom by its sorted names, so that a union
+	// appearing twice is a single atom.
+	names []string
+	// leaves, unions and cubes memoize the estimates of |atom\union| by
+	// atom and union mask, the unions by mask, and the cubes by in and out
+	// masks.
+	leaves map[[2]uint32]Bounded
+	unions map[uint32]*Sketch
+	cubes  map[[2]uint32]Bounded
+}
+
+// atomize turns the maximal unions of n into atoms and returns n over them.
+func (ev *setExprEval) atomize(n *setExprNode, sketches map[string]*Sketch) *boolExpr {
+	if n.op != opName && n.op != opUnion || !n.unionOnly() {
+		return &boolExpr{op: n.op, left: ev.atomize(n.left, sketches), right: ev.atomize(n.right, sketches)}
+	}
+	names := (&SetExpr{root: n}).Names()
+	key := strings.Join(names, "\x00")
+	if i := slices.Index(ev.names, key); i >= 0 {
+		return &boolExpr{op: opName, atom: i}
+	}
+	union := ev.newUnion()
+	for _, name := range names {
+		if sk := sketches[name]; sk != nil && sk.p != 0 {
+			// Both have precision ev.p and hash function ev.hash.
+			_ = union.Merge(jointOperand(sk, ev.p))
+		}
+	}
+	ev.atoms = append(ev.atoms, union)
+	ev.names = append(ev.names, key)
+	return &boolExpr{op: opName, atom: len(ev.atoms) - 1}
+}
+
+// newUnion returns an empty Sketch for the sketches of ev to be merged into.
+func (ev *setExprEval) newUnion() *Sketch {
+	sk, _ := NewSketchWithHash(ev.p, true, ev.hash)
+	return sk
+}
+
+func (n *setExprNode) unionOnly() bool {
+	switch n.op {
+	case opName:
+		return true
+	case opUnion:
+		return n.left.unionOnly() && n.right.unionOnly()
+	}
+	return false
+}
+
+// cube estimates the elements in all atoms of in and in none of out, as
+// |X∩A\U| = |X\U| - |X\(U∪A)| for an atom A of in and the intersection X
+// of the others.
+func (ev *setExprEval) cube(in, out uint32) Bounded {
+	key := [2]uint32{in, out}
+	if c, ok := ev.cubes[key]; ok {
+		return c
+	}
+	var c Bounded
+	if bits.OnesCount32(in) == 1 {
+		c = ev.leaf(bits.TrailingZeros32(in), out)
+	} else {
+		a := uint32(1) << (31 - bits.LeadingZeros32(in))
+		keep, drop := ev.cube(in&^a, out), ev.cube(in&^a, out|a)
+		c = Bounded{keep.Estimate - drop.Estimate, math.Hypot(keep.StdErr, drop.StdErr)}
+	}
+	ev.cubes[key] = c
+	return c
+}
+
+// leaf estimates |atom\U| for the union U of the atoms of out.
+func (ev *setExprEval) leaf(atom int, out uint32) Bounded {
+	key := [2]uint32{uint32(atom), out}
+	if l, ok := ev.leaves[key]; ok {
+		return l
+	}
+	u, ok := ev.unions[out]
+	if !ok {
+		u = ev.newUnion()
+		for rest := out; rest != 0; rest &= rest - 1 {
+			// Both have precision ev.p and hash function ev.hash.
+			_ = u.Merge(ev.atoms[bits.TrailingZeros32(rest)])
+		}
+		ev.unions[out] = u
+	}
+	l := EstimateJoint(ev.atoms[atom], u).AnotB
+	ev.leaves[key] = l
+	return l
+}
+
+type setExprToken byte
+
+const (
+	tokEOF setExprToken = iota
+	tokName
+	tokOp
+	tokLParen
+	tokRParen
+	tokInvalid
+)
+
+type setExprParser struct {
+	src string
+	// pos is the offset of the current token, end the offset after it.
+	pos, end int
+	tok      setExprToken
+	op       setOp
+	name     string
+	// depth is the number of parentheses open around the current token.
+	depth int
+}
+
+func (p *setExprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("hyperloglog: set expression at offset %d: %s: %w", p.pos, fmt.Sprintf(format, args...), ErrorInvalidExpression)
+}
+
+func (p *setExprParser) describe() string {
+	if p.tok == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", p.src[p.pos:p.end])
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+}
+
+// next scans the token after the current one.
+func (p *setExprParser) next() {
+	p.pos = p.end
+	for p.pos < len(p.src) {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		p.pos += size
+	}
+	if p.pos == len(p.src) {
+		p.tok, p.end = tokEOF, p.pos
+		return
+	}
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.end = p.pos + size
+	switch r {
+	case '∪', '|':
+		p.tok, p.op = tokOp, opUnion
+	case '∩', '&':
+		p.tok, p.op = tokOp, opIntersect
+	case '\\', '-':
+		p.tok, p.op = tokOp, opDiff
+	case '(':
+		p.tok = tokLParen
+	case ')':
+		p.tok = tokRParen
+	default:
+		if !isNameRune(r) {
+			p.tok = tokInvalid
+			return
+		}
+		for p.end < len(p.src) {
+			r, size := utf8.DecodeRuneInString(p.src[p.end:])
+			if !isNameRune(r) {
+				break
+			}
+			p.end += size
+		}
+		p.tok, p.name = tokName, p.src[p.pos:p.end]
+	}
+}
+
+// parseExpr parses unions and differences of terms.
+func (p *setExprParser) parseExpr() (*setExprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == tokOp && p.op != opIntersect {
+		op := p.op
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &setExprNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseTerm parses intersections of factors.
+func (p *setExprParser) parseTerm() (*setExprNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == tokOp && p.op == opIntersect {
+		p.next()
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &setExprNode{op: opIntersect, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseFactor parses a name or a parenthesized expression.
+func (p *setExprParser) parseFactor() (*setExprNode, error) {
+	switch p.tok {
+	case tokName:
+		n := &setExprNode{op: opName, name: p.name}
+		p.next()
+		return n, nil
+	case tokLParen:
+		if p.depth == maxSetExprDepth {
+			return nil, p.errorf("parentheses nest deeper than %d", maxSetExprDepth)
+		}
+		p.depth++
+		p.next()
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != tokRParen {
+			return nil, p.errorf("expected ')', found %s", p.describe())
+		}
+		p.depth--
+		p.next()
+		return n, nil
+	}
+	return nil, p.errorf("expected a name or '(', found %s", p.describe())
+}
@@ -0,0 +1,141 @@
+package hyperloglog
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSetExpr(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"A", "A"},
+		{"(A ∪ B) ∩ C \\ D", "((A ∪ B) ∩ C) \\ D"},
+		{"A | B & C - D", "(A ∪ (B ∩ C)) \\ D"},
+		{"A - B | C", "(A \\ B) ∪ C"},
+		{"A ∩ (B \\ C) ∩ D", "(A ∩ (B \\ C)) ∩ D"},
+		{"  users.eu_2024 &(x1)  ", "users.eu_2024 ∩ x1"},
+		{"((A))", "A"},
+	} {
+		e, err := ParseSetExpr(tt.in)
+		require.NoError(t, err, tt.in)
+		require.Equal(t, tt.want, e.String(), tt.in)
+	}
+
+	e, err := ParseSetExpr("(B ∪ A) ∩ B \\ C")
+	require.NoError(t, err)
+	require.Equal(t, []string{"A", "B", "C"}, e.Names())
+
+	for _, in := range []string{"", "A ∪", "∪ A", "(A", "A)", "A B", "A + B", "()"} {
+		_, err := ParseSetExpr(in)
+		require.ErrorIs(t, err, ErrorInvalidExpression, in)
+	}
+
+	nested := func(depth int) string {
+		return strings.Repeat("(", depth) + "A" + strings.Repeat(")", depth)
+	}
+	e, err = ParseSetExpr(nested(maxSetExprDepth) + " ∪ " + nested(maxSetExprDepth))
+	require.NoError(t, err)
+	require.Equal(t, "A ∪ A", e.String())
+	_, err = ParseSetExpr(nested(maxSetExprDepth + 1))
+	require.ErrorIs(t, err, ErrorInvalidExpression)
+	_, err = ParseSetExpr(strings.Repeat("(", 10_000_000))
+	require.ErrorIs(t, err, ErrorInvalidExpression)
+}
+
+func TestSetExpr_Estimate(t *testing.T) {
+	// Each element belongs to each of A, B, C and D with its own probability,
+	// so every region of the Venn diagram is populated.
+	const n = 200000
+	probs := map[string]float64{"A": 0.5, "B": 0.3, "C": 0.4, "D": 0.2}
+	names := []string{"A", "B", "C", "D"}
+	sketches := make(map[string]*Sketch)
+	for _, name := range names {
+		sketches[name] = newSketchNoError(14, true)
+	}
+	members := make([]map[string]bool, n)
+	for i := range members {
+		members[i] = make(map[string]bool)
+		x := rand.Uint64()
+		for _, name := range names {
+			if rand.Float64() < probs[name] {
+				members[i][name] = true
+				sketches[name].InsertHash(x)
+			}
+		}
+	}
+	before := make(map[string]*Sketch)
+	for name, sk := range sketches {
+		before[name] = sk.Clone()
+	}
+
+	rel := 1.04 / math.Sqrt(1<<14)
+	for _, tt := range []struct {
+		expr string
+		fn   func(in map[string]bool) bool
+	}{
+		{"A ∪ B ∪ C", func(in map[string]bool) bool { return in["A"] || in["B"] || in["C"] }},
+		{"A ∩ B", func(in map[string]bool) bool { return in["A"] && in["B"] }},
+		{"A \\ B", func(in map[string]bool) bool { return in["A"] && !in["B"] }},
+		{"(A ∪ B) ∩ C \\ D", func(in map[string]bool) bool { return (in["A"] || in["B"]) && in["C"] && !in["D"] }},
+		{"A ∩ B ∩ C", func(in map[string]bool) bool { return in["A"] && in["B"] && in["C"] }},
+		{"(A \\ B) ∪ (C ∩ D)", func(in map[string]bool) bool { return in["A"] && !in["B"] || in["C"] && in["D"] }},
+		{"(A ∪ B) ∩ (A ∪ C)", func(in map[string]bool) bool { return in["A"] || in["B"] && in["C"] }},
+		{"A \\ A", func(in map[string]bool) bool { return false }},
+	} {
+		var want, union float64
+		for _, in := range members {
+			if tt.fn(in) {
+				want++
+			}
+			if len(in) > 0 {
+				union++
+			}
+		}
+		got, err := EstimateSetExpr(tt.expr, sketches)
+		require.NoError(t, err, tt.expr)
+		require.GreaterOrEqual(t, got.Estimate, 0.0, tt.expr)
+		requireBounded(t, want, got, 3.5*rel*union, tt.expr)
+	}
+	for name, sk := range sketches {
+		require.Equal(t, denseRegs(before[name]), denseRegs(sk), name)
+	}
+
+	// Sparse sketches are compared almost exactly.
+	small := map[string]*Sketch{"A": New(), "B": New16(), "C": nil}
+	for i := 0; i < 300; i++ {
+		x := rand.Uint64()
+		small["A"].InsertHash(x)
+		if i >= 100 {
+			small["B"].InsertHash(x)
+		}
+	}
+	got, err := EstimateSetExpr("A \\ B ∪ C", small)
+	require.NoError(t, err)
+	require.InDelta(t, 100, got.Estimate, 2)
+
+	// Sketches fed by another hash function are compared alike, but not with
+	// sketches fed by the first.
+	redis := map[string]*Sketch{"A": small["A"].Clone(), "B": small["B"].Clone(), "C": nil}
+	redis["A"].hashFunc, redis["B"].hashFunc = HashRedis, HashRedis
+	got, err = EstimateSetExpr("A \\ B ∪ C", redis)
+	require.NoError(t, err)
+	require.InDelta(t, 100, got.Estimate, 2)
+	redis["C"] = small["A"]
+	_, err = EstimateSetExpr("A \\ B ∪ C", redis)
+	require.ErrorIs(t, err, ErrorHashMismatch)
+
+	_, err = EstimateSetExpr("A ∩ E", small)
+	require.ErrorIs(t, err, ErrorInvalidExpression)
+	_, err = EstimateSetExpr("a & b & c & d & e & f & g & h & i", map[string]*Sketch{
+		"a": New(), "b": New(), "c": New(), "d": New(), "e": New(), "f": New(), "g": New(), "h": New(), "i": New(),
+	})
+	require.ErrorIs(t, err, ErrorInvalidExpression)
+	got, err = EstimateSetExpr("a ∩ b", map[string]*Sketch{"a": nil, "b": {}})
+	require.NoError(t, err)
+	require.Equal(t, Bounded{}, got)
+}
@@ -0,0 +1,333 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// SetSketch follows Otmar Ertl, "SetSketch: Filling the Gap between MinHash
+// and HyperLogLog" (VLDB 2021), in its SetSketch1 variant.
+
+const (
+	setSketchVersion = 1
+	minSetSketchM    = 16
+	maxSetSketchM    = 1 << 20
+)
+
+// SetSketch is a sketch of m registers whose base b moves it between MinHash
+// (b close to 1) and HyperLogLog (b = 2) behaviour. Each element draws one
+// exponentially distributed value per register, and a register keeps
+// floor(1-log_b(x)) of the smallest value drawn, clamped to [0, q+1]. As with
+// MinHash, equal registers of two sketches are likely to come from a shared
+// element, which Joint turns into estimates of the union, intersection and
+// differences, with standard errors.
+//
+// Ertl recommends a = 20 and, for b close to 1, q = 2^16-2, and for b = 2, q =
+// 62. Estimates are only reliable while no register is still 0 or already
+// q+1. Use NewSetSketch to create one; the zero value is not usable.
+type SetSketch struct {
+	b, a float64
+	q    uint16
+	regs []uint16
+	// low is the smallest register value and lowCount the number of
+	// registers holding it. Insertion stops as soon as the values it draws
+	// can no longer raise a register above low.
+	low      uint16
+	lowCount int
+	// perm is the identity permutation of the register indexes between
+	// insertions; InsertHash shuffles a prefix of it, recording the swaps
+	// in swaps, and undoes them.
+	perm  []uint32
+	swaps []uint32
+}
+
+// NewSetSketch returns an empty SetSketch with m registers, base b, rate a
+// and register limit q. m has to be >= 16 and <= 2^20, b > 1 and <= 16, a
+// positive and finite, and q >= 1 and <= 65534, otherwise an error wrapping
+// ErrorInvalidParameter is returned.
+func NewSetSketch(m int, b, a float64, q uint16) (*SetSketch, error) {
+	if err := checkSetSketch(m, b, a, q); err != nil {
+		return nil, err
+	}
+	return &SetSketch{b: b, a: a, q: q, regs: make([]uint16, m), lowCount: m}, nil
+}
+
+func checkSetSketch(m int, b, a float64, q uint16) error {
+	switch {
+	case m < minSetSketchM || m > maxSetSketchM:
+		return fmt.Errorf("hyperloglog: setsketch m %d outside [%d, %d]: %w", m, minSetSketchM, maxSetSketchM, ErrorInvalidParameter)
+	case !(b > 1 && b <= 16):
+		return fmt.Errorf("hyperloglog: setsketch base %g outside (1, 16]: %w", b, ErrorInvalidParameter)
+	case !(a > 0) || math.IsInf(a, 0):
+		return fmt.Errorf("hyperloglog: setsketch rate %g is not positive and finite: %w", a, ErrorInvalidParameter)
+	case q < 1 || q == math.MaxUint16:
+		return fmt.Errorf("hyperloglog: setsketch q %d outside [1, %d]: %w", q, math.MaxUint16-1, ErrorInvalidParameter)
+	}
+	return nil
+}
+
+// Clone returns a deep copy of s.
+func (s *SetSketch) Clone() *SetSketch {
+	clone := *s
+	clone.regs = slices.Clone(s.regs)
+	clone.perm, clone.swaps = nil, nil
+	return &clone
+}
+
+// Insert hashes e with the package's MetroHash64 seed and adds it to s.
+func (s *SetSketch) Insert(e []byte) { s.InsertHash(hash(e)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to s. The hash seeds the
+// random values the element draws, so the same hash always draws the same
+// values for the same register.
+func (s *SetSketch) InsertHash(x uint64) {
+	m := len(s.regs)
+	if s.perm == nil {
+		s.perm = make([]uint32, m)
+		s.swaps = make([]uint32, m)
+		for i := range s.perm {
+			s.perm[i] = uint32(i)
+		}
+	}
+	rng := splitMix64(x)
+	logB := math.Log(s.b)
+
+	// The m values are drawn in increasing order, as the spacings of m
+	// exponential order statistics, and dealt to the registers in a
+	// random order by a Fisher-Yates shuffle that is undone afterwards, so
+	// that the order only depends on the hash.
+	var v float64
+	j := 0
+	for ; j < m; j++ {
+		v += rng.exp() / (s.a * float64(m-j))
+		k := s.level(v, logB)
+		if k <= s.low {
+			break
+		}
+		r := uint32(j) + uint32(rng.below(uint64(m-j)))
+		s.swaps[j] = r
+		s.perm[j], s.perm[r] = s.perm[r], s.perm[j]
+		s.update(s.perm[j], k)
+	}
+	for j--; j >= 0; j-- {
+		r := s.swaps[j]
+		s.perm[j], s.perm[r] = s.perm[r], s.perm[j]
+	}
+}
+
+// level returns the register value of a drawn value v.
+func (s *SetSketch) level(v, logB float64) uint16 {
+	k := math.Floor(1 - math.Log(v)/logB)
+	switch {
+	case !(k > 0):
+		return 0
+	case k > float64(s.q):
+		return s.q + 1
+	}
+	return uint16(k)
+}
+
+func (s *SetSketch) update(i uint32, k uint16) {
+	old := s.regs[i]
+	if k <= old {
+		return
+	}
+	s.regs[i] = k
+	if old == s.low {
+		s.lowCount--
+		if s.lowCount == 0 {
+			s.recountLow()
+		}
+	}
+}
+
+func (s *SetSketch) recountLow() {
+	s.low = slices.Min(s.regs)
+	s.lowCount = 0
+	for _, v := range s.regs {
+		if v == s.low {
+			s.lowCount++
+		}
+	}
+}
+
+// Merge adds other to s. Both sketches must have the same m, b, a and q,
+// otherwise an error wrapping ErrorPrecisionMismatch is returned. A nil other
+// is treated as empty.
+func (s *SetSketch) Merge(other *SetSketch) error {
+	if other == nil {
+		return nil
+	}
+	if err := s.compatible(other); err != nil {
+		return err
+	}
+	for i, v := range other.regs {
+		s.regs[i] = max(s.regs[i], v)
+	}
+	s.recountLow()
+	return nil
+}
+
+func (s *SetSketch) compatible(other *SetSketch) error {
+	if len(s.regs) != len(other.regs) || s.b != other.b || s.a != other.a || s.q != other.q {
+		return fmt.Errorf("hyperloglog: cannot combine setsketch (m=%d, b=%g, a=%g, q=%d) with (m=%d, b=%g, a=%g, q=%d): %w",
+			len(s.regs), s.b, s.a, s.q, len(other.regs), other.b, other.a, other.q, ErrorPrecisionMismatch)
+	}
+	return nil
+}
+
+func (s *SetSketch) estimate() float64 {
+	var sum float64
+	for _, v := range s.regs {
+		sum += math.Pow(s.b, -float64(v))
+	}
+	m := float64(len(s.regs))
+	return m * (1 - 1/s.b) / (s.a * math.Log(s.b) * sum)
+}
+
+// Estimate returns the cardinality estimate.
+func (s *SetSketch) Estimate() uint64 {
+	return uint64(s.cardinality() + 0.5)
+}
+
+// relStdErr returns the relative standard error of the cardinality estimate.
+func (s *SetSketch) relStdErr() float64 {
+	b := s.b
+	return math.Sqrt((b+1)/(b-1)*math.Log(b)-1) / math.Sqrt(float64(len(s.regs)))
+}
+
+// Joint returns the joint estimate of the sets s (A) and other (B) have seen.
+// Registers where A is larger, where B is larger, and where both agree are
+// counted, and the intersection is the one that makes those counts most
+// likely given the cardinality estimates of A and B. The standard error of
+// the regions combines the uncertainty of that fit with the error of the
+// cardinality estimates.
+func (s *SetSketch) Joint(other *SetSketch) (JointEstimate, error) {
+	if err := s.compatible(other); err != nil {
+		return JointEstimate{}, err
+	}
+	var dPlus, dMinus, dZero float64
+	for i, v := range s.regs {
+		switch w := other.regs[i]; {
+		case v > w:
+			dPlus++
+		case v < w:
+			dMinus++
+		default:
+			dZero++
+		}
+	}
+
+	na, nb := s.cardinality(), other.cardinality()
+	// P(K_A > K_B) is close to p(|A\B| / |A∪B|).
+	p := func(x float64) float64 { return -math.Log1p(-x*(1-1/s.b)) / math.Log(s.b) }
+	ll := func(x float64) float64 {
+		u := na + nb - x
+		pa, pb := p((na-x)/u), p((nb-x)/u)
+		return xlogy(dPlus, pa) + xlogy(dMinus, pb) + xlogy(dZero, 1-pa-pb)
+	}
+	x, fitErr := maximizeIntersection(na, nb, ll)
+	return jointFromIntersection(na, nb, x, fitErr, s.relStdErr()), nil
+}
+
+func (s *SetSketch) cardinality() float64 {
+	if s.low == 0 && s.lowCount == len(s.regs) {
+		return 0
+	}
+	return s.estimate()
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (s *SetSketch) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil)
+}
+
+// AppendBinary implements the encoding.BinaryAppender interface. See
+// UnmarshalBinary for the format.
+func (s *SetSketch) AppendBinary(data []byte) ([]byte, error) {
+	if err := checkSetSketch(len(s.regs), s.b, s.a, s.q); err != nil {
+		return data, err
+	}
+	data = slices.Grow(data, 26+2*len(s.regs))
+	data = append(data, setSketchVersion, 0, 0, 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(s.regs)))
+	data = binary.BigEndian.AppendUint64(data, math.Float64bits(s.b))
+	data = binary.BigEndian.AppendUint64(data, math.Float64bits(s.a))
+	data = binary.BigEndian.AppendUint16(data, s.q)
+	for _, v := range s.regs {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+//
+// The format is a 4 byte header holding the version (1) and three reserved 0
+// bytes, followed by big endian fields: m as a uint32, b and a as IEEE 754
+// float64s, q as a uint16, and m uint16 registers, each at most q+1. The
+// parameters must be ones NewSetSketch accepts, and the buffer must end after
+// the last register.
+//
+// Errors wrap the package's exported sentinels and leave s unchanged.
+func (s *SetSketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 26 {
+		return fmt.Errorf("hyperloglog: setsketch header needs 26 bytes, have %d: %w", len(data), ErrorTooShort)
+	}
+	if data[0] != setSketchVersion {
+		return fmt.Errorf("hyperloglog: setsketch version %d: %w", data[0], ErrorInvalidVersion)
+	}
+	if data[1] != 0 || data[2] != 0 || data[3] != 0 {
+		return fmt.Errorf("hyperloglog: setsketch header bytes 1:4 are not zero: %w", ErrorInvalidData)
+	}
+	m := binary.BigEndian.Uint32(data[4:8])
+	b := math.Float64frombits(binary.BigEndian.Uint64(data[8:16]))
+	a := math.Float64frombits(binary.BigEndian.Uint64(data[16:24]))
+	q := binary.BigEndian.Uint16(data[24:26])
+	if err := checkSetSketch(int(m), b, a, q); err != nil {
+		return err
+	}
+	if err := exactLen("setsketch registers at offset 26", uint64(len(data)-26), 2*uint64(m)); err != nil {
+		return err
+	}
+
+	tmp, _ := NewSetSketch(int(m), b, a, q)
+	for i := range tmp.regs {
+		v := binary.BigEndian.Uint16(data[26+2*i:])
+		if v > q+1 {
+			return fmt.Errorf("hyperloglog: setsketch register %d = %d at offset %d, max %d: %w", i, v, 26+2*i, q+1, ErrorInvalidData)
+		}
+		tmp.regs[i] = v
+	}
+	tmp.recountLow()
+	*s = *tmp
+	return nil
+}
+
+// splitMix64 is Vigna's SplitMix64 generator. It is only used to derive
+// reproducible values from a hash, not for anything that needs strong
+// randomness.
+type splitMix64 uint64
+
+func (r *splitMix64) next() uint64 {
+	*r += 0x9e3779b97f4a7c15
+	z := uint64(*r)
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+// exp returns an exponentially distributed value with rate 1.
+func (r *splitMix64) exp() float64 {
+	// A uniform value in (0, 1].
+	u := math.Ldexp(float64(r.next()>>11+1), -53)
+	return -math.Log(u)
+}
+
+// below returns a value in [0, n), with a bias of at most n/2^64.
+func (r *splitMix64) below(n uint64) uint64 {
+	hi, _ := bits.Mul64(r.next(), n)
+	return hi
+}
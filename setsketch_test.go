@@ -0,0 +1,146 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetSketch_Error(t *testing.T) {
+	for _, tt := range []struct {
+		m    int
+		b, a float64
+		q    uint16
+	}{
+		{8, 2, 20, 62},
+		{1024, 1, 20, 62},
+		{1024, 2, 0, 62},
+		{1024, 2, 20, 0},
+		{1024, 2, 20, 65535},
+	} {
+		_, err := NewSetSketch(tt.m, tt.b, tt.a, tt.q)
+		require.ErrorIs(t, err, ErrorInvalidParameter, "%+v", tt)
+	}
+
+	a, _ := NewSetSketch(1024, 2, 20, 62)
+	b, _ := NewSetSketch(1024, 1.001, 20, 62)
+	require.ErrorIs(t, a.Merge(b), ErrorPrecisionMismatch)
+	_, err := a.Joint(b)
+	require.ErrorIs(t, err, ErrorPrecisionMismatch)
+}
+
+func TestSetSketch_Estimate(t *testing.T) {
+	for _, b := range []float64{1.001, 2} {
+		s, err := NewSetSketch(4096, b, 20, 62)
+		if b < 2 {
+			s, err = NewSetSketch(4096, b, 20, 65534)
+		}
+		require.NoError(t, err)
+		require.Zero(t, s.Estimate())
+
+		n := 0
+		for _, want := range []int{10, 1000, 100000, 1000000} {
+			for ; n < want; n++ {
+				s.InsertHash(rand.Uint64())
+			}
+			ratio := 100 * estimateError(s.Estimate(), uint64(n))
+			require.LessOrEqual(t, ratio, 10.0, "b=%g n=%d got %d", b, n, s.Estimate())
+		}
+		require.Equal(t, uint32(len(s.regs)), uint32(len(s.perm)))
+		for i, v := range s.perm {
+			require.EqualValues(t, i, v, "permutation not restored")
+		}
+	}
+}
+
+func TestSetSketch_Merge(t *testing.T) {
+	a, _ := NewSetSketch(256, 1.001, 20, 65534)
+	b := a.Clone()
+	all := a.Clone()
+	for i := 0; i < 20000; i++ {
+		x := rand.Uint64()
+		if i%3 == 0 {
+			a.InsertHash(x)
+		} else {
+			b.InsertHash(x)
+		}
+		all.InsertHash(x)
+	}
+	require.NoError(t, a.Merge(b))
+	require.Equal(t, all.regs, a.regs)
+	require.Equal(t, all.low, a.low)
+	require.Equal(t, all.lowCount, a.lowCount)
+}
+
+func TestSetSketch_Joint(t *testing.T) {
+	for _, tt := range []struct {
+		na, nb, shared int
+	}{
+		{100000, 100000, 50000},
+		{100000, 100000, 0},
+		{200000, 50000, 50000},
+		{100000, 60000, 10000},
+	} {
+		a, _ := NewSetSketch(4096, 1.001, 20, 65534)
+		b := a.Clone()
+		for i := 0; i < tt.shared; i++ {
+			x := rand.Uint64()
+			a.InsertHash(x)
+			b.InsertHash(x)
+		}
+		for i := tt.shared; i < tt.na; i++ {
+			a.InsertHash(rand.Uint64())
+		}
+		for i := tt.shared; i < tt.nb; i++ {
+			b.InsertHash(rand.Uint64())
+		}
+
+		j, err := a.Joint(b)
+		require.NoError(t, err)
+		union := float64(tt.na + tt.nb - tt.shared)
+		for _, r := range []struct {
+			name string
+			got  Bounded
+			want int
+		}{
+			{"intersection", j.Intersection, tt.shared},
+			{"a not b", j.AnotB, tt.na - tt.shared},
+			{"b not a", j.BnotA, tt.nb - tt.shared},
+		} {
+			require.InDelta(t, float64(r.want), r.got.Estimate, 0.03*union, "%s %+v", r.name, tt)
+			lo, hi := r.got.Bounds(4)
+			require.LessOrEqual(t, lo, float64(r.want), "%s %+v", r.name, tt)
+			require.GreaterOrEqual(t, hi, float64(r.want), "%s %+v", r.name, tt)
+		}
+		require.InDelta(t, j.A.Estimate, j.Intersection.Estimate+j.AnotB.Estimate, 1e-6)
+		require.InDelta(t, float64(tt.shared)/union, j.Jaccard(), 0.03)
+	}
+}
+
+func TestSetSketch_Marshal_Unmarshal(t *testing.T) {
+	s, _ := NewSetSketch(64, 2, 20, 62)
+	for i := 0; i < 1000; i++ {
+		s.InsertHash(rand.Uint64())
+	}
+	data, err := s.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, data, 26+2*64)
+
+	var res SetSketch
+	require.NoError(t, res.UnmarshalBinary(data))
+	require.Equal(t, s.regs, res.regs)
+	require.Equal(t, s.low, res.low)
+	require.Equal(t, s.Estimate(), res.Estimate())
+
+	require.ErrorIs(t, res.UnmarshalBinary(data[:len(data)-1]), ErrorTooShort)
+	require.ErrorIs(t, res.UnmarshalBinary(append(data, 0)), ErrorInvalidData)
+	bad := append([]byte(nil), data...)
+	bad[26], bad[27] = 0, 64 // q+1 = 63 is the largest register.
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidData)
+	bad[8] = 0 // b = 0.
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidParameter)
+	bad[0] = 2
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidVersion)
+	require.Equal(t, s.regs, res.regs)
+}
@@ -0,0 +1,149 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// A signed envelope is the magic "HLLM", the envelope version 1, a byte
+// holding the length of the key ID, the key ID, the sketch's binary encoding
+// as AppendBinary writes it, and the HMAC-SHA256 under the key of every byte
+// before it.
+const (
+	signedMagic      = "HLLM"
+	signedVersion    = 1
+	signedHeaderSize = len(signedMagic) + 2
+	minSigningKey    = 16
+)
+
+// ErrorSignature is returned, wrapped, when a signed envelope's HMAC does not
+// match its contents, so that it was modified or signed with another key. It
+// wraps ErrorInvalidData.
+var ErrorSignature = fmt.Errorf("signature mismatch: %w", ErrorInvalidData)
+
+// ErrorUnknownKey is returned, wrapped, when a signed envelope names a key ID
+// the Verifier does not hold. It wraps ErrorSignature.
+var ErrorUnknownKey = fmt.Errorf("unknown signing key: %w", ErrorSignature)
+
+// Signer wraps sketches in envelopes signed with HMAC-SHA256, so that a
+// Verifier holding the same key can tell whether they were modified. Use
+// NewSigner to create one. A Signer is safe for concurrent use.
+type Signer struct {
+	keyID string
+	key   []byte
+}
+
+// NewSigner returns a Signer that signs with key and names it keyID in every
+// envelope. The key has to be at least 16 bytes long and the key ID at most
+// 255 bytes, otherwise an error wrapping ErrorInvalidParameter is returned.
+// key is copied.
+//
+// To rotate keys, add the new key to every Verifier first, then sign with it,
+// and remove the old key once no envelope signed with it is in use.
+func NewSigner(keyID string, key []byte) (*Signer, error) {
+	if err := checkSigningKey(keyID, key); err != nil {
+		return nil, err
+	}
+	return &Signer{keyID: keyID, key: bytes.Clone(key)}, nil
+}
+
+func checkSigningKey(keyID string, key []byte) error {
+	if len(key) < minSigningKey {
+		return fmt.Errorf("hyperloglog: signing key %q of %d bytes, need %d: %w", keyID, len(key), minSigningKey, ErrorInvalidParameter)
+	}
+	if len(keyID) > 255 {
+		return fmt.Errorf("hyperloglog: signing key ID of %d bytes, max 255: %w", len(keyID), ErrorInvalidParameter)
+	}
+	return nil
+}
+
+// Sign returns sk in a signed envelope. See AppendSigned.
+func (s *Signer) Sign(sk *Sketch) ([]byte, error) {
+	return s.AppendSigned(nil, sk)
+}
+
+// AppendSigned appends sk in a signed envelope to data. As for AppendBinary, a
+// zero-value Sketch returns an error wrapping ErrorInvalidPrecision, and one
+// fed by another hash function than HashMetro an error wrapping
+// ErrorHashMismatch; data, including its spare capacity, is then left
+// unmodified.
+func (s *Signer) AppendSigned(data []byte, sk *Sketch) ([]byte, error) {
+	// Nothing is appended before sk is known to encode.
+	if err := sk.checkBinary(); err != nil {
+		return data, err
+	}
+	start := len(data)
+	data = append(data, signedMagic...)
+	data = append(data, signedVersion, byte(len(s.keyID)))
+	data = append(data, s.keyID...)
+	// sk was checked above.
+	data, _ = sk.appendBinary(data)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(data[start:])
+	return mac.Sum(data), nil
+}
+
+// Verifier checks and opens envelopes written by a Signer with any of the keys
+// it holds. Use NewVerifier to create one. A Verifier is safe for concurrent
+// use.
+type Verifier struct {
+	keys map[string][]byte
+}
+
+// NewVerifier returns a Verifier holding keys by key ID. Every key has to be
+// valid for NewSigner, otherwise an error wrapping ErrorInvalidParameter is
+// returned. keys is copied.
+func NewVerifier(keys map[string][]byte) (*Verifier, error) {
+	v := &Verifier{keys: make(map[string][]byte, len(keys))}
+	for keyID, key := range keys {
+		if err := checkSigningKey(keyID, key); err != nil {
+			return nil, err
+		}
+		v.keys[keyID] = bytes.Clone(key)
+	}
+	return v, nil
+}
+
+// Verify checks the signed envelope data and decodes the sketch it holds into
+// sk, returning the ID of the key it was signed with. The HMAC is checked
+// before the sketch is decoded, so a modified envelope never reaches
+// UnmarshalBinary.
+//
+// An envelope with another magic or version returns an error wrapping
+// ErrorInvalidData or ErrorInvalidVersion, one that is cut short ErrorTooShort,
+// one naming a key the Verifier does not hold ErrorUnknownKey, and one whose
+// HMAC does not match ErrorSignature. Errors decoding the sketch are returned
+// as UnmarshalBinary returns them. If an error is returned sk is left
+// unchanged.
+func (v *Verifier) Verify(data []byte, sk *Sketch) (string, error) {
+	if len(data) < signedHeaderSize {
+		return "", decodeError(0, "signed header", ErrorTooShort, "need %d bytes, have %d", signedHeaderSize, len(data))
+	}
+	if !bytes.HasPrefix(data, []byte(signedMagic)) {
+		return "", decodeError(0, "signed magic", ErrorInvalidData, "magic %q", data[:len(signedMagic)])
+	}
+	if data[4] != signedVersion {
+		return "", decodeError(4, "signed version", ErrorInvalidVersion, "version %d", data[4])
+	}
+	payload := signedHeaderSize + int(data[5])
+	if len(data) < payload+sha256.Size {
+		return "", decodeError(signedHeaderSize, "key ID", ErrorTooShort, "key ID of %d bytes and HMAC need %d bytes, have %d", data[5], payload+sha256.Size, len(data))
+	}
+	keyID := string(data[signedHeaderSize:payload])
+	key, ok := v.keys[keyID]
+	if !ok {
+		return "", decodeError(signedHeaderSize, "key ID", ErrorUnknownKey, "key ID %q", keyID)
+	}
+	body := data[:len(data)-sha256.Size]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), data[len(body):]) {
+		return "", decodeError(len(body), "HMAC", ErrorSignature, "key ID %q", keyID)
+	}
+	if err := sk.UnmarshalBinary(body[payload:]); err != nil {
+		return "", fmt.Errorf("hyperloglog: signed sketch at offset %d: %w", payload, err)
+	}
+	return keyID, nil
+}
@@ -0,0 +1,129 @@
+package hyperloglog
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigned(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+	oldSigner, err := NewSigner("2025-01", oldKey)
+	require.NoError(t, err)
+	newSigner, err := NewSigner("2025-02", newKey)
+	require.NoError(t, err)
+	v, err := NewVerifier(map[string][]byte{"2025-01": oldKey, "2025-02": newKey})
+	require.NoError(t, err)
+
+	for _, sparse := range []bool{true, false} {
+		sk := newSketchNoError(14, sparse)
+		for i := 0; i < 1000; i++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		for _, s := range []*Signer{oldSigner, newSigner} {
+			data, err := s.Sign(sk)
+			require.NoError(t, err)
+			require.Equal(t, []byte("HLLM\x01"), data[:5])
+			appended, err := s.AppendSigned([]byte{0xaa}, sk)
+			require.NoError(t, err)
+			require.Equal(t, append([]byte{0xaa}, data...), appended)
+
+			got := &Sketch{}
+			keyID, err := v.Verify(data, got)
+			require.NoError(t, err)
+			require.Equal(t, s.keyID, keyID)
+			require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+		}
+	}
+
+	// Keys are copied.
+	clear(newKey)
+	data, err := newSigner.Sign(New())
+	require.NoError(t, err)
+	_, err = v.Verify(data, &Sketch{})
+	require.NoError(t, err)
+
+	// After rotation, the old key no longer verifies.
+	v, err = NewVerifier(map[string][]byte{"2025-02": bytes.Repeat([]byte{2}, 16)})
+	require.NoError(t, err)
+	data, err = oldSigner.Sign(New())
+	require.NoError(t, err)
+	_, err = v.Verify(data, &Sketch{})
+	require.ErrorIs(t, err, ErrorUnknownKey)
+	require.ErrorIs(t, err, ErrorSignature)
+
+	_, err = oldSigner.Sign(&Sketch{})
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	// A failed append leaves the spare capacity alone too.
+	for _, tt := range []struct {
+		sk  *Sketch
+		err error
+	}{
+		{&Sketch{}, ErrorInvalidPrecision},
+		{NewRedis(), ErrorHashMismatch},
+	} {
+		buf := bytes.Repeat([]byte{0xee}, 64)
+		data, err := oldSigner.AppendSigned(buf[:1], tt.sk)
+		require.ErrorIs(t, err, tt.err)
+		require.Equal(t, buf[:1], data)
+		require.Equal(t, bytes.Repeat([]byte{0xee}, 64), buf)
+	}
+	_, err = NewSigner("short", make([]byte, 15))
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+	_, err = NewSigner(string(make([]byte, 256)), make([]byte, 16))
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+	_, err = NewVerifier(map[string][]byte{"a": nil})
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+}
+
+func TestSigned_Tampered(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	s, err := NewSigner("k", key)
+	require.NoError(t, err)
+	v, err := NewVerifier(map[string][]byte{"k": key, "j": bytes.Repeat([]byte{8}, 32)})
+	require.NoError(t, err)
+	sk := New()
+	for i := 0; i < 100; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+	data, err := s.Sign(sk)
+	require.NoError(t, err)
+
+	target := New()
+	target.InsertHash(1)
+	want := target.Fingerprint()
+	for i := range data {
+		corrupt := bytes.Clone(data)
+		corrupt[i] ^= 1 << rand.Intn(8)
+		_, err := v.Verify(corrupt, target)
+		switch {
+		case i < 4:
+			require.ErrorIs(t, err, ErrorInvalidData, "byte %d", i)
+		case i == 4:
+			require.ErrorIs(t, err, ErrorInvalidVersion, "byte %d", i)
+		default:
+			// The key ID may now name another key, or none.
+			require.ErrorIs(t, err, ErrorSignature, "byte %d", i)
+		}
+	}
+	for n := range len(data) {
+		_, err := v.Verify(data[:n], target)
+		require.Error(t, err, "cut at %d", n)
+	}
+	require.Equal(t, want, target.Fingerprint())
+
+	// A valid HMAC over an invalid sketch still fails to decode.
+	blob := bytes.Clone(data[:len(data)-sha256.Size])
+	blob[len("HLLM\x01\x01k")] = 9
+	mac := hmac.New(sha256.New, key)
+	mac.Write(blob)
+	blob = mac.Sum(blob)
+	_, err = v.Verify(blob, target)
+	require.ErrorIs(t, err, ErrorInvalidVersion)
+	require.Equal(t, want, target.Fingerprint())
+}
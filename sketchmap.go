@@ -0,0 +1,221 @@
+package hyperloglog
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// sketchMapEntryOverhead approximates the memory a key takes in a SketchMap
+// besides its Sketch's registers or sparse keys.
+const sketchMapEntryOverhead = 128
+
+// SketchMapPolicy is what a SketchMap does when it grows over its budget.
+type SketchMapPolicy int
+
+const (
+	// EvictLRU removes the least recently used keys.
+	EvictLRU SketchMapPolicy = iota
+	// FoldLargest folds the largest sketches to a lower precision, one step
+	// at a time, down to the configured minimum precision. When no sketch can
+	// be folded any further it removes the least recently used keys.
+	FoldLargest
+)
+
+// SketchMapConfig configures a SketchMap.
+type SketchMapConfig struct {
+	// Precision is the precision each key's Sketch starts with. 0 means 14.
+	Precision uint8
+	// MaxBytes is the memory budget for all keys together. It is compared
+	// against an approximation of the memory the sketches take.
+	MaxBytes int
+	// Policy is what the map does when it grows over MaxBytes.
+	Policy SketchMapPolicy
+	// MinPrecision is the lowest precision FoldLargest folds a sketch to. 0
+	// means 4.
+	MinPrecision uint8
+}
+
+// SketchMap keeps a Sketch per key within a global memory budget. Every key
+// starts out sparse, so keys with few distinct values stay small, and the map
+// tracks the size of each sketch as it grows and turns dense. Once the total
+// goes over the budget, the map evicts keys or folds sketches to a lower
+// precision according to its policy.
+//
+// The most recently used key is never evicted, so a map holding a single key
+// may exceed its budget. A SketchMap is not safe for concurrent use.
+type SketchMap[K comparable] struct {
+	cfg     SketchMapConfig
+	entries map[K]*sketchMapEntry[K]
+	// lru orders the entries from the most to the least recently used.
+	lru list.List
+	// foldable holds the entries above MinPrecision, largest first, when
+	// the policy is FoldLargest.
+	foldable sketchMapHeap[K]
+	size     int
+}
+
+type sketchMapEntry[K comparable] struct {
+	key  K
+	sk   *Sketch
+	size int
+	elem *list.Element
+	// index is the entry's position in foldable, or -1.
+	index int
+}
+
+// NewSketchMap returns an empty SketchMap. Precision and MinPrecision have to
+// be >= 4 and <= 18, and MinPrecision at most Precision, otherwise an error
+// wrapping ErrorInvalidPrecision is returned. A MaxBytes that is not positive
+// or an unknown Policy returns an error wrapping ErrorInvalidParameter.
+func NewSketchMap[K comparable](cfg SketchMapConfig) (*SketchMap[K], error) {
+	if cfg.Precision == 0 {
+		cfg.Precision = 14
+	}
+	if cfg.MinPrecision == 0 {
+		cfg.MinPrecision = 4
+	}
+	if checkPrecision(cfg.Precision) != nil || checkPrecision(cfg.MinPrecision) != nil || cfg.MinPrecision > cfg.Precision {
+		return nil, fmt.Errorf("hyperloglog: sketch map precision %d with minimum %d: %w", cfg.Precision, cfg.MinPrecision, ErrorInvalidPrecision)
+	}
+	if cfg.MaxBytes <= 0 {
+		return nil, fmt.Errorf("hyperloglog: sketch map budget %d bytes is not positive: %w", cfg.MaxBytes, ErrorInvalidParameter)
+	}
+	if cfg.Policy != EvictLRU && cfg.Policy != FoldLargest {
+		return nil, fmt.Errorf("hyperloglog: sketch map policy %d: %w", cfg.Policy, ErrorInvalidParameter)
+	}
+	return &SketchMap[K]{
+		cfg:     cfg,
+		entries: make(map[K]*sketchMapEntry[K]),
+	}, nil
+}
+
+// Insert hashes value with the package's MetroHash64 seed and adds it to the
+// sketch of key.
+func (m *SketchMap[K]) Insert(key K, value []byte) { m.InsertHash(key, hash(value)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to the sketch of key,
+// creating it if needed.
+func (m *SketchMap[K]) InsertHash(key K, x uint64) {
+	e, ok := m.entries[key]
+	if !ok {
+		e = &sketchMapEntry[K]{
+			key:   key,
+			sk:    newSketchNoError(m.cfg.Precision, true),
+			index: -1,
+		}
+		e.elem = m.lru.PushFront(e)
+		m.entries[key] = e
+		if m.cfg.Policy == FoldLargest && e.sk.p > m.cfg.MinPrecision {
+			heap.Push(&m.foldable, e)
+		}
+	} else {
+		m.lru.MoveToFront(e.elem)
+	}
+	e.sk.InsertHash(x)
+	m.resize(e)
+	m.enforce()
+}
+
+// Estimate returns the cardinality estimate of key's sketch, or 0 when the
+// map does not hold key. It counts as a use of key.
+func (m *SketchMap[K]) Estimate(key K) uint64 {
+	e, ok := m.entries[key]
+	if !ok {
+		return 0
+	}
+	m.lru.MoveToFront(e.elem)
+	// Estimate may compact the sketch's sparse state, or turn it dense.
+	est := e.sk.Estimate()
+	m.resize(e)
+	m.enforce()
+	return est
+}
+
+// Sketch returns a copy of key's sketch, or nil when the map does not hold
+// key. The copy is independent of m and its precision may be lower than the
+// configured one when the sketch was folded.
+func (m *SketchMap[K]) Sketch(key K) *Sketch {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	return e.sk.Clone()
+}
+
+// Delete removes key from m.
+func (m *SketchMap[K]) Delete(key K) {
+	if e, ok := m.entries[key]; ok {
+		m.remove(e)
+	}
+}
+
+// Len returns the number of keys m holds.
+func (m *SketchMap[K]) Len() int { return len(m.entries) }
+
+// Size returns the approximate memory in bytes all keys take, which is what
+// m keeps within MaxBytes.
+func (m *SketchMap[K]) Size() int { return m.size }
+
+func (m *SketchMap[K]) resize(e *sketchMapEntry[K]) {
+	size := sketchMapEntryOverhead + e.sk.sizeInBytes()
+	m.size += size - e.size
+	e.size = size
+	if e.index >= 0 {
+		heap.Fix(&m.foldable, e.index)
+	}
+}
+
+func (m *SketchMap[K]) remove(e *sketchMapEntry[K]) {
+	if e.index >= 0 {
+		heap.Remove(&m.foldable, e.index)
+	}
+	m.lru.Remove(e.elem)
+	delete(m.entries, e.key)
+	m.size -= e.size
+}
+
+// enforce brings m back within its budget.
+func (m *SketchMap[K]) enforce() {
+	for m.size > m.cfg.MaxBytes {
+		if len(m.foldable) > 0 {
+			e := m.foldable[0]
+			// Fold cannot fail: the entry is above MinPrecision.
+			_ = e.sk.Fold(e.sk.p - 1)
+			if e.sk.p == m.cfg.MinPrecision {
+				heap.Remove(&m.foldable, e.index)
+			}
+			m.resize(e)
+			continue
+		}
+		if m.lru.Len() <= 1 {
+			return
+		}
+		m.remove(m.lru.Back().Value.(*sketchMapEntry[K]))
+	}
+}
+
+// sketchMapHeap orders entries from the largest to the smallest.
+type sketchMapHeap[K comparable] []*sketchMapEntry[K]
+
+func (h sketchMapHeap[K]) Len() int           { return len(h) }
+func (h sketchMapHeap[K]) Less(i, j int) bool { return h[i].size > h[j].size }
+func (h sketchMapHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sketchMapHeap[K]) Push(x any) {
+	e := x.(*sketchMapEntry[K])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *sketchMapHeap[K]) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,95 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketchMap_Error(t *testing.T) {
+	for _, cfg := range []SketchMapConfig{
+		{Precision: 19, MaxBytes: 1},
+		{Precision: 10, MinPrecision: 12, MaxBytes: 1},
+		{MinPrecision: 3, MaxBytes: 1},
+	} {
+		_, err := NewSketchMap[string](cfg)
+		require.ErrorIs(t, err, ErrorInvalidPrecision, "%+v", cfg)
+	}
+	_, err := NewSketchMap[string](SketchMapConfig{})
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+	_, err = NewSketchMap[string](SketchMapConfig{MaxBytes: 1, Policy: 2})
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+}
+
+func TestSketchMap_EvictLRU(t *testing.T) {
+	m, err := NewSketchMap[int](SketchMapConfig{MaxBytes: 1 << 20})
+	require.NoError(t, err)
+
+	// Small keys stay sparse and many fit.
+	for key := 0; key < 1000; key++ {
+		for i := 0; i < 10; i++ {
+			m.InsertHash(key, rand.Uint64())
+		}
+	}
+	require.Equal(t, 1000, m.Len())
+	require.EqualValues(t, 10, m.Estimate(0))
+
+	// Dense keys take 16 KB each, so the oldest keys make room for them.
+	for key := 1000; key < 1100; key++ {
+		for i := 0; i < 20000; i++ {
+			m.InsertHash(key, rand.Uint64())
+		}
+		require.LessOrEqual(t, m.Size(), 1<<20)
+	}
+	require.Less(t, m.Len(), 100)
+	require.Zero(t, m.Estimate(1))
+	require.Nil(t, m.Sketch(1))
+	require.LessOrEqual(t, 100*estimateError(m.Estimate(1099), 20000), 3.0)
+
+	var total int
+	for _, e := range m.entries {
+		total += e.size
+		require.Equal(t, sketchMapEntryOverhead+e.sk.sizeInBytes(), e.size)
+	}
+	require.Equal(t, total, m.Size())
+
+	m.Delete(1099)
+	require.Zero(t, m.Estimate(1099))
+	require.Equal(t, total-sketchMapEntryOverhead-(1<<14), m.Size())
+}
+
+func TestSketchMap_FoldLargest(t *testing.T) {
+	m, err := NewSketchMap[string](SketchMapConfig{
+		MaxBytes:     64 << 10,
+		Policy:       FoldLargest,
+		MinPrecision: 10,
+	})
+	require.NoError(t, err)
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		for i := 0; i < 100000; i++ {
+			m.InsertHash(key, rand.Uint64())
+		}
+		require.LessOrEqual(t, m.Size(), 64<<10)
+	}
+	// Folding keeps every key, at a lower precision.
+	require.Equal(t, len(keys), m.Len())
+	for _, key := range keys {
+		sk := m.Sketch(key)
+		require.Less(t, sk.p, uint8(14))
+		require.GreaterOrEqual(t, sk.p, uint8(10))
+		require.LessOrEqual(t, 100*estimateError(m.Estimate(key), 100000), 10.0, key)
+	}
+
+	// Once every sketch is at the minimum precision, keys are evicted.
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10000; j++ {
+			m.InsertHash(string(rune('A'+i)), rand.Uint64())
+		}
+	}
+	require.LessOrEqual(t, m.Size(), 64<<10)
+	require.Less(t, m.Len(), 64)
+	require.Empty(t, m.foldable)
+}
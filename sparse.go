@@ -1,7 +1,6 @@
 package hyperloglog
 
 import (
-	"fmt"
 	"math/bits"
 	"slices"
 
@@ -38,11 +37,12 @@ func decodeHash(k uint32, p, pp uint8) (uint32, uint8) {
 	return getIndex(k, p, pp), r
 }
 
-// checkSparseKey requires p to have passed checkPrecision.
-func checkSparseKey(k uint32, p uint8) error {
+// checkSparseKey checks the sparse key k decoded from the field at offset off.
+// It requires p to have passed checkPrecision.
+func checkSparseKey(k uint32, p uint8, off int, field string) error {
 	maxRho := maxRho(p)
 	if _, r := decodeHash(k, p, pp); r > maxRho {
-		return fmt.Errorf("hyperloglog: sparse key %#08x decodes to rho %d, max %d: %w", k, r, maxRho, ErrorInvalidData)
+		return decodeError(off, field, ErrorInvalidData, "sparse key %#08x decodes to rho %d, max %d", k, r, maxRho)
 	}
 	return nil
 }
@@ -0,0 +1,92 @@
+package hyperloglog
+
+import (
+	"database/sql/driver"
+	"fmt"
+)
+
+// Scan implements the sql.Scanner interface, for sketches stored in binary
+// columns such as Postgres bytea or SQLite BLOB. NULL scans to a zero-value
+// Sketch, and []byte or string is decoded as by UnmarshalBinary, which copies
+// it. Any other type returns an error wrapping ErrorInvalidData. If an error
+// is returned sk is left unchanged.
+func (sk *Sketch) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*sk = Sketch{}
+		return nil
+	case []byte:
+		return sk.UnmarshalBinary(src)
+	case string:
+		return sk.UnmarshalBinary([]byte(src))
+	}
+	return fmt.Errorf("hyperloglog: cannot scan %T into a Sketch: %w", src, ErrorInvalidData)
+}
+
+// Value implements the driver.Valuer interface, encoding sk as MarshalBinary
+// does, so a *Sketch query argument is always stored in version 2. A nil or
+// zero-value Sketch is NULL. Value has a pointer receiver, so pass a *Sketch
+// as the query argument. To store version 3, pass NullSketch{Sketch: sk,
+// Valid: true, Version: 3} instead, which sets the version per value.
+func (sk *Sketch) Value() (driver.Value, error) {
+	return sqlValue(sk, version)
+}
+
+// sqlValue encodes sk in the binary format version v, 2 or 3.
+func sqlValue(sk *Sketch, v uint8) (driver.Value, error) {
+	if sk == nil || sk.p == 0 {
+		return nil, nil
+	}
+	switch v {
+	case version:
+		return sk.MarshalBinary()
+	case versionV3:
+		return sk.MarshalBinaryV3()
+	default:
+		return nil, fmt.Errorf("hyperloglog: SQL format version %d: %w", v, ErrorInvalidVersion)
+	}
+}
+
+// NullSketch is a Sketch that may be NULL, for struct fields mapped to
+// nullable columns. It implements sql.Scanner and driver.Valuer as sql.Null
+// does: Valid is false for NULL, and Sketch is then nil.
+type NullSketch struct {
+	Sketch *Sketch
+	Valid  bool
+	// Version is the binary format version Value writes: 0 or 2 for
+	// AppendBinary, or 3 for AppendBinaryV3. Scan reads every version
+	// UnmarshalBinary does, so a column can hold both while it is migrated,
+	// and leaves Version unchanged.
+	Version uint8
+}
+
+// Scan implements the sql.Scanner interface. A value other than NULL is
+// scanned into a new Sketch as by Sketch.Scan. If an error is returned n is
+// left unchanged.
+func (n *NullSketch) Scan(src any) error {
+	if src == nil {
+		n.Sketch, n.Valid = nil, false
+		return nil
+	}
+	sk := &Sketch{}
+	if err := sk.Scan(src); err != nil {
+		return err
+	}
+	n.Sketch, n.Valid = sk, true
+	return nil
+}
+
+// Value implements the driver.Valuer interface. It is NULL when n is not
+// Valid or its Sketch is nil or zero, and the Sketch encoded in n's Version
+// otherwise. A Version other than 0, 2 or 3 returns an error wrapping
+// ErrorInvalidVersion.
+func (n NullSketch) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	v := n.Version
+	if v == 0 {
+		v = version
+	}
+	return sqlValue(n.Sketch, v)
+}
@@ -0,0 +1,97 @@
+package hyperloglog
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ sql.Scanner   = (*Sketch)(nil)
+	_ driver.Valuer = (*Sketch)(nil)
+	_ sql.Scanner   = (*NullSketch)(nil)
+	_ driver.Valuer = NullSketch{}
+)
+
+func TestHLL_SQL(t *testing.T) {
+	sk := New()
+	for i := 0; i < 1000; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+
+	for _, v := range []uint8{0, 2, 3} {
+		value, err := NullSketch{Sketch: sk, Valid: true, Version: v}.Value()
+		require.NoError(t, err)
+		if v == 0 {
+			sv, err := sk.Value()
+			require.NoError(t, err)
+			require.Equal(t, sv, value)
+			v = 2
+		}
+		require.True(t, driver.IsValue(value))
+		data := value.([]byte)
+		require.Equal(t, v, data[0])
+
+		got := &Sketch{}
+		require.NoError(t, got.Scan(string(data)))
+		require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+		got = &Sketch{}
+		require.NoError(t, got.Scan(data))
+		require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+		// Drivers may reuse the buffer they scan from.
+		clear(data)
+		require.Equal(t, sk.Fingerprint(), got.Fingerprint())
+	}
+	_, err := NullSketch{Sketch: sk, Valid: true, Version: 4}.Value()
+	require.ErrorIs(t, err, ErrorInvalidVersion)
+
+	value, err := (&Sketch{}).Value()
+	require.NoError(t, err)
+	require.Nil(t, value)
+	// database/sql converts arguments this way, calling Value on a nil
+	// *Sketch.
+	value, err = driver.DefaultParameterConverter.ConvertValue((*Sketch)(nil))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.NoError(t, sk.Scan(nil))
+	require.Zero(t, sk.p)
+
+	sk.InsertHash(1)
+	want := sk.Fingerprint()
+	require.ErrorIs(t, sk.Scan(int64(1)), ErrorInvalidData)
+	require.ErrorIs(t, sk.Scan([]byte{2}), ErrorTooShort)
+	require.Equal(t, want, sk.Fingerprint())
+}
+
+func TestHLL_NullSketch(t *testing.T) {
+	sk := New()
+	sk.InsertHash(1)
+	data, err := sk.MarshalBinary()
+	require.NoError(t, err)
+
+	n := NullSketch{Version: 3}
+	require.NoError(t, n.Scan(data))
+	require.True(t, n.Valid)
+	require.Equal(t, uint8(3), n.Version)
+	n.Version = 0
+	require.Equal(t, sk.Fingerprint(), n.Sketch.Fingerprint())
+	value, err := n.Value()
+	require.NoError(t, err)
+	require.Equal(t, data, value)
+
+	require.ErrorIs(t, n.Scan(true), ErrorInvalidData)
+	require.True(t, n.Valid)
+
+	require.NoError(t, n.Scan(nil))
+	require.False(t, n.Valid)
+	require.Nil(t, n.Sketch)
+	value, err = n.Value()
+	require.NoError(t, err)
+	require.Nil(t, value)
+	value, err = NullSketch{Valid: true}.Value()
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
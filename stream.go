@@ -0,0 +1,263 @@
+package hyperloglog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// streamMagic starts a stream of sketches, followed by the stream version.
+const (
+	streamMagic   = "HLLS"
+	streamVersion = 1
+)
+
+// streamKeyed is the flag of a record that has a key.
+const streamKeyed = 1
+
+// ErrorLimitExceeded is returned, wrapped, when decoding would exceed a limit
+// the caller set in StreamLimits or DecodeOptions.
+var ErrorLimitExceeded = errors.New("decode limit exceeded")
+
+// Encoder writes a stream of sketches, each optionally with a key, that a
+// Decoder reads back. The stream starts with the magic "HLLS" and a version
+// byte, 1, written with the first record. Each record is a flags byte, whose
+// bit 0 is set when the record has a key and whose other bits are clear, the
+// key as a uvarint length and its bytes when there is one, and the version 3
+// encoding of the sketch (see AppendBinaryV3) as a uvarint length and its
+// bytes. An empty stream has no bytes at all.
+//
+// Each record is written with a single Write call; wrap w in a bufio.Writer to
+// batch them. An Encoder is not safe for concurrent use.
+type Encoder struct {
+	w io.Writer
+	// buf holds the record being written and sketch the encoding of its
+	// sketch. Both are reused across records.
+	buf, sketch []byte
+	started     bool
+	err         error
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes sk as a record without a key. A zero-value Sketch returns an
+// error wrapping ErrorInvalidPrecision and writes nothing. Once w has failed,
+// every call returns its error.
+func (e *Encoder) Encode(sk *Sketch) error {
+	return e.encode(nil, false, sk)
+}
+
+// EncodeKeyed writes sk as a record with key, which may be empty. See Encode.
+func (e *Encoder) EncodeKeyed(key []byte, sk *Sketch) error {
+	return e.encode(key, true, sk)
+}
+
+func (e *Encoder) encode(key []byte, keyed bool, sk *Sketch) error {
+	if e.err != nil {
+		return e.err
+	}
+	buf := e.buf[:0]
+	if !e.started {
+		buf = append(buf, streamMagic...)
+		buf = append(buf, streamVersion)
+	}
+	if keyed {
+		buf = append(buf, streamKeyed)
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+	} else {
+		buf = append(buf, 0)
+	}
+	data, err := sk.AppendBinaryV3(e.sketch[:0])
+	if err != nil {
+		return err
+	}
+	e.sketch = data
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	buf = append(buf, data...)
+	e.buf = buf
+
+	if _, err := e.w.Write(buf); err != nil {
+		e.err = fmt.Errorf("hyperloglog: writing stream: %w", err)
+		return e.err
+	}
+	e.started = true
+	return nil
+}
+
+// StreamLimits bounds what a Decoder reads, so that a stream from an
+// untrusted source cannot make it allocate without bound. A zero field takes
+// its default.
+type StreamLimits struct {
+	// MaxKeyBytes bounds the length of a record's key. The default is 64
+	// KiB.
+	MaxKeyBytes int
+	// MaxSketchBytes bounds the length of a record's sketch encoding. The
+	// default is 1 MiB, more than any precision needs.
+	MaxSketchBytes int
+}
+
+const (
+	defaultMaxKeyBytes    = 64 << 10
+	defaultMaxSketchBytes = 1 << 20
+)
+
+// Decoder reads a stream of sketches written by an Encoder. A Decoder is not
+// safe for concurrent use.
+type Decoder struct {
+	r      *bufio.Reader
+	limits StreamLimits
+	opts   DecodeOptions
+	buf    []byte
+	// records counts the records read, to locate errors.
+	records int
+	started bool
+	err     error
+}
+
+// NewDecoder returns a Decoder reading from r with the default limits. The
+// Decoder buffers its reads and may read data from r beyond the records it
+// returns.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &Decoder{r: br}
+	d.SetLimits(StreamLimits{})
+	return d
+}
+
+// SetLimits replaces the Decoder's limits for the records that follow.
+func (d *Decoder) SetLimits(limits StreamLimits) {
+	if limits.MaxKeyBytes <= 0 {
+		limits.MaxKeyBytes = defaultMaxKeyBytes
+	}
+	if limits.MaxSketchBytes <= 0 {
+		limits.MaxSketchBytes = defaultMaxSketchBytes
+	}
+	d.limits = limits
+}
+
+// SetDecodeOptions restricts the sketches of the records that follow, as
+// UnmarshalBinaryWithOptions does. The zero value, the default, restricts
+// nothing beyond the format.
+func (d *Decoder) SetDecodeOptions(opts DecodeOptions) {
+	d.opts = opts
+}
+
+// Decode reads the next record into sk, discarding its key, if any. It
+// returns io.EOF when the stream ends cleanly between records. See
+// DecodeKeyed.
+func (d *Decoder) Decode(sk *Sketch) error {
+	_, err := d.DecodeKeyed(sk)
+	return err
+}
+
+// DecodeKeyed reads the next record into sk and returns its key, or nil if it
+// has none. It returns io.EOF when the stream ends cleanly between records.
+//
+// The sketch is decoded as by UnmarshalBinaryWithOptions with the Decoder's
+// DecodeOptions, and its errors are returned wrapped. A stream that ends inside a record returns an error wrapping
+// ErrorTooShort, a malformed header or flags byte one wrapping ErrorInvalidData
+// or ErrorInvalidVersion, and a key or sketch longer than the limits one
+// wrapping ErrorLimitExceeded. sk is left unchanged on error, and once an
+// error other than io.EOF is returned the stream cannot be resynchronized, so
+// every later call returns it too.
+func (d *Decoder) DecodeKeyed(sk *Sketch) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	key, err := d.decode(sk)
+	if err != nil {
+		d.err = err
+		return nil, err
+	}
+	d.records++
+	return key, nil
+}
+
+func (d *Decoder) decode(sk *Sketch) ([]byte, error) {
+	if !d.started {
+		header := make([]byte, len(streamMagic)+1)
+		if n, err := io.ReadFull(d.r, header); err != nil {
+			if n == 0 && err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, d.readError("stream header", err)
+		}
+		if !bytes.Equal(header[:len(streamMagic)], []byte(streamMagic)) {
+			return nil, fmt.Errorf("hyperloglog: stream magic %q: %w", header[:len(streamMagic)], ErrorInvalidData)
+		}
+		if v := header[len(streamMagic)]; v != streamVersion {
+			return nil, fmt.Errorf("hyperloglog: stream version %d: %w", v, ErrorInvalidVersion)
+		}
+		d.started = true
+	}
+
+	flags, err := d.r.ReadByte()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, d.readError("flags", err)
+	}
+	if flags&^streamKeyed != 0 {
+		return nil, fmt.Errorf("hyperloglog: stream record %d flags %#x: %w", d.records, flags, ErrorInvalidData)
+	}
+
+	var key []byte
+	if flags&streamKeyed != 0 {
+		if key, err = d.readField("key", d.limits.MaxKeyBytes, nil); err != nil {
+			return nil, err
+		}
+		if key == nil {
+			key = []byte{}
+		}
+	}
+	if d.buf, err = d.readField("sketch", d.limits.MaxSketchBytes, d.buf[:0]); err != nil {
+		return nil, err
+	}
+	if err := sk.UnmarshalBinaryWithOptions(d.buf, d.opts); err != nil {
+		return nil, fmt.Errorf("hyperloglog: stream record %d: %w", d.records, err)
+	}
+	return key, nil
+}
+
+// readField reads a uvarint length of at most limit and that many bytes,
+// appended to buf.
+func (d *Decoder) readField(what string, limit int, buf []byte) ([]byte, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, d.readError(what+" length", err)
+		}
+		return nil, fmt.Errorf("hyperloglog: stream record %d %s length: %v: %w", d.records, what, err, ErrorInvalidData)
+	}
+	if n > uint64(limit) {
+		return nil, fmt.Errorf("hyperloglog: stream record %d %s of %d bytes, limit %d: %w", d.records, what, n, limit, ErrorLimitExceeded)
+	}
+	start := len(buf)
+	buf = slices.Grow(buf, int(n))[:start+int(n)]
+	if _, err := io.ReadFull(d.r, buf[start:]); err != nil {
+		return nil, d.readError(what, err)
+	}
+	return buf, nil
+}
+
+// readError wraps an error reading what: an input that ends early wraps
+// ErrorTooShort, and any other error from the reader is returned wrapped as
+// it is.
+func (d *Decoder) readError(what string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("hyperloglog: stream record %d %s: %w", d.records, what, ErrorTooShort)
+	}
+	return fmt.Errorf("hyperloglog: stream record %d %s: %w", d.records, what, err)
+}
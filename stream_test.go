@@ -0,0 +1,144 @@
+package hyperloglog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+type streamRecord struct {
+	key []byte
+	sk  *Sketch
+}
+
+func writeStream(t *testing.T, records []streamRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, r := range records {
+		if r.key == nil {
+			require.NoError(t, enc.Encode(r.sk))
+		} else {
+			require.NoError(t, enc.EncodeKeyed(r.key, r.sk))
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	var records []streamRecord
+	for i := 0; i < 200; i++ {
+		sk := newSketchNoError(uint8(4+i%15), i%3 != 0)
+		for j := 0; j < rand.Intn(3000); j++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		var key []byte
+		switch i % 4 {
+		case 1:
+			key = []byte{}
+		case 2, 3:
+			key = []byte{byte(i), 'k', byte(i >> 8)}
+		}
+		records = append(records, streamRecord{key, sk})
+	}
+	data := writeStream(t, records)
+	require.Equal(t, []byte("HLLS\x01"), data[:5])
+
+	// A one-byte reader exercises every partial read.
+	dec := NewDecoder(iotest.OneByteReader(bytes.NewReader(data)))
+	for i, want := range records {
+		got := &Sketch{}
+		key, err := dec.DecodeKeyed(got)
+		require.NoError(t, err, "record %d", i)
+		require.Equal(t, want.key, key, "record %d", i)
+		require.Equal(t, want.sk.sparse(), got.sparse())
+		require.Equal(t, denseRegs(want.sk), denseRegs(got))
+	}
+	require.ErrorIs(t, dec.Decode(&Sketch{}), io.EOF)
+	require.ErrorIs(t, dec.Decode(&Sketch{}), io.EOF)
+
+	require.Empty(t, writeStream(t, nil))
+	require.ErrorIs(t, NewDecoder(bytes.NewReader(nil)).Decode(&Sketch{}), io.EOF)
+	require.ErrorIs(t, NewDecoder(bytes.NewReader([]byte("HLLS\x01"))).Decode(&Sketch{}), io.EOF)
+
+	br := bufio.NewReader(bytes.NewReader(data))
+	require.Same(t, br, NewDecoder(br).r)
+}
+
+func TestStream_Errors(t *testing.T) {
+	sk := New()
+	for i := 0; i < 100; i++ {
+		sk.InsertHash(rand.Uint64())
+	}
+	data := writeStream(t, []streamRecord{{[]byte("a"), sk}, {nil, sk}})
+
+	// Cutting the stream anywhere but between records is too short.
+	first := len(writeStream(t, []streamRecord{{[]byte("a"), sk}}))
+	for n := 1; n < len(data); n++ {
+		dec := NewDecoder(bytes.NewReader(data[:n]))
+		var err error
+		for err == nil {
+			err = dec.Decode(&Sketch{})
+		}
+		if n == 5 || n == first {
+			require.ErrorIs(t, err, io.EOF, "cut at %d", n)
+			continue
+		}
+		require.ErrorIs(t, err, ErrorTooShort, "cut at %d", n)
+		// Errors are sticky.
+		require.Equal(t, err, dec.Decode(&Sketch{}))
+	}
+
+	target := New()
+	target.InsertHash(1)
+	want := target.Clone()
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"magic", append([]byte("HLLX\x01"), data[5:]...), ErrorInvalidData},
+		{"version", append([]byte("HLLS\x02"), data[5:]...), ErrorInvalidVersion},
+		{"flags", []byte("HLLS\x01\x02"), ErrorInvalidData},
+		{"key length", []byte("HLLS\x01\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"), ErrorInvalidData},
+		{"key limit", []byte("HLLS\x01\x01\xff\xff\x7f"), ErrorLimitExceeded},
+		{"sketch limit", []byte("HLLS\x01\x00\xff\xff\xff\x7f"), ErrorLimitExceeded},
+		{"sketch", []byte("HLLS\x01\x00\x08\x03\x0e\x00\x01\x00\x00\x00\x00"), ErrorChecksum},
+	} {
+		dec := NewDecoder(bytes.NewReader(tt.data))
+		require.ErrorIs(t, dec.Decode(target), tt.err, tt.name)
+		require.Equal(t, want.Fingerprint(), target.Fingerprint(), tt.name)
+	}
+
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.SetLimits(StreamLimits{MaxKeyBytes: 1, MaxSketchBytes: 100})
+	require.ErrorIs(t, dec.Decode(&Sketch{}), ErrorLimitExceeded)
+	dec = NewDecoder(bytes.NewReader(data))
+	dec.SetLimits(StreamLimits{MaxKeyBytes: 1})
+	require.NoError(t, dec.Decode(&Sketch{}))
+	dec.SetDecodeOptions(DecodeOptions{RejectSparse: true})
+	err := dec.Decode(&Sketch{})
+	require.ErrorIs(t, err, ErrorLimitExceeded)
+	var de *DecodeError
+	require.ErrorAs(t, err, &de)
+
+	readErr := errors.New("disk on fire")
+	dec = NewDecoder(iotest.ErrReader(readErr))
+	require.ErrorIs(t, dec.Decode(&Sketch{}), readErr)
+
+	enc := NewEncoder(io.Discard)
+	require.ErrorIs(t, enc.Encode(&Sketch{}), ErrorInvalidPrecision)
+	enc = NewEncoder(failingWriter{readErr})
+	require.ErrorIs(t, enc.Encode(sk), readErr)
+	require.ErrorIs(t, enc.EncodeKeyed(nil, sk), readErr)
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
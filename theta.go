@@ -0,0 +1,274 @@
+package hyperloglog
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/kamstrup/intmap"
+)
+
+const (
+	thetaVersion = 1
+	minThetaK    = 16
+	maxThetaK    = 1 << 26
+)
+
+// ThetaSketch is a Theta sketch in its K Minimum Values (KMV) form: it
+// retains the k smallest hashes it has seen, and theta, the bound below which
+// every retained hash lies. Unlike a Sketch, two Theta sketches can be
+// intersected and subtracted, with an error that only depends on how many
+// hashes survive the operation.
+//
+// Insert uses the same MetroHash64 seed as Sketch.Insert, so one hash per
+// element can feed both. Use NewTheta to create one; the zero value is not
+// usable.
+type ThetaSketch struct {
+	k int
+	// theta is the exclusive upper bound of the retained hashes, as a
+	// fraction of 2^64. It starts at math.MaxUint64, so a new sketch
+	// samples every hash but math.MaxUint64 itself, a fraction that rounds
+	// to 1.
+	theta   uint64
+	entries maxHeap
+	set     *intmap.Set[uint64]
+}
+
+// NewTheta returns an empty Theta sketch that retains up to k hashes. k has to
+// be >= 16 and <= 2^26, otherwise an error wrapping ErrorInvalidParameter is
+// returned. The relative standard error of an estimate is about 1/sqrt(k).
+func NewTheta(k int) (*ThetaSketch, error) {
+	if k < minThetaK || k > maxThetaK {
+		return nil, fmt.Errorf("hyperloglog: theta k %d outside [%d, %d]: %w", k, minThetaK, maxThetaK, ErrorInvalidParameter)
+	}
+	return newTheta(k, math.MaxUint64, 0), nil
+}
+
+func newTheta(k int, theta uint64, n int) *ThetaSketch {
+	return &ThetaSketch{
+		k:       k,
+		theta:   theta,
+		entries: make(maxHeap, 0, n),
+		set:     intmap.NewSet[uint64](n),
+	}
+}
+
+// Clone returns a deep copy of t.
+func (t *ThetaSketch) Clone() *ThetaSketch {
+	clone := newTheta(t.k, t.theta, len(t.entries))
+	for _, x := range t.entries {
+		clone.add(x)
+	}
+	return clone
+}
+
+// Insert hashes e with the package's MetroHash64 seed and adds it to t.
+func (t *ThetaSketch) Insert(e []byte) { t.InsertHash(hash(e)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to t. Theta is an
+// exclusive bound from the start, so the hash math.MaxUint64 is never
+// retained.
+func (t *ThetaSketch) InsertHash(x uint64) {
+	if x >= t.theta || t.set.Has(x) {
+		return
+	}
+	t.add(x)
+	t.trim()
+}
+
+// add requires x < t.theta and x not yet retained.
+func (t *ThetaSketch) add(x uint64) {
+	t.set.Add(x)
+	heap.Push(&t.entries, x)
+}
+
+// trim discards the largest hashes until at most k remain, lowering theta to
+// the last one discarded.
+func (t *ThetaSketch) trim() {
+	for len(t.entries) > t.k {
+		x := heap.Pop(&t.entries).(uint64)
+		t.set.Del(x)
+		t.theta = x
+	}
+}
+
+// Merge adds other to t, keeping t's k. The union of two Theta sketches is
+// exact up to the smaller of their thetas.
+func (t *ThetaSketch) Merge(other *ThetaSketch) {
+	if other == nil {
+		return
+	}
+	if other.theta < t.theta {
+		t.lowerTheta(other.theta)
+	}
+	for _, x := range other.entries {
+		if x < t.theta && !t.set.Has(x) {
+			t.add(x)
+		}
+	}
+	t.trim()
+}
+
+func (t *ThetaSketch) lowerTheta(theta uint64) {
+	t.theta = theta
+	kept := t.entries[:0]
+	for _, x := range t.entries {
+		if x < theta {
+			kept = append(kept, x)
+		} else {
+			t.set.Del(x)
+		}
+	}
+	t.entries = kept
+	heap.Init(&t.entries)
+}
+
+// ThetaIntersection returns a sketch of the elements both a and b have seen.
+func ThetaIntersection(a, b *ThetaSketch) *ThetaSketch {
+	return thetaFilter(a, b, true)
+}
+
+// ThetaAnotB returns a sketch of the elements a has seen and b has not.
+func ThetaAnotB(a, b *ThetaSketch) *ThetaSketch {
+	return thetaFilter(a, b, false)
+}
+
+// thetaFilter keeps the hashes of a below both thetas that b does, or does
+// not, retain. Below the smaller theta both sketches are exact samples, so
+// membership in b is decided correctly.
+func thetaFilter(a, b *ThetaSketch, inB bool) *ThetaSketch {
+	res := newTheta(max(a.k, b.k), min(a.theta, b.theta), 0)
+	for _, x := range a.entries {
+		if x < res.theta && b.set.Has(x) == inB {
+			res.add(x)
+		}
+	}
+	return res
+}
+
+// Theta returns the fraction of the hash space t still samples. It is 1 until
+// t has discarded a hash.
+func (t *ThetaSketch) Theta() float64 {
+	// math.MaxUint64 rounds to 2^64.
+	return math.Ldexp(float64(t.theta), -64)
+}
+
+// Retained returns the number of hashes t holds.
+func (t *ThetaSketch) Retained() int { return len(t.entries) }
+
+func (t *ThetaSketch) estimate() float64 {
+	return float64(len(t.entries)) / t.Theta()
+}
+
+// Estimate returns the cardinality estimate. It is exact while Theta is 1.
+func (t *ThetaSketch) Estimate() uint64 {
+	return uint64(t.estimate() + 0.5)
+}
+
+// Bounds returns an approximate confidence interval of numStdDev standard
+// deviations around Estimate. The number of retained hashes is binomially
+// distributed with success probability Theta, which the bounds approximate
+// as normal. The lower bound is never below the number of retained hashes,
+// which are certainly distinct.
+func (t *ThetaSketch) Bounds(numStdDev float64) (lower, upper uint64) {
+	theta := t.Theta()
+	n := float64(len(t.entries))
+	if theta == 1 {
+		return uint64(n), uint64(n)
+	}
+	// An empty intersection still admits a small count of the size theta
+	// would have had to miss.
+	sd := math.Sqrt(max(n, 1)*(1-theta)) / theta
+	est := t.estimate()
+	return uint64(max(n, math.Floor(est-numStdDev*sd))), uint64(math.Ceil(est + numStdDev*sd))
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (t *ThetaSketch) MarshalBinary() ([]byte, error) {
+	return t.AppendBinary(nil)
+}
+
+// AppendBinary implements the encoding.BinaryAppender interface. See
+// UnmarshalBinary for the format. The encoding is canonical: the retained
+// hashes are written in ascending order.
+func (t *ThetaSketch) AppendBinary(data []byte) ([]byte, error) {
+	if t.k < minThetaK || t.k > maxThetaK {
+		return data, fmt.Errorf("hyperloglog: theta k %d: %w", t.k, ErrorInvalidParameter)
+	}
+	data = slices.Grow(data, 20+8*len(t.entries))
+	data = append(data, thetaVersion, 0, 0, 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(t.k))
+	data = binary.BigEndian.AppendUint64(data, t.theta)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(t.entries)))
+	sorted := slices.Clone(t.entries)
+	slices.Sort(sorted)
+	for _, x := range sorted {
+		data = binary.BigEndian.AppendUint64(data, x)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+//
+// The format is a 4 byte header holding the version (1) and three reserved 0
+// bytes, followed by big endian fields: k as a uint32, theta as a uint64
+// fraction of 2^64, the number N of retained hashes as a uint32, and N uint64
+// hashes. N must not exceed k, and the hashes must be strictly increasing and
+// below theta. The buffer must end after the last hash.
+//
+// Errors wrap the package's exported sentinels and leave t unchanged.
+func (t *ThetaSketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 20 {
+		return fmt.Errorf("hyperloglog: theta header needs 20 bytes, have %d: %w", len(data), ErrorTooShort)
+	}
+	if data[0] != thetaVersion {
+		return fmt.Errorf("hyperloglog: theta version %d: %w", data[0], ErrorInvalidVersion)
+	}
+	if data[1] != 0 || data[2] != 0 || data[3] != 0 {
+		return fmt.Errorf("hyperloglog: theta header bytes 1:4 are not zero: %w", ErrorInvalidData)
+	}
+	k := binary.BigEndian.Uint32(data[4:8])
+	if k < minThetaK || k > maxThetaK {
+		return fmt.Errorf("hyperloglog: theta k %d: %w", k, ErrorInvalidParameter)
+	}
+	theta := binary.BigEndian.Uint64(data[8:16])
+	n := binary.BigEndian.Uint32(data[16:20])
+	if n > k {
+		return fmt.Errorf("hyperloglog: theta retains %d hashes, more than k = %d: %w", n, k, ErrorInvalidData)
+	}
+	if err := exactLen("theta hashes at offset 20", uint64(len(data)-20), 8*uint64(n)); err != nil {
+		return err
+	}
+
+	tmp := newTheta(int(k), theta, int(n))
+	var prev uint64
+	for i := range int(n) {
+		off := 20 + 8*i
+		x := binary.BigEndian.Uint64(data[off:])
+		if x >= theta || (i > 0 && x <= prev) {
+			return fmt.Errorf("hyperloglog: theta hash %d at offset %d is not increasing or not below theta: %w", i, off, ErrorInvalidData)
+		}
+		prev = x
+		tmp.set.Add(x)
+		tmp.entries = append(tmp.entries, x)
+	}
+	heap.Init(&tmp.entries)
+	*t = *tmp
+	return nil
+}
+
+// maxHeap implements heap.Interface with the largest hash on top.
+type maxHeap []uint64
+
+func (h maxHeap) Len() int           { return len(h) }
+func (h maxHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h maxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x any)        { *h = append(*h, x.(uint64)) }
+func (h *maxHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,119 @@
+package hyperloglog
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTheta_Error(t *testing.T) {
+	_, err := NewTheta(15)
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+	_, err = NewTheta(1<<26 + 1)
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+}
+
+func TestTheta_Estimate(t *testing.T) {
+	th, err := NewTheta(4096)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		th.Insert(fmt.Appendf(nil, "user-%d", i))
+		th.Insert(fmt.Appendf(nil, "user-%d", i))
+	}
+	// The largest hash lies past theta, even while it is 1.
+	th.InsertHash(math.MaxUint64)
+	require.EqualValues(t, 1, th.Theta())
+	require.EqualValues(t, 1000, th.Estimate())
+	lo, hi := th.Bounds(2)
+	require.EqualValues(t, 1000, lo)
+	require.EqualValues(t, 1000, hi)
+
+	for i := 1000; i < 1000000; i++ {
+		th.Insert(fmt.Appendf(nil, "user-%d", i))
+	}
+	require.Equal(t, 4096, th.Retained())
+	require.Less(t, th.Theta(), 1.0)
+	ratio := 100 * estimateError(th.Estimate(), 1000000)
+	require.LessOrEqual(t, ratio, 5.0, "got %d", th.Estimate())
+	lo, hi = th.Bounds(3)
+	require.LessOrEqual(t, lo, uint64(1000000))
+	require.GreaterOrEqual(t, hi, uint64(1000000))
+}
+
+func TestTheta_SetOperations(t *testing.T) {
+	a, _ := NewTheta(1 << 14)
+	b, _ := NewTheta(1 << 12)
+	// a holds [0, 300000), b holds [200000, 400000).
+	for i := 0; i < 400000; i++ {
+		x := rand.Uint64()
+		if i < 300000 {
+			a.InsertHash(x)
+		}
+		if i >= 200000 {
+			b.InsertHash(x)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		sk   *ThetaSketch
+		want uint64
+	}{
+		{"intersection", ThetaIntersection(a, b), 100000},
+		{"a not b", ThetaAnotB(a, b), 200000},
+		{"b not a", ThetaAnotB(b, a), 100000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lo, hi := tt.sk.Bounds(4)
+			require.LessOrEqual(t, lo, tt.want)
+			require.GreaterOrEqual(t, hi, tt.want)
+			ratio := 100 * estimateError(tt.sk.Estimate(), tt.want)
+			require.LessOrEqual(t, ratio, 10.0, "got %d", tt.sk.Estimate())
+		})
+	}
+
+	u := a.Clone()
+	u.Merge(b)
+	require.LessOrEqual(t, u.Retained(), 1<<14)
+	require.LessOrEqual(t, u.theta, b.theta)
+	ratio := 100 * estimateError(u.Estimate(), 400000)
+	require.LessOrEqual(t, ratio, 5.0, "got %d", u.Estimate())
+
+	// The sketches are disjoint from one of their own differences.
+	require.Zero(t, ThetaIntersection(ThetaAnotB(a, b), b).Retained())
+}
+
+func TestTheta_Marshal_Unmarshal(t *testing.T) {
+	th, _ := NewTheta(64)
+	for i := 0; i < 10000; i++ {
+		th.InsertHash(rand.Uint64())
+	}
+	data, err := th.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, data, 20+8*64)
+
+	var res ThetaSketch
+	require.NoError(t, res.UnmarshalBinary(data))
+	require.Equal(t, th.Estimate(), res.Estimate())
+	again, err := res.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, data, again)
+
+	// Further inserts see the same state.
+	x := rand.Uint64() >> 8
+	th.InsertHash(x)
+	res.InsertHash(x)
+	require.Equal(t, th.theta, res.theta)
+
+	require.ErrorIs(t, res.UnmarshalBinary(data[:len(data)-1]), ErrorTooShort)
+	require.ErrorIs(t, res.UnmarshalBinary(append(data, 0)), ErrorInvalidData)
+	bad := append([]byte(nil), data...)
+	copy(bad[20:28], bad[28:36])
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidData)
+	bad = append([]byte(nil), data...)
+	bad[0] = 9
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidVersion)
+}
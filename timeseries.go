@@ -0,0 +1,339 @@
+package hyperloglog
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	timeSeriesVersion = 1
+	maxSeriesLevels   = 16
+)
+
+// TimeSeriesLevel configures one resolution of a TimeSeriesSketch.
+type TimeSeriesLevel struct {
+	// Width is the length of the level's buckets. Buckets are aligned to
+	// multiples of Width since the Unix epoch.
+	Width time.Duration
+	// Retention is how long a bucket stays at this level once it has ended,
+	// measured back from the newest timestamp inserted. An expired bucket is
+	// merged into the next level's bucket that contains it, or dropped on
+	// the last level. 0 keeps the buckets forever and is only allowed on the
+	// last level.
+	Retention time.Duration
+}
+
+// TimeSeriesSketch keeps one Sketch per time bucket and rolls old buckets up
+// into coarser ones, for instance minute buckets for the last two hours, hour
+// buckets for the last two days and day buckets forever. Every element lives
+// in exactly one bucket: the finest one whose level still retains its
+// timestamp.
+//
+// Use NewTimeSeriesSketch to create one; the zero value is not usable.
+type TimeSeriesSketch struct {
+	p      uint8
+	sparse bool
+	levels []TimeSeriesLevel
+	// latest is the newest timestamp inserted, in Unix nanoseconds.
+	latest int64
+	// buckets holds each level's buckets, ordered by start.
+	buckets [][]*seriesBucket
+}
+
+type seriesBucket struct {
+	start int64
+	// first and last are the oldest and newest timestamps the bucket holds,
+	// which after a rollup can be a small part of its width.
+	first, last int64
+	sk          *Sketch
+}
+
+// NewTimeSeriesSketch returns an empty series whose buckets are Sketches with
+// 2^precision registers, starting out in the sparse representation when
+// sparse is true. The precision has to be >= 4 and <= 18, otherwise
+// ErrorInvalidPrecision is returned.
+//
+// The levels go from the finest to the coarsest. Each Width must be positive
+// and a multiple of the previous level's, and each Retention must be
+// positive, except that the last level's may be 0; otherwise an error
+// wrapping ErrorInvalidParameter is returned.
+func NewTimeSeriesSketch(precision uint8, sparse bool, levels ...TimeSeriesLevel) (*TimeSeriesSketch, error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	if err := checkSeriesLevels(levels); err != nil {
+		return nil, err
+	}
+	return &TimeSeriesSketch{
+		p:       precision,
+		sparse:  sparse,
+		levels:  slices.Clone(levels),
+		latest:  math.MinInt64,
+		buckets: make([][]*seriesBucket, len(levels)),
+	}, nil
+}
+
+func checkSeriesLevels(levels []TimeSeriesLevel) error {
+	if len(levels) == 0 || len(levels) > maxSeriesLevels {
+		return fmt.Errorf("hyperloglog: %d series levels outside [1, %d]: %w", len(levels), maxSeriesLevels, ErrorInvalidParameter)
+	}
+	for i, l := range levels {
+		if l.Width <= 0 {
+			return fmt.Errorf("hyperloglog: series level %d width %v is not positive: %w", i, l.Width, ErrorInvalidParameter)
+		}
+		if i > 0 && l.Width%levels[i-1].Width != 0 {
+			return fmt.Errorf("hyperloglog: series level %d width %v is not a multiple of %v: %w", i, l.Width, levels[i-1].Width, ErrorInvalidParameter)
+		}
+		last := i == len(levels)-1
+		if l.Retention < 0 || (l.Retention == 0 && !last) {
+			return fmt.Errorf("hyperloglog: series level %d retention %v: %w", i, l.Retention, ErrorInvalidParameter)
+		}
+	}
+	return nil
+}
+
+// floorTo rounds t down to a multiple of w.
+func floorTo(t, w int64) int64 {
+	r := t % w
+	if r < 0 {
+		r += w
+	}
+	return t - r
+}
+
+// expired reports whether the bucket of level i starting at start has left
+// the level.
+func (s *TimeSeriesSketch) expired(i int, start int64) bool {
+	l := s.levels[i]
+	if l.Retention == 0 {
+		return false
+	}
+	if start > s.latest {
+		return false
+	}
+	// Neither latest-start nor Width+Retention, both positive, can wrap
+	// around as uint64s.
+	return uint64(s.latest)-uint64(start) >= uint64(l.Width)+uint64(l.Retention)
+}
+
+// bucket returns the bucket of level i starting at start, creating it if
+// needed.
+func (s *TimeSeriesSketch) bucket(i int, start int64) *seriesBucket {
+	bs := s.buckets[i]
+	pos, found := slices.BinarySearchFunc(bs, start, func(b *seriesBucket, start int64) int {
+		return cmp.Compare(b.start, start)
+	})
+	if found {
+		return bs[pos]
+	}
+	b := &seriesBucket{
+		start: start,
+		first: math.MaxInt64,
+		last:  math.MinInt64,
+		sk:    newSketchNoError(s.p, s.sparse),
+	}
+	s.buckets[i] = slices.Insert(bs, pos, b)
+	return b
+}
+
+// rollup moves the expired buckets of every level into the next one, or
+// drops them on the last level.
+func (s *TimeSeriesSketch) rollup() {
+	for i := range s.levels {
+		bs := s.buckets[i]
+		n := 0
+		for n < len(bs) && s.expired(i, bs[n].start) {
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if i+1 < len(s.levels) {
+			w := int64(s.levels[i+1].Width)
+			for _, b := range bs[:n] {
+				parent := s.bucket(i+1, floorTo(b.start, w))
+				// Both sketches have the series' precision.
+				_ = parent.sk.Merge(b.sk)
+				parent.first = min(parent.first, b.first)
+				parent.last = max(parent.last, b.last)
+			}
+		}
+		s.buckets[i] = slices.Delete(bs, 0, n)
+	}
+}
+
+// InsertAt hashes e with the package's MetroHash64 seed and adds it to s as
+// seen at t.
+func (s *TimeSeriesSketch) InsertAt(e []byte, t time.Time) { s.InsertHashAt(hash(e), t) }
+
+// InsertHashAt adds a uniformly distributed 64-bit hash to s as seen at t.
+// Timestamps do not have to arrive in order: a late hash goes to the bucket
+// its timestamp has been rolled up into, and is dropped if the last level
+// no longer retains it.
+func (s *TimeSeriesSketch) InsertHashAt(x uint64, t time.Time) {
+	ts := t.UnixNano()
+	if ts > s.latest {
+		s.latest = ts
+		s.rollup()
+	}
+	for i, l := range s.levels {
+		start := floorTo(ts, int64(l.Width))
+		if s.expired(i, start) {
+			continue
+		}
+		b := s.bucket(i, start)
+		b.sk.InsertHash(x)
+		b.first = min(b.first, ts)
+		b.last = max(b.last, ts)
+		return
+	}
+}
+
+// Sketch returns the union of the smallest set of buckets that covers the
+// hashes seen in [from, to). The union is a new Sketch, independent of s.
+//
+// Buckets are indivisible, so a range that starts or ends inside a bucket
+// which holds timestamps on both sides of the boundary also counts the
+// bucket's hashes outside the range.
+func (s *TimeSeriesSketch) Sketch(from, to time.Time) *Sketch {
+	lo, hi := from.UnixNano(), to.UnixNano()
+	res := newSketchNoError(s.p, s.sparse)
+	for _, bs := range s.buckets {
+		for _, b := range bs {
+			if b.first < hi && b.last >= lo {
+				// Both sketches have the series' precision.
+				_ = res.Merge(b.sk)
+			}
+		}
+	}
+	return res
+}
+
+// Estimate returns the cardinality estimate of the hashes seen in [from, to),
+// with the same bucket granularity as Sketch.
+func (s *TimeSeriesSketch) Estimate(from, to time.Time) uint64 {
+	return s.Sketch(from, to).Estimate()
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (s *TimeSeriesSketch) MarshalBinary() ([]byte, error) {
+	return s.AppendBinary(nil)
+}
+
+// AppendBinary implements the encoding.BinaryAppender interface. See
+// UnmarshalBinary for the format. data is left unmodified on error.
+func (s *TimeSeriesSketch) AppendBinary(data []byte) ([]byte, error) {
+	start := len(data)
+	var flags byte
+	if s.sparse {
+		flags = 1
+	}
+	data = append(data, timeSeriesVersion, s.p, flags, byte(len(s.levels)))
+	data = binary.BigEndian.AppendUint64(data, uint64(s.latest))
+	for i, l := range s.levels {
+		data = binary.BigEndian.AppendUint64(data, uint64(l.Width))
+		data = binary.BigEndian.AppendUint64(data, uint64(l.Retention))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(s.buckets[i])))
+	}
+	for _, bs := range s.buckets {
+		for _, b := range bs {
+			data = binary.BigEndian.AppendUint64(data, uint64(b.start))
+			data = binary.BigEndian.AppendUint64(data, uint64(b.first))
+			data = binary.BigEndian.AppendUint64(data, uint64(b.last))
+			// Leave room for the length, written once the Sketch is.
+			at := len(data)
+			data = append(data, 0, 0, 0, 0)
+			var err error
+			if data, err = b.sk.AppendBinary(data); err != nil {
+				return data[:start], err
+			}
+			binary.BigEndian.PutUint32(data[at:], uint32(len(data)-at-4))
+		}
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+//
+// The format is a 4 byte header holding the version (1), the precision p, a
+// flags byte (bit 0: new buckets start sparse) and the number of levels,
+// followed by the newest timestamp in Unix nanoseconds as a big endian int64.
+// Then, for each level, its width and retention in nanoseconds as big endian
+// int64s and its number of buckets as a big endian uint32. Then the buckets of
+// every level in order of level and start: the start, the oldest and the
+// newest timestamp held as big endian int64s, and the length of the bucket's
+// Sketch as a big endian uint32 followed by the Sketch in its own binary
+// format, with precision p. The buffer must end after the last bucket.
+//
+// Errors wrap the package's exported sentinels and leave s unchanged.
+func (s *TimeSeriesSketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("hyperloglog: series header needs 12 bytes, have %d: %w", len(data), ErrorTooShort)
+	}
+	if data[0] != timeSeriesVersion {
+		return fmt.Errorf("hyperloglog: series version %d: %w", data[0], ErrorInvalidVersion)
+	}
+	if data[2] > 1 {
+		return fmt.Errorf("hyperloglog: series flags %#02x: %w", data[2], ErrorInvalidData)
+	}
+	levels := make([]TimeSeriesLevel, data[3])
+	counts := make([]uint32, data[3])
+	if len(data) < 12+20*len(levels) {
+		return fmt.Errorf("hyperloglog: series levels need %d bytes, have %d: %w", 12+20*len(levels), len(data), ErrorTooShort)
+	}
+	for i := range levels {
+		off := 12 + 20*i
+		levels[i].Width = time.Duration(binary.BigEndian.Uint64(data[off:]))
+		levels[i].Retention = time.Duration(binary.BigEndian.Uint64(data[off+8:]))
+		counts[i] = binary.BigEndian.Uint32(data[off+16:])
+	}
+	tmp, err := NewTimeSeriesSketch(data[1], data[2] == 1, levels...)
+	if err != nil {
+		return err
+	}
+	tmp.latest = int64(binary.BigEndian.Uint64(data[4:]))
+
+	off := 12 + 20*len(levels)
+	for i, n := range counts {
+		w := int64(levels[i].Width)
+		for j := range n {
+			if len(data)-off < 28 {
+				return fmt.Errorf("hyperloglog: series level %d bucket %d at offset %d needs 28 bytes, have %d: %w", i, j, off, len(data)-off, ErrorTooShort)
+			}
+			b := &seriesBucket{
+				start: int64(binary.BigEndian.Uint64(data[off:])),
+				first: int64(binary.BigEndian.Uint64(data[off+8:])),
+				last:  int64(binary.BigEndian.Uint64(data[off+16:])),
+				sk:    &Sketch{},
+			}
+			size := uint64(binary.BigEndian.Uint32(data[off+24:]))
+			off += 28
+			if floorTo(b.start, w) != b.start || b.first < b.start || b.first > b.last || b.last-b.start >= w || b.last > tmp.latest {
+				return fmt.Errorf("hyperloglog: series level %d bucket %d spans [%d, %d] from start %d: %w", i, j, b.first, b.last, b.start, ErrorInvalidData)
+			}
+			if prev := tmp.buckets[i]; len(prev) > 0 && prev[len(prev)-1].start >= b.start {
+				return fmt.Errorf("hyperloglog: series level %d bucket %d out of order: %w", i, j, ErrorInvalidData)
+			}
+			if uint64(len(data)-off) < size {
+				return fmt.Errorf("hyperloglog: series level %d bucket %d sketch needs %d bytes, have %d: %w", i, j, size, len(data)-off, ErrorTooShort)
+			}
+			if err := b.sk.UnmarshalBinary(data[off : off+int(size)]); err != nil {
+				return fmt.Errorf("hyperloglog: series level %d bucket %d: %w", i, j, err)
+			}
+			if b.sk.p != tmp.p {
+				return fmt.Errorf("hyperloglog: series level %d bucket %d has precision %d, want %d: %w", i, j, b.sk.p, tmp.p, ErrorInvalidData)
+			}
+			off += int(size)
+			tmp.buckets[i] = append(tmp.buckets[i], b)
+		}
+	}
+	if off != len(data) {
+		return fmt.Errorf("hyperloglog: %d trailing bytes after series: %w", len(data)-off, ErrorInvalidData)
+	}
+	*s = *tmp
+	return nil
+}
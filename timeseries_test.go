@@ -0,0 +1,156 @@
+package hyperloglog
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSeriesLevels = []TimeSeriesLevel{
+	{Width: time.Minute, Retention: 2 * time.Hour},
+	{Width: time.Hour, Retention: 24 * time.Hour},
+	{Width: 24 * time.Hour},
+}
+
+func TestTimeSeries_Error(t *testing.T) {
+	_, err := NewTimeSeriesSketch(19, true, testSeriesLevels...)
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	for _, levels := range [][]TimeSeriesLevel{
+		nil,
+		{{Width: 0}},
+		{{Width: time.Minute, Retention: -1}},
+		{{Width: time.Minute}, {Width: time.Hour}},
+		{{Width: time.Minute, Retention: time.Hour}, {Width: 90 * time.Second}},
+	} {
+		_, err := NewTimeSeriesSketch(14, true, levels...)
+		require.ErrorIs(t, err, ErrorInvalidParameter, "%v", levels)
+	}
+}
+
+// fillSeries inserts perMinute new hashes every minute for the given number of
+// minutes after start.
+func fillSeries(s *TimeSeriesSketch, start time.Time, minutes, perMinute int) {
+	for m := 0; m < minutes; m++ {
+		at := start.Add(time.Duration(m) * time.Minute)
+		for i := 0; i < perMinute; i++ {
+			s.InsertHashAt(rand.Uint64(), at.Add(time.Duration(i)*time.Millisecond))
+		}
+	}
+}
+
+func TestTimeSeries_Rollup(t *testing.T) {
+	s, err := NewTimeSeriesSketch(14, true, testSeriesLevels...)
+	require.NoError(t, err)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fillSeries(s, start, 3*24*60, 100)
+
+	// The newest two hours are minute buckets, the day before them hour
+	// buckets and the rest day buckets. Only the hours rolled up from minute
+	// buckets exist, and the newest day is still made of hour buckets.
+	require.Len(t, s.buckets[0], 121)
+	require.Len(t, s.buckets[1], 23)
+	require.Len(t, s.buckets[2], 2)
+	for i, bs := range s.buckets {
+		for _, b := range bs {
+			require.False(t, s.expired(i, b.start))
+		}
+	}
+
+	for _, tt := range []struct {
+		from, to time.Duration
+	}{
+		{71*time.Hour + 30*time.Minute, 72 * time.Hour}, // minute buckets
+		{50 * time.Hour, 60 * time.Hour},                // hour buckets
+		{0, 24 * time.Hour},                             // a day bucket
+		{0, 72 * time.Hour},                             // everything
+	} {
+		exact := uint64((tt.to - tt.from) / time.Minute * 100)
+		got := s.Estimate(start.Add(tt.from), start.Add(tt.to))
+		require.LessOrEqual(t, 100*estimateError(got, exact), 3.0, "[%v, %v): got %d, want %d", tt.from, tt.to, got, exact)
+	}
+	require.Zero(t, s.Estimate(start.Add(-time.Hour), start))
+}
+
+func TestTimeSeries_OutOfOrder(t *testing.T) {
+	s, _ := NewTimeSeriesSketch(10, false, testSeriesLevels...)
+	start := time.Unix(0, 0)
+	s.InsertHashAt(rand.Uint64(), start.Add(48*time.Hour))
+
+	// A late hash goes to the bucket its time has been rolled up into.
+	s.InsertHashAt(rand.Uint64(), start.Add(90*time.Minute))
+	require.Len(t, s.buckets[2], 1)
+	s.InsertHashAt(rand.Uint64(), start.Add(45*time.Hour))
+	require.Len(t, s.buckets[1], 1)
+	s.InsertHashAt(rand.Uint64(), start.Add(48*time.Hour-time.Minute))
+	require.Len(t, s.buckets[0], 2)
+
+	require.EqualValues(t, 4, s.Estimate(start, start.Add(49*time.Hour)))
+	// The day bucket only holds its first two hours, so later ranges skip
+	// it.
+	require.EqualValues(t, 1, s.Estimate(start, start.Add(2*time.Hour)))
+	require.EqualValues(t, 0, s.Estimate(start, start.Add(90*time.Minute)))
+	require.EqualValues(t, 3, s.Estimate(start.Add(2*time.Hour), start.Add(49*time.Hour)))
+
+	// The last level can drop old data.
+	dropping, _ := NewTimeSeriesSketch(10, false, TimeSeriesLevel{Width: time.Hour, Retention: time.Hour})
+	dropping.InsertHashAt(rand.Uint64(), start.Add(3*time.Hour))
+	dropping.InsertHashAt(rand.Uint64(), start)
+	require.EqualValues(t, 1, dropping.Estimate(start, start.Add(4*time.Hour)))
+
+	// A retention whose end is past the largest timestamp keeps everything.
+	keeping, _ := NewTimeSeriesSketch(10, false, TimeSeriesLevel{Width: time.Hour, Retention: math.MaxInt64})
+	keeping.InsertHashAt(rand.Uint64(), start.Add(3*time.Hour))
+	keeping.InsertHashAt(rand.Uint64(), start)
+	require.EqualValues(t, 2, keeping.Estimate(start, start.Add(4*time.Hour)))
+
+	// Timestamps further apart than the largest int64.
+	early, late := time.Date(1700, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2250, 1, 1, 0, 0, 0, 0, time.UTC)
+	dropping, _ = NewTimeSeriesSketch(10, false, TimeSeriesLevel{Width: time.Hour, Retention: time.Hour})
+	dropping.InsertHashAt(rand.Uint64(), late)
+	dropping.InsertHashAt(rand.Uint64(), early)
+	require.EqualValues(t, 1, dropping.Estimate(early, late.Add(time.Hour)))
+}
+
+func TestTimeSeries_Marshal_Unmarshal(t *testing.T) {
+	s, _ := NewTimeSeriesSketch(12, true, testSeriesLevels...)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fillSeries(s, start, 2*24*60, 10)
+
+	data, err := s.MarshalBinary()
+	require.NoError(t, err)
+	var res TimeSeriesSketch
+	require.NoError(t, res.UnmarshalBinary(data))
+	for _, r := range [][2]time.Duration{{0, 48 * time.Hour}, {30 * time.Hour, 31 * time.Hour}, {47 * time.Hour, 48 * time.Hour}} {
+		from, to := start.Add(r[0]), start.Add(r[1])
+		require.Equal(t, s.Estimate(from, to), res.Estimate(from, to))
+	}
+
+	// Both keep rolling up the same way.
+	x := rand.Uint64()
+	s.InsertHashAt(x, start.Add(50*time.Hour))
+	res.InsertHashAt(x, start.Add(50*time.Hour))
+	require.Equal(t, s.Estimate(start, start.Add(51*time.Hour)), res.Estimate(start, start.Add(51*time.Hour)))
+
+	for i := 0; i < len(data); i += 1 + i/64 {
+		require.ErrorIs(t, res.UnmarshalBinary(data[:i]), ErrorTooShort, "length %d", i)
+	}
+	require.ErrorIs(t, res.UnmarshalBinary(append(data, 0)), ErrorInvalidData)
+	bad := append([]byte(nil), data...)
+	bad[0] = 2
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidVersion)
+	bad = append([]byte(nil), data...)
+	bad[1] = 13 // The buckets have precision 12.
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidData)
+	bad = append([]byte(nil), data...)
+	bad[12+20*3+7]++ // Unaligned first bucket.
+	require.ErrorIs(t, res.UnmarshalBinary(bad), ErrorInvalidData)
+
+	// A bucket that fails to encode returns the buffer as it was.
+	s.buckets[0][0].sk.hashFunc = HashRedis
+	got, err := s.AppendBinary([]byte{1})
+	require.ErrorIs(t, err, ErrorHashMismatch)
+	require.Equal(t, []byte{1}, got)
+}
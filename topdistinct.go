@@ -0,0 +1,219 @@
+package hyperloglog
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// TopDistinct follows the Space-Saving algorithm of Metwally, Agrawal and El
+// Abbadi, "Efficient computation of frequent and top-k elements in data
+// streams" (2005), counting distinct values with a Sketch instead of
+// occurrences.
+
+// TopDistinct finds the keys with the most distinct values, such as the
+// sources that contact the most distinct destinations, without a Sketch for
+// every key. It tracks a fixed number of candidate keys, each with its own
+// sparse Sketch. When a new key arrives and every slot is taken, it replaces
+// the candidate with the smallest estimate and inherits its Sketch, so a key
+// that belongs in the top is never underestimated and eventually claims a
+// slot. The estimate of the replaced candidate is remembered as the new key's
+// error.
+//
+// Tracking several times as many candidates as the number of top keys wanted
+// keeps the errors of the top keys small. A TopDistinct is not safe for
+// concurrent use.
+type TopDistinct[K comparable] struct {
+	p        uint8
+	capacity int
+	entries  map[K]*topDistinctEntry[K]
+	// byEstimate orders the entries from the smallest cached estimate.
+	byEstimate topDistinctHeap[K]
+}
+
+// TopDistinctEntry is a key with its estimated number of distinct values.
+type TopDistinctEntry[K comparable] struct {
+	Key      K
+	Estimate uint64
+	// Error bounds how far Estimate may be off. It is the part of the
+	// estimate inherited from replaced keys, plus what other shards may
+	// have seen of the key without tracking it.
+	Error uint64
+}
+
+type topDistinctEntry[K comparable] struct {
+	key K
+	sk  *Sketch
+	err uint64
+	// est caches sk's estimate; it is stale when dirty. Estimates only
+	// grow, so a stale one is still a lower bound.
+	est   uint64
+	dirty bool
+}
+
+// NewTopDistinct returns an empty TopDistinct that tracks up to capacity
+// candidate keys with sketches of 2^precision registers. The precision has to
+// be >= 4 and <= 18, otherwise ErrorInvalidPrecision is returned; a capacity
+// that is not positive returns an error wrapping ErrorInvalidParameter.
+func NewTopDistinct[K comparable](capacity int, precision uint8) (*TopDistinct[K], error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("hyperloglog: top distinct capacity %d is not positive: %w", capacity, ErrorInvalidParameter)
+	}
+	return &TopDistinct[K]{
+		p:        precision,
+		capacity: capacity,
+		entries:  make(map[K]*topDistinctEntry[K], capacity),
+	}, nil
+}
+
+// Insert hashes value with the package's MetroHash64 seed and adds it to the
+// distinct values of key.
+func (t *TopDistinct[K]) Insert(key K, value []byte) { t.InsertHash(key, hash(value)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash to the distinct values
+// of key.
+func (t *TopDistinct[K]) InsertHash(key K, x uint64) {
+	e, ok := t.entries[key]
+	if !ok {
+		if len(t.entries) < t.capacity {
+			e = &topDistinctEntry[K]{key: key, sk: newSketchNoError(t.p, true)}
+			heap.Push(&t.byEstimate, e)
+		} else {
+			e = t.min()
+			delete(t.entries, e.key)
+			e.key, e.err = key, e.est
+		}
+		t.entries[key] = e
+	}
+	e.sk.InsertHash(x)
+	e.dirty = true
+}
+
+// min returns the entry with the smallest estimate, refreshing stale
+// estimates until the smallest one is current.
+func (t *TopDistinct[K]) min() *topDistinctEntry[K] {
+	for {
+		e := t.byEstimate[0]
+		if !e.dirty {
+			return e
+		}
+		e.refresh()
+		heap.Fix(&t.byEstimate, 0)
+	}
+}
+
+// minEstimate returns the smallest estimate of t's entries like min, but
+// without refreshing them, so that t is not modified.
+func (t *TopDistinct[K]) minEstimate() uint64 {
+	res := uint64(math.MaxUint64)
+	for _, e := range t.byEstimate {
+		est := e.est
+		if e.dirty {
+			// Estimate compacts sparse state, which canonical leaves
+			// nothing of to compact.
+			est = e.sk.canonical().Estimate()
+		}
+		res = min(res, est)
+	}
+	return res
+}
+
+func (e *topDistinctEntry[K]) refresh() {
+	if e.dirty {
+		e.est = e.sk.Estimate()
+		e.dirty = false
+	}
+}
+
+// Len returns the number of candidate keys t tracks.
+func (t *TopDistinct[K]) Len() int { return len(t.entries) }
+
+// Top returns up to k candidate keys with the largest estimates, from the
+// largest down. Keys with equal estimates are ordered by their errors, the
+// smallest first.
+func (t *TopDistinct[K]) Top(k int) []TopDistinctEntry[K] {
+	res := make([]TopDistinctEntry[K], 0, len(t.entries))
+	for _, e := range t.byEstimate {
+		e.refresh()
+		res = append(res, TopDistinctEntry[K]{Key: e.key, Estimate: e.est, Error: e.err})
+	}
+	heap.Init(&t.byEstimate)
+	slices.SortFunc(res, func(a, b TopDistinctEntry[K]) int {
+		return cmp.Or(cmp.Compare(b.Estimate, a.Estimate), cmp.Compare(a.Error, b.Error))
+	})
+	return res[:min(max(k, 0), len(res))]
+}
+
+// Merge adds other, typically built on another shard of the stream, to t.
+// Keys both track merge their sketches. A key only one of them tracks may
+// have been seen by the other one, which would have dropped it with fewer
+// distinct values than its smallest candidate, so that bound is added to the
+// key's error. When more keys result than t's capacity, those with the
+// smallest estimates are dropped.
+//
+// Both must have the same precision, otherwise an error wrapping
+// ErrorPrecisionMismatch is returned and t is unchanged. other is not
+// modified.
+func (t *TopDistinct[K]) Merge(other *TopDistinct[K]) error {
+	if other == nil || len(other.entries) == 0 {
+		return nil
+	}
+	if t.p != other.p {
+		return fmt.Errorf("hyperloglog: cannot merge top distinct precision %d with precision %d: %w", t.p, other.p, ErrorPrecisionMismatch)
+	}
+	// A TopDistinct below capacity has never dropped a key.
+	var missedHere, missedThere uint64
+	if len(t.entries) == t.capacity {
+		missedHere = t.min().est
+	}
+	if len(other.entries) == other.capacity {
+		missedThere = other.minEstimate()
+	}
+
+	for _, e := range t.entries {
+		if _, ok := other.entries[e.key]; !ok {
+			e.err += missedThere
+		}
+	}
+	for key, o := range other.entries {
+		if e, ok := t.entries[key]; ok {
+			// Both sketches have precision t.p.
+			_ = e.sk.Merge(o.sk)
+			e.err += o.err
+			e.dirty = true
+			continue
+		}
+		e := &topDistinctEntry[K]{key: key, sk: o.sk.Clone(), err: o.err + missedHere, dirty: true}
+		t.entries[key] = e
+		heap.Push(&t.byEstimate, e)
+	}
+
+	for _, e := range t.byEstimate {
+		e.refresh()
+	}
+	heap.Init(&t.byEstimate)
+	for len(t.entries) > t.capacity {
+		e := heap.Pop(&t.byEstimate).(*topDistinctEntry[K])
+		delete(t.entries, e.key)
+	}
+	return nil
+}
+
+// topDistinctHeap orders entries from the smallest cached estimate.
+type topDistinctHeap[K comparable] []*topDistinctEntry[K]
+
+func (h topDistinctHeap[K]) Len() int           { return len(h) }
+func (h topDistinctHeap[K]) Less(i, j int) bool { return h[i].est < h[j].est }
+func (h topDistinctHeap[K]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *topDistinctHeap[K]) Push(x any)        { *h = append(*h, x.(*topDistinctEntry[K])) }
+func (h *topDistinctHeap[K]) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
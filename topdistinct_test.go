@@ -0,0 +1,121 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopDistinct_Error(t *testing.T) {
+	_, err := NewTopDistinct[string](10, 19)
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	_, err = NewTopDistinct[string](0, 12)
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+
+	a, _ := NewTopDistinct[string](10, 12)
+	b, _ := NewTopDistinct[string](10, 10)
+	b.InsertHash("x", 1)
+	require.ErrorIs(t, a.Merge(b), ErrorPrecisionMismatch)
+	require.Zero(t, a.Len())
+}
+
+type flow struct {
+	src int
+	dst uint64
+}
+
+// superspreaderFlows returns a shuffled stream in which sources 0 to 9
+// contact 5000 down to 500 distinct destinations each, and 2000 other
+// sources up to 40 each.
+func superspreaderFlows() []flow {
+	var flows []flow
+	for src := 0; src < 10; src++ {
+		for i := 0; i < 5000-500*src; i++ {
+			dst := rand.Uint64()
+			flows = append(flows, flow{src, dst}, flow{src, dst})
+		}
+	}
+	for src := 10; src < 2010; src++ {
+		for i := rand.Intn(40); i >= 0; i-- {
+			flows = append(flows, flow{src, rand.Uint64()})
+		}
+	}
+	rand.Shuffle(len(flows), func(i, j int) { flows[i], flows[j] = flows[j], flows[i] })
+	return flows
+}
+
+func requireSuperspreaders(t *testing.T, top []TopDistinctEntry[int]) {
+	t.Helper()
+	require.Len(t, top, 10)
+	for i, e := range top {
+		require.Equal(t, i, e.Key)
+		exact := uint64(5000 - 500*i)
+		require.LessOrEqual(t, e.Error, exact/10)
+		require.InDelta(t, exact, e.Estimate, float64(e.Error)+0.05*float64(exact))
+	}
+}
+
+func TestTopDistinct_Top(t *testing.T) {
+	top, err := NewTopDistinct[int](100, 12)
+	require.NoError(t, err)
+	require.Empty(t, top.Top(10))
+	for _, f := range superspreaderFlows() {
+		top.InsertHash(f.src, f.dst)
+	}
+	require.Equal(t, 100, top.Len())
+	requireSuperspreaders(t, top.Top(10))
+	require.Len(t, top.Top(1000), 100)
+}
+
+func TestTopDistinct_Merge(t *testing.T) {
+	flows := superspreaderFlows()
+	shards := make([]*TopDistinct[int], 4)
+	for i := range shards {
+		shards[i], _ = NewTopDistinct[int](100, 12)
+	}
+	for _, f := range flows {
+		shards[rand.Intn(len(shards))].InsertHash(f.src, f.dst)
+	}
+
+	merged, _ := NewTopDistinct[int](100, 12)
+	for _, s := range shards {
+		before := topDistinctState(s)
+		require.NoError(t, merged.Merge(s))
+		require.Equal(t, before, topDistinctState(s))
+	}
+	require.Equal(t, 100, merged.Len())
+	requireSuperspreaders(t, merged.Top(10))
+
+	// Merging a TopDistinct below capacity adds no error for the keys it
+	// does not track.
+	a, _ := NewTopDistinct[int](10, 12)
+	b, _ := NewTopDistinct[int](10, 12)
+	for i := 0; i < 100; i++ {
+		a.InsertHash(1, rand.Uint64())
+		b.InsertHash(2, rand.Uint64())
+	}
+	require.NoError(t, a.Merge(b))
+	require.Equal(t, []TopDistinctEntry[int]{{Key: 1, Estimate: 100}, {Key: 2, Estimate: 100}}, a.Top(2))
+}
+
+type topDistinctEntryState struct {
+	key        int
+	est        uint64
+	dirty      bool
+	tmpKeys    int
+	sparseKeys uint32
+}
+
+// topDistinctState returns the state of t's entries in heap order.
+func topDistinctState(t *TopDistinct[int]) []topDistinctEntryState {
+	var res []topDistinctEntryState
+	for _, e := range t.byEstimate {
+		st := topDistinctEntryState{key: e.key, est: e.est, dirty: e.dirty, tmpKeys: e.sk.tmpSet.Len()}
+		if e.sk.sparse() {
+			st.sparseKeys = e.sk.sparseList.count
+		}
+		res = append(res, st)
+	}
+	return res
+}
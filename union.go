@@ -0,0 +1,109 @@
+package hyperloglog
+
+import (
+	"math/bits"
+	"slices"
+)
+
+// EstimateUnion returns the cardinality estimate of the union of the sets the
+// sketches have seen, as Estimate would return it for a Clone of the first
+// one with the others merged in, but without building that sketch or
+// modifying any of the sketches.
+//
+// When all the sketches are sparse, their sparse keys are deduplicated, and
+// the union stays sparse unless the keys would not fit in the dense
+// registers. Otherwise the largest register values are collected into a
+// single scratch slice of registers. Sketches of different precisions are
+// compared at the lowest, as if they had been folded to it. Nil and
+// zero-value sketches are empty. Sketches fed by different hash functions put
+// the same element in unrelated registers, so they have no union estimate and
+// return 0.
+func EstimateUnion(sketches ...*Sketch) uint64 {
+	if _, ok := sharedHashFunc(sketches...); !ok {
+		return 0
+	}
+	var p uint8
+	allSparse := true
+	for _, sk := range sketches {
+		if sk == nil || sk.p == 0 {
+			continue
+		}
+		if p == 0 || sk.p < p {
+			p = sk.p
+		}
+		allSparse = allSparse && sk.sparse()
+	}
+	if p == 0 {
+		return 0
+	}
+	m := uint32(1) << p
+
+	if allSparse {
+		if n, ok := sparseUnionCount(sketches, p, m); ok {
+			return uint64(linearCount(mp, mp-min(n, mp-1)))
+		}
+	}
+
+	regs := make([]uint8, m)
+	for _, sk := range sketches {
+		if sk == nil || sk.p == 0 {
+			continue
+		}
+		if sk.sparse() {
+			sk.forEachKey(func(k uint32) {
+				i, r := decodeHash(foldKey(k, p), p, pp)
+				regs[i] = max(regs[i], r)
+			})
+			continue
+		}
+		d := sk.p - p
+		for i, r := range sk.regs {
+			if r != 0 {
+				j, r := foldRegister(uint32(i), r, d)
+				regs[j] = max(regs[j], r)
+			}
+		}
+	}
+	sum, ez := sumAndZeros(regs)
+	return estimateDense(p, sum, ez)
+}
+
+// sparseUnionCount returns the number of distinct sparse keys of the sparse
+// sketches folded to precision p, and whether their compressed list would fit
+// in m bytes and so stay sparse.
+func sparseUnionCount(sketches []*Sketch, p uint8, m uint32) (uint32, bool) {
+	union := makeSet(0)
+	for _, sk := range sketches {
+		if sk == nil || sk.p == 0 {
+			continue
+		}
+		sk.forEachKey(func(k uint32) { union.add(foldKey(k, p)) })
+		// Every key takes at least a byte of the compressed list.
+		if uint32(union.Len()) > m {
+			return 0, false
+		}
+	}
+
+	keys := make([]uint32, 0, union.Len())
+	union.ForEach(func(k uint32) { keys = append(keys, k) })
+	slices.Sort(keys)
+	// Size the compressed list the way compressedList.Append encodes it:
+	// a varint of 7 bits per byte for each delta.
+	var size, last uint32
+	for _, k := range keys {
+		size += max(1, uint32(bits.Len32(k-last)+6)/7)
+		last = k
+	}
+	return uint32(len(keys)), size <= m
+}
+
+// forEachKey calls fn for the sparse keys of the sparse sketch sk, in no
+// particular order and possibly more than once.
+func (sk *Sketch) forEachKey(fn func(k uint32)) {
+	if sk.tmpSet != nilSet {
+		sk.tmpSet.ForEach(fn)
+	}
+	for iter := sk.sparseList.Iter(); iter.HasNext(); {
+		fn(iter.Next())
+	}
+}
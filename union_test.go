@@ -0,0 +1,108 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mergedEstimate is what EstimateUnion replaces: a Clone of the first sketch
+// with the others folded to its precision and merged in.
+func mergedEstimate(t *testing.T, sketches ...*Sketch) uint64 {
+	t.Helper()
+	var p uint8
+	for _, sk := range sketches {
+		if sk != nil && sk.p != 0 && (p == 0 || sk.p < p) {
+			p = sk.p
+		}
+	}
+	merged := &Sketch{}
+	for _, sk := range sketches {
+		if sk == nil || sk.p == 0 {
+			continue
+		}
+		sk = sk.Clone()
+		require.NoError(t, sk.Fold(p))
+		require.NoError(t, merged.Merge(sk))
+	}
+	return merged.Estimate()
+}
+
+func TestEstimateUnion(t *testing.T) {
+	build := func(p uint8, sparse bool, n int, shared []uint64) *Sketch {
+		sk := newSketchNoError(p, sparse)
+		for _, x := range shared {
+			sk.InsertHash(x)
+		}
+		for i := 0; i < n; i++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		return sk
+	}
+	shared := make([]uint64, 50)
+	for i := range shared {
+		shared[i] = rand.Uint64()
+	}
+
+	for _, tt := range []struct {
+		name     string
+		sketches []*Sketch
+	}{
+		{"empty", nil},
+		{"nil and zero", []*Sketch{nil, {}}},
+		{"one sparse", []*Sketch{build(14, true, 100, nil)}},
+		{"sparse", []*Sketch{build(14, true, 100, shared), build(14, true, 300, shared), nil, build(14, true, 0, shared)}},
+		{"sparse to dense", []*Sketch{build(14, true, 5000, shared), build(14, true, 5000, shared), build(14, true, 5000, shared)}},
+		{"dense", []*Sketch{build(14, false, 100000, shared), build(14, false, 50000, shared)}},
+		{"mixed", []*Sketch{build(14, true, 200, shared), build(14, false, 50000, shared), build(14, true, 3000, nil)}},
+		{"precisions", []*Sketch{build(16, true, 500, shared), build(12, false, 20000, shared), build(14, true, 100, shared)}},
+		{"sparse precisions", []*Sketch{build(18, true, 500, shared), build(10, true, 30, shared)}},
+	} {
+		var before []*Sketch
+		for _, sk := range tt.sketches {
+			if sk != nil {
+				sk = sk.Clone()
+			}
+			before = append(before, sk)
+		}
+		require.Equal(t, mergedEstimate(t, tt.sketches...), EstimateUnion(tt.sketches...), tt.name)
+		for i, sk := range tt.sketches {
+			if sk == nil || sk.p == 0 {
+				continue
+			}
+			require.Equal(t, before[i].sparse(), sk.sparse(), tt.name)
+			require.Equal(t, before[i].tmpSet.Len(), sk.tmpSet.Len(), tt.name)
+			require.Equal(t, denseRegs(before[i]), denseRegs(sk), tt.name)
+		}
+	}
+
+	// Many small sketches of one stream.
+	var parts []*Sketch
+	for i := 0; i < 500; i++ {
+		parts = append(parts, build(14, true, 200, nil))
+	}
+	got := EstimateUnion(parts...)
+	require.Equal(t, mergedEstimate(t, parts...), got)
+	require.Less(t, estimateError(got, 100000), 0.05)
+
+	redis := NewRedis()
+	redis.Insert([]byte("a"))
+	require.Equal(t, uint64(1), EstimateUnion(redis, nil, NewRedis()))
+	require.Zero(t, EstimateUnion(parts[0], redis))
+}
+
+func Benchmark_EstimateUnion(b *testing.B) {
+	var parts []*Sketch
+	for i := 0; i < 500; i++ {
+		sk := New()
+		for j := 0; j < 2000; j++ {
+			sk.InsertHash(rand.Uint64())
+		}
+		parts = append(parts, sk)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		EstimateUnion(parts...)
+	}
+}
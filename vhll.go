@@ -0,0 +1,144 @@
+package hyperloglog
+
+import (
+	"fmt"
+	"math"
+)
+
+// VirtualHLL follows Xiao, Chen, Zhou, Luo and Cao, "Cardinality estimation
+// for elephant flows: A compact solution based on virtual register sharing"
+// (2017).
+
+const (
+	minPoolPrecision = 8
+	maxPoolPrecision = 30
+)
+
+// VirtualHLL estimates the cardinality of many keys, such as the number of
+// distinct destinations of every flow, with one shared pool of registers. Each
+// key owns a virtual Sketch whose 2^virtualPrecision registers are scattered
+// pseudo-randomly over the pool, so keys share registers with each other.
+// The estimate for a key subtracts the noise the other keys leave in its
+// registers, which is estimated from the whole pool.
+//
+// Memory is one byte per pool register, whatever the number of keys. The
+// noise grows with the total cardinality, so the pool should have several
+// times more registers than the expected total, and small keys have a larger
+// relative error than with a Sketch of their own.
+//
+// Use NewVirtualHLL to create one; the zero value is not usable.
+type VirtualHLL struct {
+	p    uint8
+	vp   uint8
+	regs []uint8
+	// hist counts the pool's registers by value, so that the pool's
+	// estimate does not have to scan it.
+	hist []uint64
+}
+
+// NewVirtualHLL returns an empty VirtualHLL with a pool of 2^poolPrecision
+// registers and virtual sketches of 2^virtualPrecision registers. The virtual
+// precision has to be >= 4 and <= 18, otherwise ErrorInvalidPrecision is
+// returned; a pool precision outside [8, 30] or not larger than the virtual
+// precision returns an error wrapping ErrorInvalidParameter.
+func NewVirtualHLL(poolPrecision, virtualPrecision uint8) (*VirtualHLL, error) {
+	if err := checkPrecision(virtualPrecision); err != nil {
+		return nil, err
+	}
+	if poolPrecision < minPoolPrecision || poolPrecision > maxPoolPrecision || poolPrecision <= virtualPrecision {
+		return nil, fmt.Errorf("hyperloglog: pool precision %d outside [%d, %d] or not above virtual precision %d: %w", poolPrecision, minPoolPrecision, maxPoolPrecision, virtualPrecision, ErrorInvalidParameter)
+	}
+	m := uint64(1) << poolPrecision
+	v := &VirtualHLL{
+		p:    poolPrecision,
+		vp:   virtualPrecision,
+		regs: make([]uint8, m),
+		hist: make([]uint64, maxRho(virtualPrecision)+1),
+	}
+	v.hist[0] = m
+	return v, nil
+}
+
+// register returns the pool index of the key's virtual register i: the i-th
+// value of a SplitMix64 stream seeded by the key's hash.
+func (v *VirtualHLL) register(key uint64, i uint64) uint64 {
+	r := splitMix64(key + i*0x9e3779b97f4a7c15)
+	return r.next() >> (64 - v.p)
+}
+
+// Insert hashes key and value with the package's MetroHash64 seed and adds
+// the value to key's virtual sketch.
+func (v *VirtualHLL) Insert(key, value []byte) { v.InsertHash(hash(key), hash(value)) }
+
+// InsertHash adds a uniformly distributed 64-bit hash x to the virtual sketch
+// of the key whose hash is key.
+func (v *VirtualHLL) InsertHash(key, x uint64) {
+	i, r := getPosVal(x, v.vp)
+	j := v.register(key, i)
+	if old := v.regs[j]; r > old {
+		v.regs[j] = r
+		v.hist[old]--
+		v.hist[r]++
+	}
+}
+
+// Estimate returns the cardinality estimate of key, hashed with the package's
+// MetroHash64 seed.
+func (v *VirtualHLL) Estimate(key []byte) uint64 { return v.EstimateHash(hash(key)) }
+
+// EstimateHash returns the cardinality estimate of the key whose hash is key.
+func (v *VirtualHLL) EstimateHash(key uint64) uint64 {
+	s := uint64(1) << v.vp
+	var sum, ez float64
+	for i := range s {
+		r := v.regs[v.register(key, i)]
+		if r == 0 {
+			ez++
+		}
+		sum += math.Ldexp(1, -int(r))
+	}
+	ns := float64(estimateDense(v.vp, sum, ez))
+
+	// A virtual register is any pool register, so the pool's estimate
+	// scaled to s registers is the noise the other keys leave.
+	fs, fm := float64(s), math.Ldexp(1, int(v.p))
+	est := fm * fs / (fm - fs) * (ns/fs - v.noise()/fm)
+	return uint64(max(0, est) + 0.5)
+}
+
+// noise is the pool's HyperLogLog estimate, with linear counting for small
+// cardinalities. It is not the total cardinality of all keys, since each key
+// only reaches 2^vp registers, but it is what a random register holds on
+// average.
+func (v *VirtualHLL) noise() float64 {
+	m := math.Ldexp(1, int(v.p))
+	var sum float64
+	for r, n := range v.hist {
+		sum += math.Ldexp(float64(n), -r)
+	}
+	est := alpha(m) * m * m / sum
+	if zeros := float64(v.hist[0]); est <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/zeros)
+	}
+	return est
+}
+
+// Merge adds other, built with the same pool and virtual precisions, to v.
+// Otherwise an error wrapping ErrorPrecisionMismatch is returned and v is
+// unchanged.
+func (v *VirtualHLL) Merge(other *VirtualHLL) error {
+	if other == nil {
+		return nil
+	}
+	if v.p != other.p || v.vp != other.vp {
+		return fmt.Errorf("hyperloglog: cannot merge pool precision %d with virtual precision %d and pool precision %d with virtual precision %d: %w", v.p, v.vp, other.p, other.vp, ErrorPrecisionMismatch)
+	}
+	for j, r := range other.regs {
+		if old := v.regs[j]; r > old {
+			v.regs[j] = r
+			v.hist[old]--
+			v.hist[r]++
+		}
+	}
+	return nil
+}
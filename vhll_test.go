@@ -0,0 +1,91 @@
+package hyperloglog
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualHLL_Error(t *testing.T) {
+	_, err := NewVirtualHLL(20, 3)
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	for _, p := range []uint8{7, 31, 12} {
+		_, err = NewVirtualHLL(p, 12)
+		require.ErrorIs(t, err, ErrorInvalidParameter, "%d", p)
+	}
+	a, _ := NewVirtualHLL(16, 8)
+	b, _ := NewVirtualHLL(16, 9)
+	require.ErrorIs(t, a.Merge(b), ErrorPrecisionMismatch)
+}
+
+func TestVirtualHLL_Estimate(t *testing.T) {
+	const pool, virtual = 22, 10
+	v, err := NewVirtualHLL(pool, virtual)
+	require.NoError(t, err)
+	require.Zero(t, v.EstimateHash(1))
+
+	// 20 elephant flows, 50 small flows and 200000 mice, about 2.4 million
+	// pairs in all. The first 1000 mice are checked too.
+	exact := make(map[uint64]int)
+	for key := uint64(0); key < 20; key++ {
+		exact[key] = 10000 + 5000*int(key)
+	}
+	for key := uint64(20); key < 70; key++ {
+		exact[key] = 500 + 10*int(key-20)
+	}
+	total := 0
+	for key, n := range exact {
+		for i := 0; i < n; i++ {
+			x := rand.Uint64()
+			v.InsertHash(key, x)
+			v.InsertHash(key, x)
+		}
+		total += n
+	}
+	for key := uint64(100); key < 200100; key++ {
+		n := 1 + rand.Intn(10)
+		if key < 1100 {
+			exact[key] = n
+		}
+		for i := 0; i < n; i++ {
+			v.InsertHash(key, rand.Uint64())
+		}
+		total += n
+	}
+
+	// A virtual sketch of s registers holds its key's n elements and about
+	// total*s/m of the others', and estimates them with a relative standard
+	// error of 1.04/sqrt(s); the estimator scales that by m/(m-s).
+	s, m := math.Ldexp(1, virtual), math.Ldexp(1, pool)
+	var sumSq float64
+	for key, n := range exact {
+		sigma := 1.04 / math.Sqrt(s) * m / (m - s) * (float64(n) + float64(total)*s/m)
+		got := float64(v.EstimateHash(key))
+		z := (got - float64(n)) / sigma
+		require.LessOrEqual(t, math.Abs(z), 6.0, "key %d: exact %d, got %.0f, relative error %.3f, sigma %.3f", key, n, got, got/float64(n)-1, sigma/float64(n))
+		sumSq += z * z
+	}
+	require.LessOrEqual(t, math.Sqrt(sumSq/float64(len(exact))), 1.2)
+}
+
+func TestVirtualHLL_Merge(t *testing.T) {
+	a, _ := NewVirtualHLL(16, 8)
+	b, _ := NewVirtualHLL(16, 8)
+	all, _ := NewVirtualHLL(16, 8)
+	for i := 0; i < 100000; i++ {
+		key, x := []byte{byte(i % 7)}, []byte{byte(i), byte(i >> 8), byte(i >> 16)}
+		if i%2 == 0 {
+			a.Insert(key, x)
+		} else {
+			b.Insert(key, x)
+		}
+		all.Insert(key, x)
+	}
+	require.NoError(t, a.Merge(b))
+	require.Equal(t, all.regs, a.regs)
+	require.Equal(t, all.hist, a.hist)
+	require.Equal(t, all.Estimate([]byte{3}), a.Estimate([]byte{3}))
+	require.LessOrEqual(t, 100*estimateError(a.Estimate([]byte{3}), 100000/7), 20.0)
+}
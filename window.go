@@ -0,0 +1,154 @@
+package hyperloglog
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// SlidingWindow follows Chabchoub and Hébrail, "Sliding HyperLogLog:
+// Estimating cardinality in a data stream over a sliding window" (2010).
+
+// SlidingWindow is a HyperLogLog sketch over the most recent part of a
+// stream. Instead of a single rho, each register keeps its list of future
+// possible maxima: the (timestamp, rho) pairs that are the register's largest
+// value for some window ending at the newest timestamp. A pair is dropped as
+// soon as a later pair with at least its rho arrives, and once it is older
+// than the window length, so the lists stay short.
+//
+// Queries only cover windows that end at the newest timestamp, such as the
+// last five minutes: a dropped pair may have been the largest value of a
+// window ending earlier, so [from, to) ranges cannot be answered. Nor can two
+// SlidingWindows be merged or serialized; TimeSeriesSketch answers arbitrary
+// ranges and supports both, at the granularity of its buckets.
+//
+// Use NewSlidingWindow to create one; the zero value is not usable.
+type SlidingWindow struct {
+	p      uint8
+	window int64
+	// latest is the newest timestamp inserted, in Unix nanoseconds.
+	latest int64
+	regs   [][]windowEntry
+}
+
+// windowEntry is a pair of a register's list. Within a list the timestamps
+// increase and the rhos strictly decrease.
+type windowEntry struct {
+	t   int64
+	rho uint8
+}
+
+// NewSlidingWindow returns an empty SlidingWindow with 2^precision registers
+// that answers queries over up to the last window of time. The precision has
+// to be >= 4 and <= 18, otherwise ErrorInvalidPrecision is returned; a window
+// that is not positive returns an error wrapping ErrorInvalidParameter.
+func NewSlidingWindow(precision uint8, window time.Duration) (*SlidingWindow, error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("hyperloglog: window %v is not positive: %w", window, ErrorInvalidParameter)
+	}
+	return &SlidingWindow{
+		p:      precision,
+		window: int64(window),
+		latest: math.MinInt64,
+		regs:   make([][]windowEntry, 1<<precision),
+	}, nil
+}
+
+// InsertAt hashes e with the package's MetroHash64 seed and adds it to w as
+// seen at t.
+func (w *SlidingWindow) InsertAt(e []byte, t time.Time) { w.InsertHashAt(hash(e), t) }
+
+// InsertHashAt adds a uniformly distributed 64-bit hash to w as seen at t.
+// Timestamps do not have to arrive in order, but a hash older than the window
+// length before the newest timestamp has already expired and is ignored.
+func (w *SlidingWindow) InsertHashAt(x uint64, t time.Time) {
+	ts := t.UnixNano()
+	w.latest = max(w.latest, ts)
+	horizon := w.horizon()
+	if ts < horizon {
+		return
+	}
+	i, r := getPosVal(x, w.p)
+	list := w.regs[i]
+
+	// A pair at least as new with at least the same rho makes this one
+	// useless.
+	pos, _ := slices.BinarySearchFunc(list, ts, func(e windowEntry, ts int64) int {
+		return cmp.Compare(e.t, ts)
+	})
+	if pos < len(list) && list[pos].rho >= r {
+		w.regs[i] = prune(list, horizon)
+		return
+	}
+	// Older pairs with no larger rho, and pairs of the same timestamp, are
+	// dominated by this one.
+	start, end := pos, pos
+	for start > 0 && list[start-1].rho <= r {
+		start--
+	}
+	for end < len(list) && list[end].t == ts {
+		end++
+	}
+	list = slices.Replace(list, start, end, windowEntry{t: ts, rho: r})
+	w.regs[i] = prune(list, horizon)
+}
+
+// horizon returns the oldest timestamp w still answers for.
+func (w *SlidingWindow) horizon() int64 {
+	if w.latest < math.MinInt64+w.window {
+		return math.MinInt64
+	}
+	return w.latest - w.window
+}
+
+// prune drops the expired pairs at the front of list.
+func prune(list []windowEntry, horizon int64) []windowEntry {
+	n := 0
+	for n < len(list) && list[n].t < horizon {
+		n++
+	}
+	if n == 0 {
+		return list
+	}
+	return slices.Delete(list, 0, n)
+}
+
+// registersSince returns the value each register has over [since, newest].
+func (w *SlidingWindow) registersSince(since int64) []uint8 {
+	since = max(since, w.horizon())
+	regs := make([]uint8, len(w.regs))
+	for i, list := range w.regs {
+		// The first pair at or after since has the largest rho of the
+		// window.
+		pos, _ := slices.BinarySearchFunc(list, since, func(e windowEntry, ts int64) int {
+			return cmp.Compare(e.t, ts)
+		})
+		if pos < len(list) {
+			regs[i] = list[pos].rho
+		}
+	}
+	return regs
+}
+
+// EstimateSince returns the cardinality estimate of the hashes seen at or
+// after t. A t further back than the window length before the newest
+// timestamp is treated as the start of the window.
+func (w *SlidingWindow) EstimateSince(t time.Time) uint64 {
+	sum, ez := sumAndZeros(w.registersSince(t.UnixNano()))
+	return estimateDense(w.p, sum, ez)
+}
+
+// SketchSince returns a dense Sketch of the hashes seen at or after t, with
+// the same precision as w. A t further back than the window length before the
+// newest timestamp is treated as the start of the window. The Sketch is
+// independent of w.
+func (w *SlidingWindow) SketchSince(t time.Time) *Sketch {
+	sk := newSketchNoError(w.p, false)
+	sk.regs = w.registersSince(t.UnixNano())
+	return sk
+}
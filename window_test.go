@@ -0,0 +1,89 @@
+package hyperloglog
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingWindow_Error(t *testing.T) {
+	_, err := NewSlidingWindow(3, time.Minute)
+	require.ErrorIs(t, err, ErrorInvalidPrecision)
+	_, err = NewSlidingWindow(14, 0)
+	require.ErrorIs(t, err, ErrorInvalidParameter)
+}
+
+func TestSlidingWindow_EstimateSince(t *testing.T) {
+	w, err := NewSlidingWindow(14, time.Hour)
+	require.NoError(t, err)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Zero(t, w.EstimateSince(start))
+
+	// 1000 new users per minute for two hours, each seen twice.
+	for minute := 0; minute < 120; minute++ {
+		at := start.Add(time.Duration(minute) * time.Minute)
+		for i := 0; i < 1000; i++ {
+			x := rand.Uint64()
+			w.InsertHashAt(x, at)
+			w.InsertHashAt(x, at.Add(time.Second))
+		}
+	}
+	now := start.Add(119 * time.Minute)
+
+	for _, minutes := range []int{1, 10, 30, 60} {
+		since := now.Add(-time.Duration(minutes-1) * time.Minute)
+		exact := uint64(minutes * 1000)
+		ratio := 100 * estimateError(w.EstimateSince(since), exact)
+		require.LessOrEqual(t, ratio, 3.0, "last %d minutes: got %d", minutes, w.EstimateSince(since))
+
+		sk := w.SketchSince(since)
+		require.Equal(t, w.EstimateSince(since), sk.Estimate())
+	}
+
+	// Windows beyond the window length are clipped to it.
+	require.Equal(t, w.EstimateSince(now.Add(-time.Hour)), w.EstimateSince(start))
+
+	// Lists only keep possible maxima, so they stay short.
+	var entries int
+	for _, list := range w.regs {
+		entries += len(list)
+		for i := 1; i < len(list); i++ {
+			require.Less(t, list[i-1].t, list[i].t)
+			require.Greater(t, list[i-1].rho, list[i].rho)
+		}
+	}
+	require.Less(t, entries, 10*len(w.regs))
+}
+
+func TestSlidingWindow_OutOfOrder(t *testing.T) {
+	w, _ := NewSlidingWindow(10, time.Hour)
+	ordered, _ := NewSlidingWindow(10, time.Hour)
+	start := time.Unix(0, 0)
+
+	type event struct {
+		x  uint64
+		at time.Time
+	}
+	events := make([]event, 20000)
+	for i := range events {
+		events[i] = event{rand.Uint64(), start.Add(time.Duration(rand.Intn(3600)) * time.Second)}
+	}
+	for _, e := range events {
+		w.InsertHashAt(e.x, e.at)
+	}
+	for s := 0; s < 3600; s++ {
+		for _, e := range events {
+			if e.at.Equal(start.Add(time.Duration(s) * time.Second)) {
+				ordered.InsertHashAt(e.x, e.at)
+			}
+		}
+	}
+	require.Equal(t, ordered.regs, w.regs)
+
+	// Hashes older than the window are ignored.
+	before := w.EstimateSince(start)
+	w.InsertHashAt(rand.Uint64(), start.Add(-2*time.Hour))
+	require.Equal(t, before, w.EstimateSince(start))
+}